@@ -0,0 +1,164 @@
+package cproxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+)
+
+// runRequestActions applies the request actions of the matched rules. A
+// non-nil response answers the request without going upstream.
+func (p *Proxy) runRequestActions(req *http.Request, rules []Rule) (resp *http.Response) {
+	for _, rule := range rules {
+		for _, a := range rule.GetActions() {
+			switch a.Option {
+			case OPT_SET_REQUEST_HEADER:
+				req.Header.Set(a.Header, a.Value)
+			case OPT_DEL_REQUEST_HEADER:
+				req.Header.Del(a.Header)
+			case OPT_BLOCK:
+				if resp == nil && a.fire() {
+					resp = blockResponse(req, a)
+				}
+			case OPT_SCRIPT:
+				if resp != nil {
+					continue
+				}
+				s, err := LoadScript(a.Content)
+				if err != nil {
+					scriptLog.Error("load script", "script", a.Content, "err", err)
+					continue
+				}
+				if resp, err = s.BeforeSendRequest(req, a.GetTimeout()); err != nil {
+					scriptLog.Error("run script", "script", a.Content, "err", err)
+				}
+			}
+		}
+	}
+	return
+}
+
+// runResponseActions runs the actions of all matched rules in rule order. A
+// flow is answered by at most one use-local-response, however many rules ask
+// for it. Capture actions are left to capture.
+func (p *Proxy) runResponseActions(w http.ResponseWriter, req *http.Request, resp *http.Response, rules []Rule) (responded bool) {
+	for _, rule := range rules {
+		for _, a := range rule.GetActions() {
+			switch a.Option {
+			case OPT_SET_RESPONSE_HEADER:
+				resp.Header.Set(a.Header, a.Value)
+			case OPT_DEL_RESPONSE_HEADER:
+				resp.Header.Del(a.Header)
+			case OPT_SCRIPT:
+				if responded {
+					continue
+				}
+				s, err := LoadScript(a.Content)
+				if err != nil {
+					scriptLog.Error("load script", "script", a.Content, "err", err)
+					continue
+				}
+				if err = s.BeforeSendResponse(req, resp, a.GetTimeout()); err != nil {
+					scriptLog.Error("run script", "script", a.Content, "err", err)
+				}
+			case OPT_USE_LOCAL_RESPONSE:
+				if !responded {
+					responded = writeLocalResponse(w, resp, a.Content)
+				}
+			case OPT_RESET, OPT_CLOSE, OPT_TRUNCATE, OPT_BAD_CHUNKED:
+				if !responded && a.fire() {
+					writeFault(w, resp, a)
+					responded = true
+				}
+			}
+		}
+	}
+	return
+}
+
+// runWsActions returns the frame to forward to the client, and false when
+// the frame has been answered or dropped already.
+func (p *Proxy) runWsActions(w *Conn, req *http.Request, message []byte, rules []Rule) ([]byte, bool) {
+	responded := false
+	for _, rule := range rules {
+		for _, a := range rule.GetActions() {
+			switch a.Option {
+			case OPT_SCRIPT:
+				if responded {
+					continue
+				}
+				var forward bool
+				message, forward = runWsScript(a, req, message, WS_FROM_SERVER)
+				responded = !forward
+			case OPT_USE_LOCAL_RESPONSE:
+				if !responded {
+					responded = writeLocalWsMessage(w, a.Content)
+				}
+			case OPT_BLOCK, OPT_RESET, OPT_CLOSE, OPT_TRUNCATE:
+				if !responded && a.fire() {
+					var forward bool
+					message, forward = wsFault(w, message, a)
+					responded = !forward
+				}
+			}
+		}
+	}
+	return message, !responded
+}
+
+// runWsScripts runs the script actions of the rules on a frame from the
+// client. It returns the frame to forward, and false to drop it.
+func runWsScripts(req *http.Request, message []byte, rules []Rule) ([]byte, bool) {
+	for _, rule := range rules {
+		for _, a := range rule.GetActions() {
+			if a.Option != OPT_SCRIPT {
+				continue
+			}
+			var forward bool
+			if message, forward = runWsScript(a, req, message, WS_FROM_CLIENT); !forward {
+				return nil, false
+			}
+		}
+	}
+	return message, true
+}
+
+// runWsScript calls the onWebSocketMessage hook of a script action.
+func runWsScript(a Action, req *http.Request, message []byte, from string) ([]byte, bool) {
+	s, err := LoadScript(a.Content)
+	if err != nil {
+		scriptLog.Error("load script", "script", a.Content, "err", err)
+		return message, true
+	}
+	message, forward, err := s.OnWebSocketMessage(req, message, from, a.GetTimeout())
+	if err != nil {
+		scriptLog.Error("run script", "script", a.Content, "err", err)
+	}
+	return message, forward
+}
+
+func writeLocalResponse(w http.ResponseWriter, resp *http.Response, filePath string) bool {
+	f, err := os.OpenFile(filePath, os.O_RDONLY, 0666)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(resp.StatusCode)
+
+	io.Copy(w, f)
+	return true
+}
+
+func writeLocalWsMessage(w *Conn, filePath string) bool {
+	f, err := os.OpenFile(filePath, os.O_RDONLY, 0666)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	io.Copy(w, f)
+	return true
+}
@@ -0,0 +1,92 @@
+package cproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestActionPipeline(t *testing.T) {
+	first := writeTemp(t, "first.json", "first")
+	second := writeTemp(t, "second.json", "second")
+	rules := writeTemp(t, "rules.yml", `rules:
+  - host: api.test
+    regex: '^/v1/'
+    actions:
+      - option: set-request-header
+        header: X-Step
+        value: exact
+      - option: set-response-header
+        header: X-Step
+        value: exact
+      - option: use-local-response
+        content: `+first+`
+  - host: '*.test'
+    regex: '^/v1/'
+    option: use-local-response
+    content: `+second+`
+    actions:
+      - option: set-response-header
+        header: X-Glob
+        value: "1"
+      - option: del-response-header
+        header: X-Upstream
+  - host: default
+    regex: '^/v1/stop'
+    priority: 1
+    stop: true
+    actions:
+      - option: set-request-header
+        header: X-Stop
+        value: "1"
+  - host: default
+    regex: '.*'
+    actions:
+      - option: set-response-header
+        header: X-Default
+        value: "1"
+`)
+	p := NewProxy("", "", rules, "", "")
+	p.Level = LEVEL_0
+
+	for _, test := range []struct {
+		uri        string
+		reqHeader  string // X-Step and X-Stop as the upstream would see them
+		body       string
+		respHeader string // X-Step, X-Glob, X-Default and X-Upstream sent to the client
+	}{
+		// actions run in rule order, the first local response wins and
+		// header actions after it come too late for the client
+		{"/v1/users", "exact,", "first", "exact,,,yes"},
+		// stop ends the pipeline with the stop rule itself
+		{"/v1/stop", ",1", "upstream", ",,,yes"},
+		{"/v2/users", ",", "upstream", ",,1,yes"},
+	} {
+		req := httptest.NewRequest("GET", "http://api.test"+test.uri, nil)
+		ctx := newContext(p, "", "http", req.Host)
+		req, _ = p.BeforeRequest(ctx, req)
+		if got := req.Header.Get("X-Step") + "," + req.Header.Get("X-Stop"); got != test.reqHeader {
+			t.Errorf("%s: request headers %q, want %q", test.uri, got, test.reqHeader)
+		}
+
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"X-Upstream": {"yes"}},
+			Body:       ioutil.NopCloser(strings.NewReader("upstream")),
+		}
+		w := httptest.NewRecorder()
+		if _, written := p.BeforeResponse(ctx, w, req, resp); !written {
+			w.Body.WriteString("upstream")
+			copyHeader(w.Header(), resp.Header)
+		}
+		h := w.Header()
+		if got := strings.Join([]string{h.Get("X-Step"), h.Get("X-Glob"), h.Get("X-Default"), h.Get("X-Upstream")}, ","); got != test.respHeader {
+			t.Errorf("%s: response headers %q, want %q", test.uri, got, test.respHeader)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("%s: body %q, want %q", test.uri, w.Body.String(), test.body)
+		}
+	}
+}
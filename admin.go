@@ -0,0 +1,479 @@
+package cproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ADMIN_MAX_RULE caps the size of a rule posted to the admin API.
+var ADMIN_MAX_RULE int64 = 1 << 20
+
+// adminRefusedOptions name a local file to read, write or run; rules added
+// through the API may not use them.
+var adminRefusedOptions = map[string]bool{
+	OPT_USE_LOCAL_RESPONSE: true,
+	OPT_TO_HAR:             true,
+	OPT_TO_FILE:            true,
+	OPT_TO_DB:              true,
+	OPT_SCRIPT:             true,
+}
+
+// Admin is the HTTP API controlling a running proxy, served on a port of
+// its own. Scalars are form values, rules YAML or JSON bodies, and answers
+// JSON:
+//
+//	GET    /api/status                       level, filter, upstream and rule file
+//	POST   /api/level        level=2         and/or log=warn,capture=debug
+//	POST   /api/filter       filter=regex    "" goes back to the rules
+//	POST   /api/upstream     proxy=uri       "" goes direct
+//	GET    /api/rules                        the loaded rules in match order
+//	POST   /api/rules                        add the rule in the body
+//	DELETE /api/rules?id=api-1               remove an added rule
+//	POST   /api/rules/enable?id=, /api/rules/disable?id=
+//	POST   /api/rules/reload                 read the rule file again
+//	GET    /api/groups
+//	POST   /api/groups/enable?name=, /api/groups/disable?name=
+//	GET    /api/flows?after=&limit=          recent flows, capture records with seq
+//	GET    /api/flows/<id>?format=           the records of one flow, or curl or har
+//	GET    /api/stream?host=&path=&status=   new flows as they happen, SSE or WebSocket
+//	GET    /api/breakpoints                  flows held by breakpoint actions
+//	POST   /api/breakpoints/<id>             resume, drop or respond, JSON edits in the body
+//	GET    /ca.crt                           the root CA to install on clients
+//	GET    /                                 the web UI
+type Admin struct {
+	Proxy *Proxy
+	Token string // wanted as Bearer token or token parameter, "" for none
+
+	mux *http.ServeMux
+}
+
+func NewAdmin(p *Proxy) *Admin {
+	a := &Admin{Proxy: p, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/api/status", a.status)
+	a.mux.HandleFunc("/api/level", a.level)
+	a.mux.HandleFunc("/api/filter", a.filter)
+	a.mux.HandleFunc("/api/upstream", a.upstream)
+	a.mux.HandleFunc("/api/rules", a.rules)
+	a.mux.HandleFunc("/api/rules/enable", a.toggleRule(true))
+	a.mux.HandleFunc("/api/rules/disable", a.toggleRule(false))
+	a.mux.HandleFunc("/api/rules/reload", a.reloadRules)
+	a.mux.HandleFunc("/api/groups", a.groups)
+	a.mux.HandleFunc("/api/groups/enable", a.toggleGroup(true))
+	a.mux.HandleFunc("/api/groups/disable", a.toggleGroup(false))
+	a.mux.HandleFunc("/api/flows", a.flows)
+	a.mux.HandleFunc("/api/flows/", a.flow)
+	a.mux.HandleFunc("/api/stream", a.stream)
+	a.mux.HandleFunc("/api/breakpoints", a.breakpoints)
+	a.mux.HandleFunc("/api/breakpoints/", a.resolveBreakpoint)
+	a.mux.HandleFunc("/ca.crt", a.ca)
+	a.mux.Handle("/", uiHandler())
+	return a
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		// a page of another site, riding on the browser of the user
+		adminError(w, http.StatusForbidden, fmt.Errorf("cross-origin request refused"))
+		return
+	}
+	if a.Token != "" {
+		token := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			adminError(w, http.StatusUnauthorized, fmt.Errorf("bad or missing token"))
+			return
+		}
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// RunAdmin serves the admin API on addr. The flows are there when p.Recent
+// is set. Without a token one is made up and printed once to stderr, never
+// to the log, as the API can change what the proxy does and shows every flow
+// it sees.
+func (p *Proxy) RunAdmin(addr, token string) error {
+	a := NewAdmin(p)
+	a.Token = token
+	if a.Token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		a.Token = hex.EncodeToString(b)
+		fmt.Fprintf(os.Stderr, "admin token %s, web UI http://%s/?token=%s\n", a.Token, addr, a.Token)
+	}
+	adminLog.Info("admin listening", "addr", addr)
+	return http.ListenAndServe(addr, a)
+}
+
+type adminStatus struct {
+	Level    int    `json:"level"`
+	LogLevel string `json:"log_level"`
+	Filter   string `json:"filter"`
+	Upstream string `json:"upstream"`
+	RuleFile string `json:"rule_file"`
+	Rules    int    `json:"rules"`
+}
+
+func (a *Admin) status(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	st := adminStatus{
+		Level:    a.Proxy.GetLevel(),
+		LogLevel: LogLevels(),
+		Filter:   a.Proxy.Regexp.Filter(),
+		RuleFile: a.Proxy.Regexp.FilePath(),
+		Rules:    len(a.Proxy.Regexp.Rules()),
+	}
+	if u := a.Proxy.GetProxy(); u != nil {
+		st.Upstream = u.String()
+	}
+	adminJSON(w, http.StatusOK, st)
+}
+
+func (a *Admin) level(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	level, err := strconv.Atoi(valueOrDefault(r.FormValue("level"), strconv.Itoa(a.Proxy.GetLevel())))
+	if err != nil || level < LEVEL_0 || level > LEVEL_3 {
+		adminError(w, http.StatusBadRequest, fmt.Errorf("level must be 0 to 3"))
+		return
+	}
+	if spec := r.FormValue("log"); spec != "" {
+		if err := SetLogLevels(spec); err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	a.Proxy.SetLevel(level)
+	a.status(w, getRequest(r))
+}
+
+func (a *Admin) filter(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if err := a.Proxy.Regexp.SetFilter(r.FormValue("filter")); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.status(w, getRequest(r))
+}
+
+func (a *Admin) upstream(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if err := a.Proxy.SetProxy(r.FormValue("proxy")); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.status(w, getRequest(r))
+}
+
+func (a *Admin) rules(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, ADMIN_MAX_RULE))
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		rule, err := decodeAdminRule(body)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		for _, act := range rule.GetActions() {
+			if adminRefusedOptions[act.Option] {
+				adminError(w, http.StatusForbidden, fmt.Errorf("%s names a local file, set it in the rule file instead", act.Option))
+				return
+			}
+			if act.Option == OPT_TO_WEBHOOK && act.Content != "" && act.Content != a.Proxy.Webhook.URL {
+				adminError(w, http.StatusForbidden, fmt.Errorf("to-webhook may only post to the --webhook url, set others in the rule file"))
+				return
+			}
+		}
+		id, err := a.Proxy.Regexp.AddRule(rule)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		adminJSON(w, http.StatusCreated, map[string]string{"id": id})
+	case http.MethodDelete:
+		if err := a.Proxy.Regexp.RemoveRule(r.FormValue("id")); err != nil {
+			adminError(w, ruleErrorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminJSON(w, http.StatusOK, a.Proxy.Regexp.Rules())
+	}
+}
+
+// decodeAdminRule reads the single rule of a request body as strictly as
+// ReadRuleFile reads a rule file.
+func decodeAdminRule(body []byte) (Rule, error) {
+	var rule Rule
+	dec := yaml.NewDecoder(bytes.NewReader(body))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rule); err != nil {
+		if err == io.EOF {
+			return rule, fmt.Errorf("no rule in the body")
+		}
+		return rule, err
+	}
+	if rule.Option != "" || rule.Content != "" {
+		return rule, fmt.Errorf("line %d: option/content are version 1 keys, use actions", rule.Line)
+	}
+	var more yaml.Node
+	if err := dec.Decode(&more); err != io.EOF {
+		return rule, fmt.Errorf("line %d: one rule per request", more.Line)
+	}
+	return rule, nil
+}
+
+func (a *Admin) toggleRule(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if err := a.Proxy.Regexp.SetRuleEnabled(r.FormValue("id"), enabled); err != nil {
+			adminError(w, ruleErrorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (a *Admin) reloadRules(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	n, err := a.Proxy.Regexp.Reload()
+	if err != nil {
+		adminError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	rulesLog.Info("rules reloaded", "file", a.Proxy.Regexp.FilePath(), "rules", n)
+	adminJSON(w, http.StatusOK, map[string]int{"rules": n})
+}
+
+func (a *Admin) groups(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	adminJSON(w, http.StatusOK, a.Proxy.Regexp.Groups())
+}
+
+func (a *Admin) toggleGroup(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		name := r.FormValue("name")
+		if _, ok := a.Proxy.Regexp.Groups()[name]; !ok {
+			adminError(w, http.StatusNotFound, fmt.Errorf("no group %q", name))
+			return
+		}
+		a.Proxy.Regexp.SetGroup(name, enabled)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// adminFlow is a recent flow as the admin API returns it, the capture
+// record with its number in the buffer.
+type adminFlow struct {
+	Seq uint64 `json:"seq"`
+	*Record
+}
+
+// adminRecord returns the record of a flow, without the bodies unless they
+// are asked for.
+func adminRecord(rf RecentFlow, bodies bool) adminFlow {
+	r := rf.Flow.Record()
+	if !bodies {
+		r.Request.Body = nil
+		if r.Response != nil {
+			r.Response.Body = nil
+		}
+		if r.Frame != nil {
+			r.Frame.Data = nil
+		}
+	}
+	return adminFlow{Seq: rf.Seq, Record: r}
+}
+
+func adminFlows(flows []RecentFlow, bodies bool) []adminFlow {
+	list := make([]adminFlow, 0, len(flows))
+	for _, rf := range flows {
+		list = append(list, adminRecord(rf, bodies))
+	}
+	return list
+}
+
+func (a *Admin) flows(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) || !a.keepsFlows(w) {
+		return
+	}
+	var after uint64
+	limit := 100
+	var err error
+	if v := r.FormValue("after"); v != "" {
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			adminError(w, http.StatusBadRequest, fmt.Errorf("after: %v", err))
+			return
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			adminError(w, http.StatusBadRequest, fmt.Errorf("limit must be a number, 0 for all"))
+			return
+		}
+	}
+	bodies := r.FormValue("bodies") != "0"
+	adminJSON(w, http.StatusOK, adminFlows(a.Proxy.Recent.Flows(after, limit), bodies))
+}
+
+func (a *Admin) flow(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) || !a.keepsFlows(w) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/flows/")
+	flows := a.Proxy.Recent.Find(id)
+	if len(flows) == 0 {
+		adminError(w, http.StatusNotFound, fmt.Errorf("no recent flow %s", id))
+		return
+	}
+	switch r.FormValue("format") {
+	case "curl":
+		if flows[0].Flow.Response == nil {
+			adminError(w, http.StatusBadRequest, fmt.Errorf("%s is a WebSocket connection", id))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s\n", flows[0].Flow.Curl())
+	case "har":
+		list := make([]*Flow, 0, len(flows))
+		for _, rf := range flows {
+			list = append(list, rf.Flow)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.har"`, id))
+		WriteHarFlows(w, list)
+	case "", "json":
+		adminJSON(w, http.StatusOK, adminFlows(flows, r.FormValue("bodies") != "0"))
+	default:
+		adminError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q, want json, curl or har", r.FormValue("format")))
+	}
+}
+
+func (a *Admin) keepsFlows(w http.ResponseWriter) bool {
+	if a.Proxy.Recent == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("the proxy keeps no recent flows"))
+		return false
+	}
+	return true
+}
+
+func (a *Admin) breakpoints(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	adminJSON(w, http.StatusOK, a.Proxy.Breakpoints())
+}
+
+func (a *Admin) resolveBreakpoint(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var e BreakpointEdit
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, ADMIN_MAX_RULE)).Decode(&e); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	err := a.Proxy.ResolveBreakpoint(strings.TrimPrefix(r.URL.Path, "/api/breakpoints/"), e)
+	if err == ErrUnknownBreakpoint {
+		adminError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) ca(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if err := EnsureRootCA(); err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	crt, err := ioutil.ReadFile(caPubPath)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="free-proxy-ca.crt"`)
+	w.Write(crt)
+}
+
+// allowMethods answers 405 to a request of another method.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	adminError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	return false
+}
+
+// getRequest is r as a GET, for answering a change with the new status.
+func getRequest(r *http.Request) *http.Request {
+	get := *r
+	get.Method = http.MethodGet
+	return &get
+}
+
+func ruleErrorStatus(err error) int {
+	if err == ErrUnknownRule {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+func adminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	adminJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,158 @@
+package cproxy
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tokenAdmin serves the admin API of a proxy wanting the token secret.
+func tokenAdmin(t *testing.T) (*Proxy, *httptest.Server) {
+	p := NewProxy("", "", "", "", "")
+	p.Webhook.URL = "http://hooks.test/flows"
+	a := NewAdmin(p)
+	a.Token = "secret"
+	srv := httptest.NewServer(a)
+	t.Cleanup(srv.Close)
+	return p, srv
+}
+
+// adminDo sends a request to the admin server with the header pairs and
+// returns the status and the body.
+func adminDo(t *testing.T, method, url, body string, header ...string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestAdminToken(t *testing.T) {
+	_, srv := tokenAdmin(t)
+	for _, test := range []struct {
+		name   string
+		path   string
+		header []string
+		status int
+	}{
+		{"missing", "/api/status", nil, http.StatusUnauthorized},
+		{"bad bearer", "/api/status", []string{"Authorization", "Bearer wrong"}, http.StatusUnauthorized},
+		{"bad parameter", "/api/status?token=wrong", nil, http.StatusUnauthorized},
+		{"bearer", "/api/status", []string{"Authorization", "Bearer secret"}, http.StatusOK},
+		{"parameter", "/api/status?token=secret", nil, http.StatusOK},
+		{"ui", "/", nil, http.StatusUnauthorized},
+	} {
+		if status, body := adminDo(t, "GET", srv.URL+test.path, "", test.header...); status != test.status {
+			t.Errorf("%s: got %d %s, want %d", test.name, status, body, test.status)
+		}
+	}
+}
+
+func TestAdminCrossOrigin(t *testing.T) {
+	_, srv := tokenAdmin(t)
+	for _, test := range []struct {
+		origin string
+		status int
+	}{
+		{"http://evil.test", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+		{srv.URL, http.StatusOK},
+		{"", http.StatusOK},
+	} {
+		header := []string{"Authorization", "Bearer secret", "Content-Type", "application/x-www-form-urlencoded"}
+		if test.origin != "" {
+			header = append(header, "Origin", test.origin)
+		}
+		if status, body := adminDo(t, "POST", srv.URL+"/api/level", "level=1", header...); status != test.status {
+			t.Errorf("origin %q: got %d %s, want %d", test.origin, status, body, test.status)
+		}
+	}
+}
+
+func TestAdminAddRule(t *testing.T) {
+	_, srv := tokenAdmin(t)
+	auth := []string{"Authorization", "Bearer secret"}
+	for _, test := range []struct {
+		name   string
+		body   string
+		status int
+		err    string // in the answer
+	}{
+		{"script", "regex: '^/'\nactions: [{option: script, content: /tmp/x.js}]", http.StatusForbidden, "script names a local file"},
+		{"to-file", "regex: '^/'\nactions: [{option: to-file, content: /etc/cron.d/x}]", http.StatusForbidden, "to-file names a local file"},
+		{"use-local-response", `{"regex": "^/", "actions": [{"option": "use-local-response", "content": "/etc/passwd"}]}`, http.StatusForbidden, "use-local-response"},
+		{"other webhook", "regex: '^/'\nactions: [{option: to-webhook, content: 'http://evil.test/'}]", http.StatusForbidden, "--webhook"},
+		{"unknown field", "regex: '^/'\nactions:\n  - option: block\n    stauts: 503", http.StatusBadRequest, "line 4: field stauts not found"},
+		{"version 1 keys", "regex: '^/'\noption: block", http.StatusBadRequest, "line 1: option/content are version 1 keys"},
+		{"two rules", "regex: '^/a'\n---\nregex: '^/b'", http.StatusBadRequest, "one rule per request"},
+		{"empty", "", http.StatusBadRequest, "no rule"},
+		{"invalid", "host: api.test\nregex: '('\nactions: [{option: block}]", http.StatusBadRequest, "line 1: regex"},
+		{"configured webhook", "regex: '^/'\nactions: [{option: to-webhook, content: 'http://hooks.test/flows'}]", http.StatusCreated, ""},
+	} {
+		status, body := adminDo(t, "POST", srv.URL+"/api/rules", test.body, auth...)
+		if status != test.status || !strings.Contains(body, test.err) {
+			t.Errorf("%s: got %d %s, want %d %s", test.name, status, body, test.status, test.err)
+		}
+	}
+}
+
+func TestAdminAddRemoveRule(t *testing.T) {
+	p, srv := tokenAdmin(t)
+	auth := []string{"Authorization", "Bearer secret"}
+	status, body := adminDo(t, "POST", srv.URL+"/api/rules", `{"host": "api.test", "regex": "^/v1", "actions": [{"option": "block", "status": 503}]}`, auth...)
+	var added struct{ ID string }
+	if status != http.StatusCreated || json.Unmarshal([]byte(body), &added) != nil || added.ID == "" {
+		t.Fatalf("add: got %d %s", status, body)
+	}
+	if rules := p.Regexp.MatchAll("api.test", "/v1/users"); len(rules) != 1 || rules[0].ID != added.ID {
+		t.Fatalf("added rule %s not matched: %+v", added.ID, rules)
+	}
+	status, body = adminDo(t, "GET", srv.URL+"/api/rules", "", auth...)
+	var infos []RuleInfo
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &infos) != nil || len(infos) != 1 || infos[0].ID != added.ID {
+		t.Errorf("list: got %d %s", status, body)
+	}
+
+	if status, body := adminDo(t, "DELETE", srv.URL+"/api/rules?id="+added.ID, "", auth...); status != http.StatusNoContent {
+		t.Errorf("delete: got %d %s", status, body)
+	}
+	if rules := p.Regexp.MatchAll("api.test", "/v1/users"); len(rules) > 0 && rules[0].ID == added.ID {
+		t.Errorf("deleted rule %s still matched", added.ID)
+	}
+	if status, body := adminDo(t, "DELETE", srv.URL+"/api/rules?id="+added.ID, "", auth...); status != http.StatusNotFound {
+		t.Errorf("delete again: got %d %s, want 404", status, body)
+	}
+}
+
+func TestAdminCA(t *testing.T) {
+	tempCA(t)
+	_, srv := tokenAdmin(t)
+	if status, _ := adminDo(t, "GET", srv.URL+"/ca.crt", ""); status != http.StatusUnauthorized {
+		t.Errorf("without token: got %d, want 401", status)
+	}
+	status, body := adminDo(t, "GET", srv.URL+"/ca.crt", "", "Authorization", "Bearer secret")
+	if status != http.StatusOK {
+		t.Fatalf("got %d %s", status, body)
+	}
+	block, _ := pem.Decode([]byte(body))
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Errorf("got %q, want a PEM certificate", body)
+	}
+	if crt, err := ioutil.ReadFile(caPubPath); err != nil || string(crt) != body {
+		t.Errorf("served CA differs from %s: %v", caPubPath, err)
+	}
+}
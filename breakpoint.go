@@ -0,0 +1,315 @@
+package cproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// BREAKPOINT_TIMEOUT is how long a breakpoint holds a flow when its action
+// sets no timeout; the flow then goes on unchanged.
+var BREAKPOINT_TIMEOUT = 5 * time.Minute
+
+const (
+	BREAKPOINT_REQUEST  = "request"  // held before the request goes upstream
+	BREAKPOINT_RESPONSE = "response" // held before the response goes to the client
+
+	BREAKPOINT_RESUME  = "resume"  // go on, with the edits if any
+	BREAKPOINT_DROP    = "drop"    // close the client connection
+	BREAKPOINT_RESPOND = "respond" // answer with the edited status, headers and body
+)
+
+var ErrUnknownBreakpoint = errors.New("no such breakpoint")
+
+// Breakpoint is a flow held by a breakpoint action, as the admin API shows
+// it. Body is without its Content-Encoding, base64 when it is not text.
+type Breakpoint struct {
+	ID         string      `json:"id"`
+	Flow       string      `json:"flow"`
+	Stage      string      `json:"stage"`
+	Time       time.Time   `json:"time"`
+	Expires    time.Time   `json:"expires"`
+	Method     string      `json:"method"`
+	Url        string      `json:"url"`
+	Status     int         `json:"status,omitempty"`
+	Header     http.Header `json:"headers"`
+	Body       string      `json:"body"`
+	BodyBase64 bool        `json:"body_base64,omitempty"`
+
+	done chan BreakpointEdit
+}
+
+// BreakpointEdit tells a held flow how to go on. Fields left empty keep
+// what was held; headers, when set, replace all of them.
+type BreakpointEdit struct {
+	Action     string      `json:"action"`
+	Method     string      `json:"method,omitempty"`
+	Url        string      `json:"url,omitempty"`
+	Status     int         `json:"status,omitempty"`
+	Header     http.Header `json:"headers,omitempty"`
+	Body       *string     `json:"body,omitempty"`
+	BodyBase64 bool        `json:"body_base64,omitempty"`
+}
+
+func (e *BreakpointEdit) validate(stage string) error {
+	switch e.Action {
+	case BREAKPOINT_RESUME, BREAKPOINT_DROP, BREAKPOINT_RESPOND:
+	default:
+		return fmt.Errorf("action must be %s, %s or %s", BREAKPOINT_RESUME, BREAKPOINT_DROP, BREAKPOINT_RESPOND)
+	}
+	if e.Status != 0 && (e.Status < 100 || e.Status > 599) {
+		return fmt.Errorf("status %d out of range", e.Status)
+	}
+	if e.Url != "" && stage == BREAKPOINT_REQUEST {
+		if u, err := url.Parse(e.Url); err != nil || u.Host == "" {
+			return fmt.Errorf("url %q is not absolute", e.Url)
+		}
+	}
+	_, err := e.body()
+	return err
+}
+
+// body returns the edited body, nil when it is kept.
+func (e *BreakpointEdit) body() ([]byte, error) {
+	if e.Body == nil {
+		return nil, nil
+	}
+	if !e.BodyBase64 {
+		return []byte(*e.Body), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(*e.Body)
+	if err != nil {
+		return nil, fmt.Errorf("body: %v", err)
+	}
+	return b, nil
+}
+
+type breakpoints struct {
+	held map[string]*Breakpoint
+	lock sync.Mutex
+}
+
+// breakpointAction returns the breakpoint action of the matched rules that
+// stops at stage, if any.
+func breakpointAction(rules []Rule, stage string) (Action, bool) {
+	for _, rule := range rules {
+		for _, a := range rule.GetActions() {
+			if a.Option == OPT_BREAKPOINT && (a.Content == "" || a.Content == stage) {
+				return a, true
+			}
+		}
+	}
+	return Action{}, false
+}
+
+// Breakpoints returns the flows held now, oldest first.
+func (p *Proxy) Breakpoints() []*Breakpoint {
+	p.breakpoints.lock.Lock()
+	defer p.breakpoints.lock.Unlock()
+	held := make([]*Breakpoint, 0, len(p.breakpoints.held))
+	for _, bp := range p.breakpoints.held {
+		held = append(held, bp)
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].Time.Before(held[j].Time) })
+	return held
+}
+
+// ResolveBreakpoint lets the held flow id go on as the edit says.
+func (p *Proxy) ResolveBreakpoint(id string, e BreakpointEdit) error {
+	p.breakpoints.lock.Lock()
+	defer p.breakpoints.lock.Unlock()
+	bp, ok := p.breakpoints.held[id]
+	if !ok {
+		return ErrUnknownBreakpoint
+	}
+	if err := e.validate(bp.Stage); err != nil {
+		return err
+	}
+	if e.Header != nil {
+		// keys typed by hand, content-type and the like
+		h := make(http.Header, len(e.Header))
+		for k, vv := range e.Header {
+			for _, v := range vv {
+				h.Add(k, v)
+			}
+		}
+		e.Header = h
+	}
+	delete(p.breakpoints.held, id)
+	bp.done <- e
+	return nil
+}
+
+// hold keeps bp until it is resolved or the timeout passes, which resumes
+// the flow unchanged.
+func (p *Proxy) hold(bp *Breakpoint, timeout time.Duration) BreakpointEdit {
+	bp.ID = bp.Flow + "-" + bp.Stage
+	bp.Time = time.Now()
+	bp.Expires = bp.Time.Add(timeout)
+	bp.done = make(chan BreakpointEdit, 1)
+	p.breakpoints.lock.Lock()
+	if p.breakpoints.held == nil {
+		p.breakpoints.held = make(map[string]*Breakpoint)
+	}
+	p.breakpoints.held[bp.ID] = bp
+	p.breakpoints.lock.Unlock()
+	breakpointLog.Info("flow held", "id", bp.ID, "method", bp.Method, "url", bp.Url, "timeout", timeout)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case e := <-bp.done:
+		breakpointLog.Info("flow released", "id", bp.ID, "action", e.Action)
+		return e
+	case <-timer.C:
+	}
+	p.breakpoints.lock.Lock()
+	_, waiting := p.breakpoints.held[bp.ID]
+	delete(p.breakpoints.held, bp.ID)
+	p.breakpoints.lock.Unlock()
+	if !waiting {
+		// resolved just as the timer fired
+		return <-bp.done
+	}
+	breakpointLog.Info("flow resumed on timeout", "id", bp.ID)
+	return BreakpointEdit{Action: BREAKPOINT_RESUME}
+}
+
+func breakpointTimeout(a Action) time.Duration {
+	if d, err := time.ParseDuration(a.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return BREAKPOINT_TIMEOUT
+}
+
+func (bp *Breakpoint) setBody(body []byte) {
+	if utf8.Valid(body) {
+		bp.Body = string(body)
+	} else {
+		bp.Body, bp.BodyBase64 = base64.StdEncoding.EncodeToString(body), true
+	}
+}
+
+// breakRequest holds req. It returns the response to answer with when the
+// flow is dropped or answered at the breakpoint, and nil to go upstream.
+func (p *Proxy) breakRequest(ctx *Context, req *http.Request, a Action) *http.Response {
+	body, err := peekRequestBody(req)
+	if err != nil {
+		breakpointLog.Error("read request body", "flow", ctx.ID, "err", err)
+		return nil
+	}
+	encoding := req.Header.Get("Content-Encoding")
+	body, encoding = decodeScriptBody(encoding, body)
+	bp := &Breakpoint{
+		Flow:   ctx.ID,
+		Stage:  BREAKPOINT_REQUEST,
+		Method: valueOrDefault(req.Method, "GET"),
+		Url:    req.URL.String(),
+		Header: req.Header.Clone(),
+	}
+	bp.setBody(body)
+
+	e := p.hold(bp, breakpointTimeout(a))
+	edited, _ := e.body()
+	ctx.held = e.Action
+	switch e.Action {
+	case BREAKPOINT_DROP:
+		return breakpointResponse(req, http.StatusBadGateway, nil, []byte("dropped at a breakpoint"))
+	case BREAKPOINT_RESPOND:
+		return breakpointResponse(req, e.Status, e.Header, edited)
+	}
+	if e.Method != "" {
+		req.Method = e.Method
+	}
+	if e.Url != "" {
+		if u, err := url.Parse(e.Url); err == nil && u.Host != "" {
+			req.URL = u
+			req.Host = u.Host
+		}
+	}
+	if e.Header != nil {
+		req.Header = e.Header
+	}
+	if edited != nil {
+		setRequestBody(req, encodeScriptBody(req.Header, encoding, edited))
+	}
+	return nil
+}
+
+// breakResponse holds resp and applies the edits to it. It returns false
+// when the flow is dropped.
+func (p *Proxy) breakResponse(ctx *Context, req *http.Request, resp *http.Response, a Action) bool {
+	var body []byte
+	if resp.Body != nil {
+		save, b, err := drainBody(resp.Body)
+		if err != nil {
+			breakpointLog.Error("read response body", "flow", ctx.ID, "err", err)
+			return true
+		}
+		body, _ = ioutil.ReadAll(b)
+		resp.Body = save
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	body, encoding = decodeScriptBody(encoding, body)
+	bp := &Breakpoint{
+		Flow:   ctx.ID,
+		Stage:  BREAKPOINT_RESPONSE,
+		Method: valueOrDefault(req.Method, "GET"),
+		Url:    req.URL.String(),
+		Status: resp.StatusCode,
+		Header: resp.Header.Clone(),
+	}
+	bp.setBody(body)
+
+	e := p.hold(bp, breakpointTimeout(a))
+	if e.Action == BREAKPOINT_DROP {
+		return false
+	}
+	if e.Status != 0 {
+		resp.StatusCode = e.Status
+		resp.Status = fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+	}
+	if e.Header != nil {
+		resp.Header = e.Header
+	}
+	if edited, _ := e.body(); edited != nil {
+		edited = encodeScriptBody(resp.Header, encoding, edited)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(edited))
+		resp.ContentLength = int64(len(edited))
+		resp.Header.Set("Content-Length", fmt.Sprint(len(edited)))
+	}
+	return true
+}
+
+// breakpointResponse answers a request held at a breakpoint, 200 with an
+// empty body unless told otherwise.
+func breakpointResponse(req *http.Request, status int, h http.Header, body []byte) *http.Response {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if h == nil {
+		h = make(http.Header)
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	h.Del("Content-Encoding")
+	h.Set("Content-Length", fmt.Sprint(len(body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,206 @@
+package cproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitBreakpoint returns the flow held by p once there is one.
+func waitBreakpoint(t *testing.T, p *Proxy) *Breakpoint {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		if held := p.Breakpoints(); len(held) > 0 {
+			return held[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("nothing held")
+	return nil
+}
+
+func TestBreakpoints(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + r.URL.Path + " a=" + r.Header.Get("X-A") + " " + string(b)))
+	}))
+	defer upstream.Close()
+	rules := writeTemp(t, "rules.yml", `version: 2
+rules:
+  - regex: '^/req'
+    actions: [{option: breakpoint, content: request}]
+  - regex: '^/resp'
+    actions: [{option: breakpoint, content: response}]
+  - regex: '^/slow'
+    actions: [{option: breakpoint, timeout: 50ms}]
+`)
+	p := NewProxy("", "", rules, "", "")
+	proxy := httptest.NewServer(p.proxyHander)
+	defer proxy.Close()
+	admin := httptest.NewServer(NewAdmin(p))
+	defer admin.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, test := range []struct {
+		name   string
+		path   string
+		stage  string
+		edit   string // posted to the admin API, "" to let it time out
+		status int    // 0 when the connection is closed
+		body   string
+	}{
+		{"request resumed", "/req/1", BREAKPOINT_REQUEST, `{"action":"resume"}`, 200, "POST /req/1 a= old"},
+		{"request edited", "/req/2", BREAKPOINT_REQUEST,
+			`{"action":"resume","method":"PUT","url":"` + upstream.URL + `/edited","headers":{"x-a":["1"]},"body":"new"}`, 200, "PUT /edited a=1 new"},
+		{"request answered", "/req/3", BREAKPOINT_REQUEST, `{"action":"respond","status":418,"body":"teapot"}`, 418, "teapot"},
+		{"request dropped", "/req/4", BREAKPOINT_REQUEST, `{"action":"drop"}`, 0, ""},
+		{"response resumed", "/resp/1", BREAKPOINT_RESPONSE, `{"action":"resume"}`, 200, "POST /resp/1 a= old"},
+		{"response edited", "/resp/2", BREAKPOINT_RESPONSE, `{"action":"resume","status":201,"body":"changed"}`, 201, "changed"},
+		{"response dropped", "/resp/3", BREAKPOINT_RESPONSE, `{"action":"drop"}`, 0, ""},
+		{"timed out", "/slow", BREAKPOINT_REQUEST, "", 200, "POST /slow a= old"},
+	} {
+		type result struct {
+			status int
+			body   string
+		}
+		got := make(chan result, 1)
+		go func() {
+			resp, err := client.Post(upstream.URL+test.path, "text/plain", strings.NewReader("old"))
+			if err != nil {
+				got <- result{}
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := ioutil.ReadAll(resp.Body)
+			got <- result{resp.StatusCode, string(b)}
+		}()
+
+		bp := waitBreakpoint(t, p)
+		if bp.Stage != test.stage || bp.Method != "POST" || !strings.HasSuffix(bp.Url, test.path) {
+			t.Errorf("%s: held %s %s %s", test.name, bp.Stage, bp.Method, bp.Url)
+		}
+		if test.stage == BREAKPOINT_REQUEST && bp.Body != "old" || test.stage == BREAKPOINT_RESPONSE && bp.Status != 200 {
+			t.Errorf("%s: held body %q status %d", test.name, bp.Body, bp.Status)
+		}
+		if test.edit != "" {
+			resp, err := http.Post(admin.URL+"/api/breakpoints/"+bp.ID, "application/json", strings.NewReader(test.edit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				t.Errorf("%s: resolved with %d", test.name, resp.StatusCode)
+			}
+		}
+		select {
+		case r := <-got:
+			if r.status != test.status || r.body != test.body {
+				t.Errorf("%s: got %d %q, want %d %q", test.name, r.status, r.body, test.status, test.body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: still held", test.name)
+		}
+		if held := p.Breakpoints(); len(held) > 0 {
+			t.Errorf("%s: %d still held", test.name, len(held))
+		}
+	}
+}
+
+func TestResolveBreakpointErrors(t *testing.T) {
+	p := NewProxy("", "", "", "", "")
+	held := make(chan BreakpointEdit, 1)
+	go func() {
+		held <- p.hold(&Breakpoint{Flow: "f1", Stage: BREAKPOINT_REQUEST, Method: "GET", Url: "http://api.test/"}, time.Minute)
+	}()
+	bp := waitBreakpoint(t, p)
+	if bp.ID != "f1-request" {
+		t.Errorf("id %q", bp.ID)
+	}
+	body := "%%"
+	for _, e := range []BreakpointEdit{
+		{Action: "later"},
+		{Action: BREAKPOINT_RESPOND, Status: 999},
+		{Action: BREAKPOINT_RESUME, Url: "/relative"},
+		{Action: BREAKPOINT_RESUME, Body: &body, BodyBase64: true},
+	} {
+		if err := p.ResolveBreakpoint(bp.ID, e); err == nil {
+			t.Errorf("%+v resolved", e)
+		}
+	}
+	if err := p.ResolveBreakpoint("f2-request", BreakpointEdit{Action: BREAKPOINT_RESUME}); err != ErrUnknownBreakpoint {
+		t.Errorf("unknown id: %v", err)
+	}
+
+	admin := httptest.NewServer(NewAdmin(p))
+	defer admin.Close()
+	for _, test := range []struct {
+		id, body string
+		status   int
+	}{
+		{"f2-request", `{"action":"resume"}`, http.StatusNotFound},
+		{"f1-request", `{"action":"later"}`, http.StatusBadRequest},
+		{"f1-request", `{`, http.StatusBadRequest},
+		{"f1-request", `{"action":"resume","headers":{"x-a":["1"]}}`, http.StatusNoContent},
+	} {
+		resp, err := http.Post(admin.URL+"/api/breakpoints/"+test.id, "application/json", bytes.NewReader([]byte(test.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: %d, want %d", test.id, test.body, resp.StatusCode, test.status)
+		}
+	}
+	if e := <-held; e.Action != BREAKPOINT_RESUME || e.Header.Get("X-A") != "1" {
+		t.Errorf("went on with %+v", e)
+	}
+}
+
+func TestBreakpointRecorded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	rules := writeTemp(t, "rules.yml", `version: 2
+rules:
+  - regex: '^/resp'
+    actions:
+      - {option: breakpoint, content: response}
+      - {option: set-response-header, header: X-Set, value: '1'}
+`)
+	p := NewProxy("", "", rules, "", "")
+	p.Recent = NewFlowBuffer(10)
+	proxy := httptest.NewServer(p.proxyHander)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := client.Get(upstream.URL + "/resp"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	bp := waitBreakpoint(t, p)
+	changed := "changed"
+	if err := p.ResolveBreakpoint(bp.ID, BreakpointEdit{Action: BREAKPOINT_RESUME, Status: 201, Body: &changed}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	flows := p.Recent.Flows(0, 0)
+	if len(flows) != 1 {
+		t.Fatalf("recorded %d flows, want 1", len(flows))
+	}
+	f := flows[0].Flow
+	if f.Response.StatusCode != 201 || f.Response.Header.Get("X-Set") != "1" || string(f.ResponseBody) != "changed" {
+		t.Errorf("recorded %d %v %q, want the response sent: 201 with X-Set and changed", f.Response.StatusCode, f.Response.Header, f.ResponseBody)
+	}
+}
@@ -0,0 +1,316 @@
+package cproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flow is one captured exchange, or one WebSocket frame from the server, as
+// handed to the capture sinks. Response is the response as received from
+// upstream, before the response actions changed it, without its body.
+type Flow struct {
+	Context      *Context
+	Request      *http.Request
+	Response     *http.Response // nil for a WebSocket frame
+	RequestBody  []byte
+	ResponseBody []byte // the frame for a WebSocket frame
+	Seq          int    // of a WebSocket frame within the flow
+	Timings      Timings
+
+	// content encodings removed from the bodies, "" for a body recorded as
+	// it was on the wire
+	RequestDecoded, ResponseDecoded string
+}
+
+// SINK_DRAIN_TIMEOUT is how long closing an asynchronous sink waits for its
+// queue to be delivered.
+var SINK_DRAIN_TIMEOUT = 5 * time.Second
+
+// DeliveryStats counts the records of an asynchronous sink since it started.
+type DeliveryStats struct {
+	Queued  int    `json:"queued"`  // waiting now
+	Written uint64 `json:"written"` // accepted by the other end
+	Dropped uint64 `json:"dropped"` // queue full, given up, or still queued at close
+	Failed  uint64 `json:"failed"`  // refused by the other end
+	Retries uint64 `json:"retries"` // batches sent again after an error
+}
+
+// Sink stores captured flows.
+type Sink interface {
+	WriteFlow(f *Flow) error
+	Close() error
+}
+
+// Message returns the flow in capture schema 1, the first format of the redis
+// queue. A WebSocket frame gets status 206 and the frame as response content.
+func (f *Flow) Message() *Message {
+	m := &Message{
+		Url:         f.Request.URL.RequestURI(),
+		Method:      valueOrDefault(f.Request.Method, "GET"),
+		ReqHeader:   firstValues(f.Request.Header),
+		RespContent: base64.StdEncoding.EncodeToString(f.ResponseBody),
+		Status:      206,
+	}
+	if f.Response != nil {
+		m.RespHeader = firstValues(f.Response.Header)
+		m.ReqContent = base64.StdEncoding.EncodeToString(f.RequestBody)
+		m.Status = f.Response.StatusCode
+	}
+	return m
+}
+
+// Flow returns a schema 1 message as a Flow. Messages carry neither time nor
+// protocol nor the scheme; the flow starts now and takes no time.
+func (m *Message) Flow() (*Flow, error) {
+	reqBody, err := base64.StdEncoding.DecodeString(m.ReqContent)
+	if err != nil {
+		return nil, fmt.Errorf("req: %v", err)
+	}
+	respBody, err := base64.StdEncoding.DecodeString(m.RespContent)
+	if err != nil {
+		return nil, fmt.Errorf("resp: %v", err)
+	}
+	reqHeader := messageHeader(m.ReqHeader)
+	rawurl := m.Url
+	if strings.HasPrefix(rawurl, "/") && reqHeader.Get("Host") != "" {
+		rawurl = "http://" + reqHeader.Get("Host") + rawurl
+	}
+	req, err := http.NewRequest(valueOrDefault(m.Method, "GET"), rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = reqHeader
+	tm := noTimings
+	tm.Total = 0
+	f := &Flow{
+		Context:      &Context{Scheme: req.URL.Scheme, Host: req.Host, Start: time.Now()},
+		Request:      req,
+		RequestBody:  reqBody,
+		ResponseBody: respBody,
+		Timings:      tm,
+	}
+	if m.RespHeader != nil || m.Status != 206 {
+		f.Response = &http.Response{StatusCode: m.Status, Proto: "HTTP/1.1", Header: messageHeader(m.RespHeader)}
+	}
+	return f, nil
+}
+
+func messageHeader(m map[string]string) http.Header {
+	h := make(http.Header, len(m))
+	for k, v := range m {
+		h[k] = []string{v}
+	}
+	return h
+}
+
+func firstValues(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k, v := range h {
+		m[k] = v[0]
+	}
+	return m
+}
+
+// sinks holds the sinks of the proxy: the global ones that see every printed
+// flow, and the file sinks, by path, so that rules and the global capture
+// share one writer per file.
+type sinks struct {
+	global   []Sink
+	redis    map[RedisTarget]*RedisSink
+	writer   *RedisWriter
+	webhooks map[string]*WebhookSink
+	files    map[string]Sink
+	lock     sync.Mutex
+}
+
+// AddSink registers a sink that captures every flow matched by the rules,
+// the same flows that are printed, or every flow with CaptureAll.
+func (p *Proxy) AddSink(s Sink) {
+	p.sinks.lock.Lock()
+	p.sinks.global = append(p.sinks.global, s)
+	p.sinks.lock.Unlock()
+}
+
+// CloseSinks closes all sinks.
+func (p *Proxy) CloseSinks() {
+	p.sinks.lock.Lock()
+	defer p.sinks.lock.Unlock()
+	closed := make(map[Sink]bool)
+	for _, s := range p.sinks.global {
+		closed[s] = true
+		s.Close()
+	}
+	for _, s := range p.sinks.files {
+		if !closed[s] {
+			s.Close()
+		}
+	}
+	if p.sinks.writer != nil {
+		p.sinks.writer.Close()
+	}
+	for _, s := range p.sinks.webhooks {
+		if !closed[s] {
+			s.Close()
+		}
+	}
+	p.sinks.webhooks = nil
+	p.sinks.global, p.sinks.files = nil, nil
+	p.sinks.redis, p.sinks.writer = nil, nil
+}
+
+// RedisStats reports the delivery of to-redis records, zero before the first.
+func (p *Proxy) RedisStats() DeliveryStats {
+	p.sinks.lock.Lock()
+	defer p.sinks.lock.Unlock()
+	if p.sinks.writer == nil {
+		return DeliveryStats{}
+	}
+	return p.sinks.writer.Stats()
+}
+
+// WebhookStats reports the delivery of to-webhook records by URL.
+func (p *Proxy) WebhookStats() map[string]DeliveryStats {
+	p.sinks.lock.Lock()
+	defer p.sinks.lock.Unlock()
+	stats := make(map[string]DeliveryStats, len(p.sinks.webhooks))
+	for endpoint, s := range p.sinks.webhooks {
+		stats[endpoint] = s.Stats()
+	}
+	return stats
+}
+
+// ruleSink returns the sink a capture action writes to, or nil when the
+// action does not capture.
+func (p *Proxy) ruleSink(a Action) (Sink, error) {
+	switch a.Option {
+	case OPT_TO_REDIS:
+		if p.RedisPool == nil {
+			return nil, fmt.Errorf("no redis found")
+		}
+		t, err := a.redisTarget(p.Redis)
+		if err != nil {
+			return nil, err
+		}
+		p.sinks.lock.Lock()
+		defer p.sinks.lock.Unlock()
+		s, ok := p.sinks.redis[t]
+		if !ok {
+			if p.sinks.writer == nil {
+				p.sinks.writer = NewRedisWriter(p.RedisPool)
+			}
+			s = &RedisSink{Writer: p.sinks.writer, RedisTarget: t, Schema: p.CaptureSchema}
+			if p.sinks.redis == nil {
+				p.sinks.redis = make(map[RedisTarget]*RedisSink)
+			}
+			p.sinks.redis[t] = s
+		}
+		return s, nil
+	case OPT_TO_HAR, OPT_TO_FILE, OPT_TO_DB:
+		return p.fileSink(a.Option, a.Content)
+	case OPT_TO_WEBHOOK:
+		endpoint := valueOrDefault(a.Content, p.Webhook.URL)
+		if endpoint == "" {
+			return nil, fmt.Errorf("no webhook url")
+		}
+		p.sinks.lock.Lock()
+		defer p.sinks.lock.Unlock()
+		s, ok := p.sinks.webhooks[endpoint]
+		if !ok {
+			s = NewWebhookSink(endpoint, p.Webhook)
+			if p.sinks.webhooks == nil {
+				p.sinks.webhooks = make(map[string]*WebhookSink)
+			}
+			p.sinks.webhooks[endpoint] = s
+		}
+		return s, nil
+	}
+	return nil, nil
+}
+
+// fileSink returns the sink writing filePath, opening it on first use. A
+// file is written in a single format, by whichever option opened it first.
+func (p *Proxy) fileSink(option, filePath string) (Sink, error) {
+	p.sinks.lock.Lock()
+	defer p.sinks.lock.Unlock()
+	if s, ok := p.sinks.files[filePath]; ok {
+		return s, nil
+	}
+	var s Sink
+	var err error
+	switch option {
+	case OPT_TO_HAR:
+		s, err = NewHarSink(filePath)
+	case OPT_TO_FILE:
+		s, err = NewFileSink(filePath, p.Rotation)
+	case OPT_TO_DB:
+		s, err = OpenStore(filePath)
+	default:
+		err = fmt.Errorf("%s is not a file sink", option)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.sinks.files == nil {
+		p.sinks.files = make(map[string]Sink)
+	}
+	p.sinks.files[filePath] = s
+	return s, nil
+}
+
+// CaptureHar writes every flow matched by the rules to the HAR file.
+func (p *Proxy) CaptureHar(filePath string) error {
+	return p.captureFile(OPT_TO_HAR, filePath)
+}
+
+// CaptureFile appends every flow matched by the rules to the JSONL file,
+// rotated as set by p.Rotation.
+func (p *Proxy) CaptureFile(filePath string) error {
+	return p.captureFile(OPT_TO_FILE, filePath)
+}
+
+// CaptureDB stores every flow matched by the rules in the SQLite database.
+func (p *Proxy) CaptureDB(filePath string) error {
+	return p.captureFile(OPT_TO_DB, filePath)
+}
+
+func (p *Proxy) captureFile(option, filePath string) error {
+	s, err := p.fileSink(option, filePath)
+	if err != nil {
+		return err
+	}
+	p.AddSink(s)
+	return nil
+}
+
+// capture writes the flow to the global sinks and to the sinks of the
+// capture actions of the rules, each sink at most once.
+func (p *Proxy) capture(f *Flow, rules []Rule) {
+	p.sinks.lock.Lock()
+	targets := append([]Sink(nil), p.sinks.global...)
+	p.sinks.lock.Unlock()
+	for _, rule := range rules {
+		for _, a := range rule.GetActions() {
+			s, err := p.ruleSink(a)
+			if err != nil {
+				captureLog.Error("open sink", "option", a.Option, "err", err)
+			}
+			if s != nil {
+				targets = append(targets, s)
+			}
+		}
+	}
+	seen := make(map[Sink]bool)
+	for _, s := range targets {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		if err := s.WriteFlow(f); err != nil {
+			captureLog.Error("write flow", "method", f.Request.Method, "url", f.Request.URL.String(), "err", err)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package cproxy
 
 import (
 	"errors"
-	"fmt"
 	"github.com/gorilla/websocket"
 	"io"
 
@@ -25,18 +24,23 @@ type Conn struct {
 	stopCh chan struct{}
 }
 
-// Write write p to the websocket connection. The error returned will always
-// be nil if success.
+// Write write p to the websocket connection as a text message. The error
+// returned will always be nil if success.
 func (c *Conn) Write(p []byte) (n int, err error) {
+	if err = c.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteMessage writes p to the websocket connection as a message of the
+// type, websocket.TextMessage or websocket.BinaryMessage.
+func (c *Conn) WriteMessage(messageType int, p []byte) error {
 	select {
 	case <-c.stopCh:
-		return 0, errors.New("Conn is closed, can't be written")
+		return errors.New("Conn is closed, can't be written")
 	default:
-		err = c.Conn.WriteMessage(websocket.TextMessage, p)
-		if err != nil {
-			return 0, err
-		}
-		return len(p), nil
+		return c.Conn.WriteMessage(messageType, p)
 	}
 }
 
@@ -49,7 +53,7 @@ func (c *Conn) Listen() {
 		}
 
 		if err := c.Close(); err != nil {
-			log.Println(err)
+			log.Debug("close websocket", "err", err)
 		}
 
 		message := websocket.FormatCloseMessage(code, "")
@@ -66,7 +70,7 @@ ReadLoop:
 		default:
 			messageType, r, err := c.Conn.NextReader()
 			if err != nil {
-				log.Println("read from socket error:", err)
+				log.Debug("websocket read", "err", err)
 				// TODO: handle read error maybe
 				break ReadLoop
 			}
@@ -76,7 +80,7 @@ ReadLoop:
 				n, err := r.Read(buf)
 				if err != nil {
 					if err != io.EOF {
-						fmt.Println("read error:", err)
+						log.Debug("websocket read", "err", err)
 					}
 					break
 				}
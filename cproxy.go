@@ -2,8 +2,6 @@ package cproxy
 
 import (
 	"bytes"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
@@ -12,8 +10,10 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 var (
@@ -24,12 +24,30 @@ var (
 )
 
 type Proxy struct {
-	Proxy       *url.URL
-	RedisPool   *redis.Pool
-	Regexp      RuleOperator
-	BindAddr    string
-	proxyHander *ProxyHander
-	Level       int
+	Proxy         *url.URL
+	RedisPool     *redis.Pool
+	Regexp        *RuleOperator
+	BindAddr      string
+	proxyHander   *ProxyHander
+	Level         int // set before Run, with SetLevel once running
+	Throttle      *Throttle
+	Rotation      Rotation    // of the to-file captures
+	Redis         RedisTarget // of to-redis actions that do not set their own
+	Webhook       Webhook     // of to-webhook actions
+	CaptureSchema int         // of the redis queue, 0 for the latest; the other JSON sinks always write the latest
+	CaptureBody   BodyPolicy  // which bodies the capture records
+	CaptureAll    bool        // the global sinks get every flow, not only the matched ones
+	Replay        *Replayer   // answers requests from a recording
+	Diff          *Differ     // compares responses to a recording
+	Recent        *FlowBuffer // keeps the latest flows, all of them, for the admin API
+
+	sinks       sinks
+	breakpoints breakpoints
+	lock        sync.RWMutex // of Proxy and Level, which the admin API changes
+
+	requestHandlers  []RequestHandler
+	responseHandlers []ResponseHandler
+	wsFrameHandlers  []WsFrameHandler
 }
 
 type Message struct {
@@ -43,15 +61,17 @@ type Message struct {
 }
 
 type MessageReq struct {
-	Url     string            `json:"url"`
-	Method  string            `json:"method"`
-	Header  map[string]string `json:"req-header"`
-	Content []byte            `json:"req"`
+	Url     string      `json:"url"`
+	Method  string      `json:"method"`
+	Header  http.Header `json:"req-header"`
+	Content []byte      `json:"req"`
+	Decoded string      `json:"-"` // content encoding removed from Content
 }
 type MessageResp struct {
 	Status  int `json:"status"`
-	Header  map[string]string
+	Header  http.Header
 	Content []byte `json:"resp"`
+	Decoded string `json:"-"`
 }
 
 func NewProxy(bindaddr, redisUri, rulePath, proxyUri, filter string) *Proxy {
@@ -61,6 +81,8 @@ func NewProxy(bindaddr, redisUri, rulePath, proxyUri, filter string) *Proxy {
 		RedisPool:   nil,
 		Level:       LEVEL_1,
 		BindAddr:    bindaddr,
+		Redis:       DefaultRedisTarget,
+		CaptureBody: DefaultBodyPolicy,
 	}
 	p.proxyHander.Proxy = p
 	p.initProxy(proxyUri)
@@ -69,134 +91,203 @@ func NewProxy(bindaddr, redisUri, rulePath, proxyUri, filter string) *Proxy {
 	return p
 }
 
-func (p *Proxy) BeforeResponse(w http.ResponseWriter, req *http.Request, resp *http.Response) (ret bool) {
-	ret = false
-	rule, ok := p.Regexp.Match(req.Host, req.URL.RequestURI())
-	if !ok && p.Regexp.Enable {
-		//if !ok {
-		return
+// BeforeRequest matches req against the rules, keeps them in ctx and runs
+// the rule actions, the request handlers, a breakpoint and then the replay.
+// A non-nil response answers the request without sending it upstream.
+func (p *Proxy) BeforeRequest(ctx *Context, req *http.Request) (*http.Request, *http.Response) {
+	ctx.Rules = p.Regexp.MatchAll(req.Host, req.URL.RequestURI())
+	if resp := p.runRequestActions(req, ctx.Rules); resp != nil {
+		return req, resp
+	}
+	req, resp := p.runRequestHandlers(ctx, req)
+	if resp == nil {
+		if a, ok := breakpointAction(ctx.Rules, BREAKPOINT_REQUEST); ok {
+			resp = p.breakRequest(ctx, req, a)
+		}
 	}
-	reqMsg := p.dumpReq(req)
-	respMsg := p.dumpResp(resp)
-	if reqMsg == nil || respMsg == nil {
-		return false
+	if resp == nil && p.Replay != nil {
+		resp = p.Replay.Respond(req)
 	}
+	return req, resp
+}
 
-	if p.Level > LEVEL_0 {
-		fmt.Printf("---------------\n")
-		fmt.Printf("> %s %s\n", reqMsg.Method, reqMsg.Url)
+// BeforeResponse runs the response handlers and then the rule actions. It
+// returns the response to write and whether it has been written already.
+// The flow is recorded as it goes to the client, after the response
+// breakpoint and the actions.
+func (p *Proxy) BeforeResponse(ctx *Context, w http.ResponseWriter, req *http.Request, resp *http.Response) (*http.Response, bool) {
+	if ctx.held == BREAKPOINT_DROP {
+		writeFault(w, resp, Action{Option: OPT_CLOSE})
+		return resp, true
+	}
+	resp = p.runResponseHandlers(ctx, req, resp)
+	rules := ctx.Rules
+	if len(rules) == 0 && !p.CaptureAll && p.Diff == nil && p.Recent == nil {
+		return resp, false
+	}
+	// the exchange with upstream ends here, not after a breakpoint hold
+	timings := ctx.timings(time.Now())
+	responded := false
+	if a, ok := breakpointAction(rules, BREAKPOINT_RESPONSE); ok && ctx.held != BREAKPOINT_RESPOND && !p.breakResponse(ctx, req, resp, a) {
+		writeFault(w, resp, Action{Option: OPT_CLOSE})
+		responded = true
+	} else {
+		responded = p.runResponseActions(w, req, resp, rules)
 	}
-	if p.Level > LEVEL_1 {
-		for k, v := range reqMsg.Header {
-			fmt.Printf("> %s: %s\n", k, v)
+
+	// a flow kept only for Recent is recorded without its bodies
+	bodies := len(rules) > 0 || p.CaptureAll || p.Diff != nil
+	reqMsg := p.dumpReq(req, bodies)
+	// the body of a response dropped or answered by an action itself is gone
+	respMsg, tee := p.dumpResp(resp, bodies && !responded)
+	if reqMsg == nil || respMsg == nil {
+		return resp, responded
+	}
+	sent := *resp
+	sent.Header = resp.Header.Clone()
+	sent.Body = nil
+	flow := &Flow{
+		Context:         ctx,
+		Request:         req,
+		Response:        &sent,
+		RequestBody:     reqMsg.Content,
+		ResponseBody:    respMsg.Content,
+		RequestDecoded:  reqMsg.Decoded,
+		ResponseDecoded: respMsg.Decoded,
+		Timings:         timings,
+	}
+	if tee != nil {
+		// recorded once the body has gone to the client
+		tee.done = func(body []byte) {
+			respMsg.Content, respMsg.Decoded = p.CaptureBody.body(sent.Header, body)
+			flow.ResponseBody, flow.ResponseDecoded = respMsg.Content, respMsg.Decoded
+			p.recordFlow(flow, rules, reqMsg, respMsg)
 		}
+	} else {
+		p.recordFlow(flow, rules, reqMsg, respMsg)
+	}
+	return resp, responded
+}
+
+// recordFlow logs the flow at the proxy level and hands it to the capture,
+// the diff and the recent flows.
+func (p *Proxy) recordFlow(flow *Flow, rules []Rule, reqMsg *MessageReq, respMsg *MessageResp) {
+	level := p.GetLevel()
+	if len(rules) == 0 {
+		// captured for CaptureAll, Diff or Recent only
+		level = LEVEL_0
 	}
-	if p.Level > LEVEL_2 {
-		fmt.Printf("\n> %s\n", reqMsg.Content)
+	if level > LEVEL_0 {
+		logFlow(flow.Context, level, reqMsg, respMsg)
 	}
 
-	if p.Level > LEVEL_0 {
-		fmt.Printf("\n< %d \n", respMsg.Status)
+	if len(rules) > 0 || p.CaptureAll {
+		p.capture(flow, rules)
 	}
-	if p.Level > LEVEL_1 {
-		for k, v := range respMsg.Header {
-			fmt.Printf("< %s: %s\n", k, v)
+	if p.Diff != nil {
+		if d := p.Diff.Check(flow); d != nil && p.GetLevel() > LEVEL_0 {
+			printDiff(d)
 		}
 	}
-	if p.Level > LEVEL_2 {
-		fmt.Printf("\n< %s\n", respMsg.Content)
+	if p.Recent != nil {
+		p.Recent.WriteFlow(flow)
 	}
+}
 
-	if rule.Option == OPT_USE_LOCAL_RESPONSE {
-		f, err := os.OpenFile(rule.Content, os.O_RDONLY, 0666)
-		if err != nil {
-			return
+// BeforeWsResponse handles a frame from the server, messageType being
+// websocket.TextMessage or websocket.BinaryMessage. It returns true when the
+// frame has been written to the client or dropped. ctx.Rules are the rules
+// matched by the handshake.
+func (p *Proxy) BeforeWsResponse(ctx *Context, w *Conn, req *http.Request, messageType int, message []byte) (ret bool) {
+	original, forward := message, true
+	ctx.serverFrames++
+	if len(ctx.Rules) == 0 && (p.CaptureAll || p.Recent != nil) {
+		f := &Flow{Context: ctx, Request: req, ResponseBody: message, Seq: ctx.serverFrames, Timings: noTimings}
+		if p.CaptureAll {
+			p.capture(f, nil)
+		}
+		if p.Recent != nil {
+			p.Recent.WriteFlow(f)
 		}
-		defer f.Close()
-
-		copyHeader(w.Header(), resp.Header)
-		w.Header().Del("Content-Length")
-		w.WriteHeader(resp.StatusCode)
-
-		io.Copy(w, f)
-		ret = true
-		return
 	}
-
-	if rule.Option == OPT_TO_REDIS {
-		m := Message{
-			Url:         reqMsg.Url,
-			Method:      reqMsg.Method,
-			ReqHeader:   reqMsg.Header,
-			RespHeader:  respMsg.Header,
-			ReqContent:  base64.StdEncoding.EncodeToString(reqMsg.Content),
-			RespContent: base64.StdEncoding.EncodeToString(respMsg.Content),
-			Status:      respMsg.Status,
+	if len(ctx.Rules) > 0 {
+		if level := p.GetLevel(); level > LEVEL_0 {
+			logFrame(ctx, level, req)
 		}
-		if msg, e := json.Marshal(&m); e == nil {
-			if p.RedisPool != nil {
-				p.RedisPool.Get().Do("lpush", "http-message-queue", msg)
-			} else {
-				fmt.Printf("no redis found")
-			}
+
+		f := &Flow{Context: ctx, Request: req, ResponseBody: message, Seq: ctx.serverFrames, Timings: noTimings}
+		p.capture(f, ctx.Rules)
+		if p.Recent != nil {
+			p.Recent.WriteFlow(f)
 		}
+		message, forward = p.runWsActions(w, req, message, ctx.Rules)
 	}
-	return false
-}
-func (p *Proxy) BeforeWsResponse(w *Conn, req *http.Request, message []byte) (ret bool) {
-	ret = false
-	rule, ok := p.Regexp.Match(req.Host, req.URL.RequestURI())
-	if !ok && p.Regexp.Enable {
-		return
-	}
-	if p.Level > LEVEL_0 {
-		fmt.Printf("---------------\n")
-		fmt.Printf("> %s %s\n", req.Method, req.URL.RequestURI())
+	if forward {
+		frame := &WsFrame{Type: messageType, Data: message, Seq: ctx.serverFrames}
+		forward = p.runWsFrameHandlers(ctx, req, frame)
+		message = frame.Data
 	}
-
-	if p.Level > LEVEL_1 {
-		for k, v := range req.Header {
-			fmt.Printf("> %s: %s\n", k, v[0])
+	if forward && !bytes.Equal(message, original) {
+		if e := w.WriteMessage(messageType, message); e != nil {
+			log.Debug("websocket write to client", "err", e)
 		}
+		return true
 	}
+	return !forward
+}
 
-	if rule.Option == OPT_USE_LOCAL_RESPONSE {
-		f, err := os.OpenFile(rule.Content, os.O_RDONLY, 0666)
-		if err != nil {
-			return
-		}
-		defer f.Close()
-
-		io.Copy(w, f)
-		ret = true
-		return
+// BeforeWsRequest handles a frame from the client and returns the frame to
+// send to the server, or false to drop it.
+func (p *Proxy) BeforeWsRequest(ctx *Context, req *http.Request, messageType int, message []byte) ([]byte, bool) {
+	ctx.clientFrames++
+	message, forward := runWsScripts(req, message, ctx.Rules)
+	if !forward {
+		return nil, false
+	}
+	frame := &WsFrame{Type: messageType, Data: message, FromClient: true, Seq: ctx.clientFrames}
+	if !p.runWsFrameHandlers(ctx, req, frame) {
+		return nil, false
 	}
+	return frame.Data, true
+}
 
-	if rule.Option == OPT_TO_REDIS {
-		h := make(map[string]string, 0)
-		for k, v := range req.Header {
-			h[k] = v[0]
-		}
-		m := Message{
-			Url:         req.URL.RequestURI(),
-			Method:      req.Method,
-			ReqHeader:   h,
-			RespContent: base64.StdEncoding.EncodeToString(message),
-			Status:      206,
+func (p *Proxy) GetProxy() *url.URL {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.Proxy
+}
+
+// SetProxy switches the upstream proxy of the requests from now on, "" for
+// going direct.
+func (p *Proxy) SetProxy(uri string) error {
+	var u *url.URL
+	if uri != "" {
+		var err error
+		if u, err = url.Parse(uri); err != nil {
+			return err
 		}
-		if msg, e := json.Marshal(&m); e == nil {
-			if p.RedisPool != nil {
-				p.RedisPool.Get().Do("lpush", "http-message-queue", msg)
-			} else {
-				fmt.Printf("no redis found")
-			}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%s: want scheme://host:port", uri)
 		}
 	}
-	return false
+	p.lock.Lock()
+	p.Proxy = u
+	p.lock.Unlock()
+	return nil
 }
 
-func (p *Proxy) GetProxy() *url.URL {
-	return p.Proxy
+func (p *Proxy) GetLevel() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.Level
+}
+
+// SetLevel changes how much of the flows the traffic log shows, for a
+// running proxy.
+func (p *Proxy) SetLevel(level int) {
+	p.lock.Lock()
+	p.Level = level
+	p.lock.Unlock()
 }
 func (p *Proxy) GetRedisConnection() redis.Conn {
 	if p.RedisPool != nil {
@@ -205,26 +296,27 @@ func (p *Proxy) GetRedisConnection() redis.Conn {
 	return nil
 }
 
+// Handler returns the proxy as an http.Handler, for serving it from an
+// existing server instead of Run.
+func (p *Proxy) Handler() http.Handler {
+	return p.proxyHander
+}
+
 func (p *Proxy) Run() error {
-	fmt.Printf("proxy listen on %s\n", p.BindAddr)
+	log.Info("proxy listening", "addr", p.BindAddr)
+	go p.Regexp.WatchRules(RULE_WATCH_INTERVAL)
 	return http.ListenAndServe(p.BindAddr, p.proxyHander)
 }
 
-func (p *Proxy) dumpReq(req *http.Request) (msg *MessageReq) {
+// dumpReq copies the request head, and the body too when bodies is set and
+// the body policy records it.
+func (p *Proxy) dumpReq(req *http.Request, bodies bool) (msg *MessageReq) {
 	message := &MessageReq{}
-	var err error
-	save := req.Body
-	if req.Body != nil {
-		save, req.Body, err = drainBody(req.Body)
-		if err != nil {
-			return
-		}
-	}
 	reqURI := req.URL.RequestURI()
 	message.Method = valueOrDefault(req.Method, "GET")
 	message.Url = reqURI
 
-	message.Header = make(map[string]string)
+	message.Header = make(http.Header)
 	absRequestURI := strings.HasPrefix(req.RequestURI, "http://") || strings.HasPrefix(req.RequestURI, "https://")
 	if !absRequestURI {
 		host := req.Host
@@ -232,21 +324,34 @@ func (p *Proxy) dumpReq(req *http.Request) (msg *MessageReq) {
 			host = req.URL.Host
 		}
 		if host != "" {
-			message.Header["Host"] = host
+			message.Header.Set("Host", host)
 		}
 	}
 
 	chunked := len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked"
 	if len(req.TransferEncoding) > 0 {
 		//fmt.Fprintf(&b, "Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ","))
-		message.Header["Transfer-Encoding"] = strings.Join(req.TransferEncoding, ",")
+		message.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ","))
 	}
 	if req.Close {
-		message.Header["Connection"] = "close"
+		message.Header.Set("Connection", "close")
 	}
-	message.Header = make(map[string]string)
 	for k, v := range req.Header {
-		message.Header[k] = v[0]
+		if reqWriteExcludeHeaderDump[k] && len(message.Header[k]) > 0 {
+			continue
+		}
+		message.Header[k] = append([]string(nil), v...)
+	}
+	if !bodies || !p.CaptureBody.records(req.Header, req.ContentLength) {
+		return message
+	}
+	var err error
+	save := req.Body
+	if req.Body != nil {
+		save, req.Body, err = drainBody(req.Body)
+		if err != nil {
+			return
+		}
 	}
 	var b bytes.Buffer
 	if req.Body != nil {
@@ -259,27 +364,32 @@ func (p *Proxy) dumpReq(req *http.Request) (msg *MessageReq) {
 			dest.(io.Closer).Close()
 		}
 	}
-	message.Content = b.Bytes()
+	message.Content, message.Decoded = b.Bytes(), ""
+	if !chunked {
+		message.Content, message.Decoded = p.CaptureBody.body(req.Header, b.Bytes())
+	}
 	req.Body = save
 	return message
 }
-func (p *Proxy) dumpResp(resp *http.Response) (msg *MessageResp) {
+
+// dumpResp copies the response head, and the body too when bodies is set
+// and the body policy records it. A body of unknown length is not read here
+// but recorded as it goes to the client, through the teeBody returned.
+func (p *Proxy) dumpResp(resp *http.Response, bodies bool) (msg *MessageResp, tee *teeBody) {
 	message := &MessageResp{}
 	message.Status = resp.StatusCode
-	message.Header = make(map[string]string)
+	message.Header = make(http.Header)
 
-	recordBody := false
 	for k, v := range resp.Header {
-		message.Header[k] = v[0]
-		if k == "content-type" || k == "Content-Type" {
-			if strings.Contains(v[0], "text") {
-				recordBody = true
-			}
-		}
-
+		message.Header[k] = append([]string(nil), v...)
 	}
-	if !recordBody {
-		return message
+	if !bodies || !p.CaptureBody.records(resp.Header, resp.ContentLength) {
+		return message, nil
+	}
+	if resp.ContentLength < 0 && resp.Body != nil && resp.Body != http.NoBody {
+		tee = &teeBody{ReadCloser: resp.Body, max: p.CaptureBody.MaxSize}
+		resp.Body = tee
+		return message, tee
 	}
 	var b bytes.Buffer
 	var err error
@@ -310,8 +420,8 @@ func (p *Proxy) dumpResp(resp *http.Response) (msg *MessageResp) {
 	if err != nil {
 		return
 	}
-	message.Content = b.Bytes()
-	return message
+	message.Content, message.Decoded = p.CaptureBody.body(resp.Header, b.Bytes())
+	return message, nil
 }
 
 func (p *Proxy) initRedis(uri string) {
@@ -321,9 +431,9 @@ func (p *Proxy) initRedis(uri string) {
 	p.RedisPool = &redis.Pool{
 		MaxIdle:     16,
 		MaxActive:   0,
-		IdleTimeout: 300,
+		IdleTimeout: 300 * time.Second,
 		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", uri)
+			return DialRedis(uri)
 		},
 	}
 }
@@ -365,6 +475,74 @@ func drainBody(b io.ReadCloser) (r1, r2 io.ReadCloser, err error) {
 	return ioutil.NopCloser(&buf), ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
 }
 
+// logFlow writes an exchange to the traffic log, the headers from LEVEL_2
+// and the bodies from LEVEL_3 on.
+func logFlow(ctx *Context, level int, reqMsg *MessageReq, respMsg *MessageResp) {
+	var text strings.Builder
+	args := []interface{}{"id", ctx.ID, "method", reqMsg.Method, "url", reqMsg.Url, "status", respMsg.Status}
+	fmt.Fprintf(&text, "---------------\n> %s %s\n", reqMsg.Method, reqMsg.Url)
+	if level > LEVEL_1 {
+		writeHeader(&text, "> ", reqMsg.Header)
+		args = append(args, "request_headers", reqMsg.Header)
+	}
+	if level > LEVEL_2 {
+		fmt.Fprintf(&text, "\n> %s\n", printableBody(reqMsg.Content))
+		args = append(args, "request_body", printableBody(reqMsg.Content))
+	}
+	fmt.Fprintf(&text, "\n< %d \n", respMsg.Status)
+	if level > LEVEL_1 {
+		writeHeader(&text, "< ", respMsg.Header)
+		args = append(args, "response_headers", respMsg.Header)
+	}
+	if level > LEVEL_2 {
+		fmt.Fprintf(&text, "\n< %s\n", printableBody(respMsg.Content))
+		args = append(args, "response_body", printableBody(respMsg.Content))
+	}
+	logTraffic(text.String(), "flow", args...)
+}
+
+// logFrame writes a WebSocket frame from the server to the traffic log.
+func logFrame(ctx *Context, level int, req *http.Request) {
+	var text strings.Builder
+	args := []interface{}{"id", ctx.ID, "frame", ctx.serverFrames, "method", req.Method, "url", req.URL.RequestURI()}
+	fmt.Fprintf(&text, "---------------\n> %s %s\n", req.Method, req.URL.RequestURI())
+	if level > LEVEL_1 {
+		writeHeader(&text, "> ", req.Header)
+		args = append(args, "request_headers", req.Header)
+	}
+	logTraffic(text.String(), "frame", args...)
+}
+
+func writeHeader(text *strings.Builder, prefix string, h http.Header) {
+	for k, vv := range h {
+		for _, v := range vv {
+			fmt.Fprintf(text, "%s%s: %s\n", prefix, k, v)
+		}
+	}
+}
+
+func printDiff(d *FlowDiff) {
+	var text strings.Builder
+	if d.Baseline == 0 {
+		fmt.Fprintf(&text, "~~~ no baseline for %s %s\n", d.Method, d.Url)
+	} else {
+		fmt.Fprintf(&text, "~~~ %s %s differs from #%d\n", d.Method, d.Url, d.Baseline)
+	}
+	for _, diff := range d.Differences {
+		fmt.Fprintf(&text, "~   %s\n", diff)
+	}
+	logTraffic(text.String(), "diff", "id", d.ID, "method", d.Method, "url", d.Url, "baseline", d.Baseline,
+		"differences", d.Differences)
+}
+
+// printableBody returns body for the console, binary bodies only by size.
+func printableBody(body []byte) string {
+	if utf8.Valid(body) {
+		return string(body)
+	}
+	return fmt.Sprintf("[%d bytes binary]", len(body))
+}
+
 func valueOrDefault(value, def string) string {
 	if value != "" {
 		return value
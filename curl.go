@@ -0,0 +1,69 @@
+package cproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// curlSkipHeaders are set by curl itself.
+var curlSkipHeaders = map[string]bool{
+	"Host":           true,
+	"Content-Length": true,
+	"Connection":     true,
+}
+
+// CurlCommand returns a shell command repeating the request. A body that is
+// not UTF-8 is piped in through base64.
+func CurlCommand(method, rawurl string, h http.Header, body []byte) string {
+	var b strings.Builder
+	if len(body) > 0 && !utf8.Valid(body) {
+		fmt.Fprintf(&b, "echo %s | base64 -d | ", base64.StdEncoding.EncodeToString(body))
+	}
+	b.WriteString("curl")
+	if method != "" && method != http.MethodGet {
+		fmt.Fprintf(&b, " -X %s", shellQuote(method))
+	}
+	b.WriteString(" " + shellQuote(rawurl))
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if curlSkipHeaders[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		for _, v := range h[k] {
+			fmt.Fprintf(&b, " -H %s", shellQuote(k+": "+v))
+		}
+	}
+	switch {
+	case len(body) == 0:
+	case utf8.Valid(body):
+		fmt.Fprintf(&b, " --data-binary %s", shellQuote(string(body)))
+	default:
+		b.WriteString(" --data-binary @-")
+	}
+	return b.String()
+}
+
+// Curl returns a curl command repeating the request of the flow, a decoded
+// body compressed again as its Content-Encoding says.
+func (f *Flow) Curl() string {
+	body := f.RequestBody
+	if f.RequestDecoded != "" {
+		if b, err := EncodeBody(f.RequestDecoded, body); err == nil {
+			body = b
+		}
+	}
+	r := f.Record()
+	return CurlCommand(r.Request.Method, r.Request.Url, f.Request.Header, body)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,331 @@
+package cproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of Difference.
+const (
+	DIFF_STATUS = "status"
+	DIFF_HEADER = "header"
+	DIFF_JSON   = "json" // type or presence of a JSON field, or its value with Values
+	DIFF_BODY   = "body" // a body that is not JSON on one side, or differs with Values
+)
+
+// DiffOptions say what a difference is. Header names and fields are
+// patterns as in path.Match. A field pattern is matched against the path of
+// a JSON value, e.g. data.items[0].id, also with the indexes as [*], and a
+// pattern without . or [ against the last name of the path alone.
+type DiffOptions struct {
+	IgnoreHeaders []string
+	IgnoreFields  []string
+	Values        bool // compare JSON values and non-JSON bodies, not only the structure
+}
+
+var DefaultDiffOptions = DiffOptions{
+	IgnoreHeaders: []string{"date", "expires", "last-modified", "etag", "age", "set-cookie", "content-length",
+		"x-request-id", "x-trace-id", "cf-ray", "server-timing", "report-to", "nel"},
+}
+
+type Difference struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path,omitempty"` // header name or JSON path
+	Baseline string `json:"baseline"`
+	Live     string `json:"live"`
+}
+
+func (d Difference) String() string {
+	if d.Path == "" {
+		return fmt.Sprintf("%s: %s -> %s", d.Kind, d.Baseline, d.Live)
+	}
+	return fmt.Sprintf("%s %s: %s -> %s", d.Kind, d.Path, d.Baseline, d.Live)
+}
+
+// FlowDiff is the comparison of a live flow with its recording. Baseline is
+// the id of the recording, 0 when there is none.
+type FlowDiff struct {
+	Time        time.Time    `json:"time"`
+	ID          string       `json:"id"`
+	Method      string       `json:"method"`
+	Url         string       `json:"url"`
+	Baseline    int64        `json:"baseline"`
+	Differences []Difference `json:"differences"`
+}
+
+// Differ compares the responses going through the proxy to a recording of
+// the same requests, and writes the flows that differ, or have no recording,
+// to a JSONL report.
+type Differ struct {
+	Baseline *Replayer
+	DiffOptions
+
+	report io.WriteCloser
+	lock   sync.Mutex
+
+	compared, differing, missing uint64
+}
+
+// NewDiffer writes the report to reportPath, nowhere when it is empty.
+func NewDiffer(baseline *Replayer, opts DiffOptions, reportPath string) (*Differ, error) {
+	for _, patterns := range [][]string{opts.IgnoreHeaders, opts.IgnoreFields} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("%s: %v", p, err)
+			}
+		}
+	}
+	d := &Differ{Baseline: baseline, DiffOptions: opts}
+	if reportPath != "" {
+		f, err := os.OpenFile(reportPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		d.report = f
+	}
+	return d, nil
+}
+
+// Check compares a flow with its recording. It returns nil when they do not
+// differ.
+func (d *Differ) Check(f *Flow) *FlowDiff {
+	if f.Response == nil {
+		return nil
+	}
+	u := *f.Request.URL
+	if u.Host == "" {
+		u.Host = f.Request.Host
+	}
+	fd := &FlowDiff{Time: time.Now(), Method: f.Request.Method, Url: u.String(), Differences: []Difference{}}
+	if f.Context != nil {
+		fd.ID = f.Context.ID
+	}
+	atomic.AddUint64(&d.compared, 1)
+	sf := d.Baseline.Baseline(f)
+	if sf == nil {
+		atomic.AddUint64(&d.missing, 1)
+	} else {
+		fd.Baseline = sf.ID
+		fd.Differences = DiffFlows(sf.Flow(), f, d.DiffOptions)
+		if len(fd.Differences) == 0 {
+			return nil
+		}
+		atomic.AddUint64(&d.differing, 1)
+	}
+	if d.report != nil {
+		b, _ := json.Marshal(fd)
+		d.lock.Lock()
+		d.report.Write(append(b, '\n'))
+		d.lock.Unlock()
+	}
+	return fd
+}
+
+// Stats returns how many flows were compared, how many of them differed and
+// how many had no recording.
+func (d *Differ) Stats() (compared, differing, missing uint64) {
+	return atomic.LoadUint64(&d.compared), atomic.LoadUint64(&d.differing), atomic.LoadUint64(&d.missing)
+}
+
+func (d *Differ) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.report == nil {
+		return nil
+	}
+	err := d.report.Close()
+	d.report = nil
+	return err
+}
+
+// DiffFlows lists the differences of the responses of two flows.
+func DiffFlows(baseline, live *Flow, opts DiffOptions) []Difference {
+	diffs := []Difference{}
+	if baseline.Response == nil || live.Response == nil {
+		return diffs
+	}
+	if a, b := baseline.Response.StatusCode, live.Response.StatusCode; a != b {
+		diffs = append(diffs, Difference{Kind: DIFF_STATUS, Baseline: fmt.Sprint(a), Live: fmt.Sprint(b)})
+	}
+	diffs = append(diffs, diffHeaders(baseline.Response.Header, live.Response.Header, opts)...)
+	return append(diffs, diffBodies(baseline.ResponseBody, live.ResponseBody, opts)...)
+}
+
+func diffHeaders(a, b http.Header, opts DiffOptions) []Difference {
+	var diffs []Difference
+	names := make(map[string]bool)
+	for k := range a {
+		names[http.CanonicalHeaderKey(k)] = true
+	}
+	for k := range b {
+		names[http.CanonicalHeaderKey(k)] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		if !matchAny(opts.IgnoreHeaders, k) {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		av, bv := strings.Join(a.Values(k), ", "), strings.Join(b.Values(k), ", ")
+		if av != bv {
+			diffs = append(diffs, Difference{Kind: DIFF_HEADER, Path: k, Baseline: valueOrDefault(av, "(none)"), Live: valueOrDefault(bv, "(none)")})
+		}
+	}
+	return diffs
+}
+
+func diffBodies(a, b []byte, opts DiffOptions) []Difference {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	av, aerr := parseJSON(a)
+	bv, berr := parseJSON(b)
+	switch {
+	case aerr == nil && berr == nil:
+		var diffs []Difference
+		diffJSON("$", av, bv, opts, &diffs)
+		return diffs
+	case aerr == nil || berr == nil:
+		return []Difference{{Kind: DIFF_BODY, Baseline: bodyKind(a, aerr), Live: bodyKind(b, berr)}}
+	case opts.Values && !bytes.Equal(a, b):
+		return []Difference{{Kind: DIFF_BODY, Baseline: fmt.Sprintf("%d bytes", len(a)), Live: fmt.Sprintf("%d bytes", len(b))}}
+	}
+	return nil
+}
+
+func parseJSON(b []byte) (interface{}, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, fmt.Errorf("empty")
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func bodyKind(b []byte, err error) string {
+	switch {
+	case err == nil:
+		return "JSON"
+	case len(b) == 0:
+		return "empty"
+	}
+	return fmt.Sprintf("%d bytes, not JSON", len(b))
+}
+
+var jsonIndex = regexp.MustCompile(`\[\d+\]`)
+
+// ignoresField reports whether a JSON path, like $.data.items[0].id, is left
+// out of the comparison.
+func (opts *DiffOptions) ignoresField(p string) bool {
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+	wild := jsonIndex.ReplaceAllString(p, "[*]")
+	last := p
+	if i := strings.LastIndexAny(p, ".]"); i >= 0 {
+		last = p[i+1:]
+	}
+	for _, pattern := range opts.IgnoreFields {
+		pattern = strings.TrimPrefix(strings.TrimPrefix(pattern, "$"), ".")
+		if !strings.ContainsAny(pattern, ".[") {
+			if ok, _ := path.Match(pattern, last); ok && last != "" {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, wild); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func diffJSON(p string, a, b interface{}, opts DiffOptions, diffs *[]Difference) {
+	if opts.ignoresField(p) {
+		return
+	}
+	at, bt := jsonType(a), jsonType(b)
+	if at != bt {
+		*diffs = append(*diffs, Difference{Kind: DIFF_JSON, Path: p, Baseline: at, Live: bt})
+		return
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv := b.(map[string]interface{})
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			kp := p + "." + k
+			ak, aok := av[k]
+			bk, bok := bv[k]
+			switch {
+			case opts.ignoresField(kp):
+			case !bok:
+				*diffs = append(*diffs, Difference{Kind: DIFF_JSON, Path: kp, Baseline: jsonType(ak), Live: "missing"})
+			case !aok:
+				*diffs = append(*diffs, Difference{Kind: DIFF_JSON, Path: kp, Baseline: "missing", Live: jsonType(bk)})
+			default:
+				diffJSON(kp, ak, bk, opts, diffs)
+			}
+		}
+	case []interface{}:
+		bv := b.([]interface{})
+		if opts.Values && len(av) != len(bv) {
+			*diffs = append(*diffs, Difference{Kind: DIFF_JSON, Path: p, Baseline: fmt.Sprintf("%d items", len(av)), Live: fmt.Sprintf("%d items", len(bv))})
+		}
+		for i := 0; i < len(av) && i < len(bv); i++ {
+			diffJSON(fmt.Sprintf("%s[%d]", p, i), av[i], bv[i], opts, diffs)
+		}
+	default:
+		if opts.Values && fmt.Sprint(a) != fmt.Sprint(b) {
+			*diffs = append(*diffs, Difference{Kind: DIFF_JSON, Path: p, Baseline: jsonText(a), Live: jsonText(b)})
+		}
+	}
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "bool"
+	}
+	return "null"
+}
+
+func jsonText(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
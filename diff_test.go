@@ -0,0 +1,109 @@
+package cproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func liveFlow(method, rawurl string, status int, body string) *Flow {
+	return &Flow{
+		Request:      httptest.NewRequest(method, rawurl, nil),
+		Response:     &http.Response{StatusCode: status, Header: http.Header{"Content-Type": {"application/json"}}},
+		ResponseBody: []byte(body),
+	}
+}
+
+func TestDifferBaselineOrder(t *testing.T) {
+	var flows []*StoredFlow
+	for _, body := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		sf := recording("GET", "http://api.test/n", body)
+		sf.RespHeader.Set("Content-Type", "application/json")
+		flows = append(flows, sf)
+	}
+	baseline, err := LoadReplay(writeStore(t, flows...), nil, ReplayMatch{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := filepath.Join(t.TempDir(), "diff.jsonl")
+	d, err := NewDiffer(baseline, DiffOptions{Values: true}, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same responses again, each compared with its own recording
+	for i, body := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":3}`} {
+		if fd := d.Check(liveFlow("GET", "http://api.test/n", 200, body)); fd != nil {
+			t.Errorf("request %d: %s differs from recording %d: %v", i+1, body, fd.Baseline, fd.Differences)
+		}
+	}
+	if fd := d.Check(liveFlow("GET", "http://api.test/n", 200, `{"n":4}`)); fd == nil || fd.Baseline != flows[2].ID {
+		t.Errorf("changed value: got %+v, want a difference from recording %d", fd, flows[2].ID)
+	}
+	if fd := d.Check(liveFlow("GET", "http://api.test/new", 200, `{}`)); fd == nil || fd.Baseline != 0 {
+		t.Errorf("no recording: got %+v", fd)
+	}
+	d.Close()
+
+	compared, differing, missing := d.Stats()
+	if compared != 6 || differing != 1 || missing != 1 {
+		t.Errorf("stats %d compared, %d differing, %d missing; want 6, 1, 1", compared, differing, missing)
+	}
+	f, err := os.Open(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for sc := bufio.NewScanner(f); sc.Scan(); lines++ {
+		var fd FlowDiff
+		if err := json.Unmarshal(sc.Bytes(), &fd); err != nil {
+			t.Errorf("report line %d: %v", lines+1, err)
+		}
+	}
+	if lines != 2 {
+		t.Errorf("report has %d lines, want 2", lines)
+	}
+}
+
+func TestDiffFlows(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		opts           DiffOptions
+		status         int
+		header         http.Header
+		baseline, live string
+		want           []Difference
+	}{
+		{"same", DiffOptions{}, 200, nil, `{"a":1}`, `{"a":1}`, nil},
+		{"value ignored by default", DiffOptions{}, 200, nil, `{"a":1}`, `{"a":2}`, nil},
+		{"value", DiffOptions{Values: true}, 200, nil, `{"a":1}`, `{"a":2}`,
+			[]Difference{{Kind: DIFF_JSON, Path: "$.a", Baseline: "1", Live: "2"}}},
+		{"status", DiffOptions{}, 500, nil, `{}`, `{}`,
+			[]Difference{{Kind: DIFF_STATUS, Baseline: "200", Live: "500"}}},
+		{"ignored field", DiffOptions{Values: true, IgnoreFields: []string{"ts"}}, 200, nil,
+			`{"data":{"ts":1}}`, `{"data":{"ts":2}}`, nil},
+		{"header", DiffOptions{}, 200, http.Header{"X-Version": {"2"}}, `{}`, `{}`,
+			[]Difference{{Kind: DIFF_HEADER, Path: "X-Version", Baseline: "(none)", Live: "2"}}},
+		{"ignored header", DiffOptions{IgnoreHeaders: []string{"x-*"}}, 200, http.Header{"X-Version": {"2"}}, `{}`, `{}`, nil},
+	} {
+		baseline := liveFlow("GET", "http://api.test/", 200, test.baseline)
+		live := liveFlow("GET", "http://api.test/", test.status, test.live)
+		for k, v := range test.header {
+			live.Response.Header[k] = v
+		}
+		got := DiffFlows(baseline, live, test.opts)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.name, got[i], test.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package cproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// DECODE_LIMIT caps the size of a decompressed body, against compression
+// bombs. A body that decodes to more is kept as it is on the wire.
+var DECODE_LIMIT int64 = 256 << 20
+
+// contentCodings returns the codings of a Content-Encoding header in the
+// order they were applied, without identity.
+func contentCodings(encoding string) []string {
+	var codings []string
+	for _, c := range strings.Split(encoding, ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" && c != "identity" {
+			codings = append(codings, c)
+		}
+	}
+	return codings
+}
+
+// DecodeBody undoes the Content-Encoding of a body: gzip, deflate, br, zstd
+// or a list of them. A body without encoding is returned as it is.
+func DecodeBody(encoding string, body []byte) ([]byte, error) {
+	codings := contentCodings(encoding)
+	for i := len(codings) - 1; i >= 0; i-- {
+		r, err := decoder(codings[i], body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", codings[i], err)
+		}
+		decoded, err := ioutil.ReadAll(io.LimitReader(r, DECODE_LIMIT+1))
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", codings[i], err)
+		}
+		if int64(len(decoded)) > DECODE_LIMIT {
+			return nil, fmt.Errorf("%s: decoded body larger than %d bytes", codings[i], DECODE_LIMIT)
+		}
+		body = decoded
+	}
+	return body, nil
+}
+
+func decoder(coding string, body []byte) (io.ReadCloser, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate is meant to be zlib, but some servers send raw deflate
+		if r, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			return r, nil
+		}
+		return flate.NewReader(bytes.NewReader(body)), nil
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(bytes.NewReader(body))), nil
+	case "zstd":
+		d, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding")
+}
+
+// EncodeBody applies a Content-Encoding to a body, for putting a rewritten
+// body back on the wire the way it came.
+func EncodeBody(encoding string, body []byte) ([]byte, error) {
+	for _, coding := range contentCodings(encoding) {
+		var b bytes.Buffer
+		var w io.WriteCloser
+		switch coding {
+		case "gzip", "x-gzip":
+			w = gzip.NewWriter(&b)
+		case "deflate":
+			w = zlib.NewWriter(&b)
+		case "br":
+			w = brotli.NewWriter(&b)
+		case "zstd":
+			zw, err := zstd.NewWriter(&b, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			w = zw
+		default:
+			return nil, fmt.Errorf("%s: unsupported content encoding", coding)
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, fmt.Errorf("%s: %v", coding, err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("%s: %v", coding, err)
+		}
+		body = b.Bytes()
+	}
+	return body, nil
+}
+
+// BodyPolicy says which bodies the capture records. Types and Skip are
+// patterns of media types as in path.Match, e.g. text/*, application/json.
+// A body is recorded when its type matches Types, or Types is empty, and
+// matches nothing in Skip. A body without Content-Type has type "".
+type BodyPolicy struct {
+	Types   []string
+	Skip    []string
+	MaxSize int64 // larger bodies are not recorded, 0 for no limit
+	Encoded bool  // record compressed bodies as they are on the wire
+}
+
+// STREAMING_TYPES are media types of bodies that go on for as long as the
+// server likes. They are never recorded, whatever the body policy says.
+var STREAMING_TYPES = []string{"text/event-stream", "multipart/x-mixed-replace"}
+
+var DefaultBodyPolicy = BodyPolicy{
+	Skip:    []string{"video/*", "audio/*"},
+	MaxSize: 10 << 20,
+}
+
+// ParseMediaTypes splits a comma separated list of media type patterns.
+func ParseMediaTypes(list string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t == "" {
+			continue
+		}
+		if _, err := path.Match(t, ""); err != nil {
+			return nil, fmt.Errorf("%s: %v", t, err)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// records reports whether a body with the header h and length size, -1 if
+// unknown, is recorded. A body of unknown length is recorded as it is read,
+// see teeBody.
+func (bp *BodyPolicy) records(h http.Header, size int64) bool {
+	if bp.MaxSize > 0 && size > bp.MaxSize {
+		return false
+	}
+	mediaType := ""
+	if ct := h.Get("Content-Type"); ct != "" {
+		if mt, _, err := mime.ParseMediaType(ct); err == nil {
+			mediaType = mt
+		} else {
+			mediaType = strings.ToLower(strings.TrimSpace(strings.SplitN(ct, ";", 2)[0]))
+		}
+	}
+	if matchMediaType(STREAMING_TYPES, mediaType) || matchMediaType(bp.Skip, mediaType) {
+		return false
+	}
+	return len(bp.Types) == 0 || matchMediaType(bp.Types, mediaType)
+}
+
+func matchMediaType(patterns []string, mediaType string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// body returns the body to record and the content encoding removed from it,
+// "" when it is recorded as on the wire. A body over MaxSize gives nil.
+func (bp *BodyPolicy) body(h http.Header, wire []byte) ([]byte, string) {
+	body, decoded := wire, ""
+	if encoding := h.Get("Content-Encoding"); !bp.Encoded && len(contentCodings(encoding)) > 0 && len(wire) > 0 {
+		if b, err := DecodeBody(encoding, wire); err == nil {
+			body, decoded = b, encoding
+		}
+	}
+	if bp.MaxSize > 0 && int64(len(body)) > bp.MaxSize {
+		return nil, ""
+	}
+	return body, decoded
+}
+
+// teeBody keeps a copy of a body of unknown length as it is read on its way
+// to the client, up to max bytes, 0 for no limit. done gets the copy once
+// the body is read to the end or closed: nil when it went over max or was
+// closed before its end.
+type teeBody struct {
+	io.ReadCloser
+	max  int64
+	done func([]byte)
+	buf  bytes.Buffer
+	over bool
+	eof  bool
+	once sync.Once
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 && !t.over {
+		if t.max > 0 && int64(t.buf.Len()+n) > t.max {
+			t.over = true
+			t.buf = bytes.Buffer{}
+		} else {
+			t.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		t.eof = true
+		t.finish()
+	}
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	err := t.ReadCloser.Close()
+	t.finish()
+	return err
+}
+
+func (t *teeBody) finish() {
+	t.once.Do(func() {
+		var body []byte
+		if t.eof && !t.over {
+			body = t.buf.Bytes()
+		}
+		if t.done != nil {
+			t.done(body)
+		}
+	})
+}
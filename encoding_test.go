@@ -0,0 +1,175 @@
+package cproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	body := []byte(`{"hello":"world"}`)
+	for _, encoding := range []string{"", "identity", "gzip", "x-gzip", "deflate", "br", "zstd", "gzip, br", "GZIP"} {
+		wire, err := EncodeBody(encoding, body)
+		if err != nil {
+			t.Fatalf("%q: encode: %v", encoding, err)
+		}
+		got, err := DecodeBody(encoding, wire)
+		if err != nil {
+			t.Fatalf("%q: decode: %v", encoding, err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("%q: decoded %q, want %q", encoding, got, body)
+		}
+	}
+}
+
+func TestDecodeBodyErrors(t *testing.T) {
+	for _, test := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{"gzip", []byte("not gzip")},
+		{"compress", []byte("x")},
+	} {
+		if _, err := DecodeBody(test.encoding, test.body); err == nil {
+			t.Errorf("%q: no error", test.encoding)
+		}
+	}
+}
+
+func TestDecodeBodyLimit(t *testing.T) {
+	defer func(limit int64) { DECODE_LIMIT = limit }(DECODE_LIMIT)
+	DECODE_LIMIT = 10
+	for _, test := range []struct {
+		size int
+		ok   bool
+	}{
+		{10, true},
+		{11, false},
+	} {
+		gz, _ := EncodeBody("gzip", bytes.Repeat([]byte("a"), test.size))
+		if _, err := DecodeBody("gzip", gz); (err == nil) != test.ok {
+			t.Errorf("%d bytes: %v", test.size, err)
+		}
+	}
+	// a body decoding over the limit is recorded as it is on the wire
+	gz, _ := EncodeBody("gzip", bytes.Repeat([]byte("a"), 50))
+	got, decoded := (&BodyPolicy{}).body(http.Header{"Content-Encoding": {"gzip"}}, gz)
+	if !bytes.Equal(got, gz) || decoded != "" {
+		t.Errorf("got %q %q, want the wire body", got, decoded)
+	}
+}
+
+func TestParseMediaTypes(t *testing.T) {
+	got, err := ParseMediaTypes(" Text/*, ,application/json")
+	if err != nil || strings.Join(got, " ") != "text/* application/json" {
+		t.Errorf("got %q %v", got, err)
+	}
+	if _, err := ParseMediaTypes("text/[a"); err == nil {
+		t.Error("bad pattern parsed")
+	}
+}
+
+func TestBodyPolicyRecords(t *testing.T) {
+	bp := &BodyPolicy{Types: []string{"text/*", "application/json"}, Skip: []string{"text/csv"}, MaxSize: 100}
+	for _, test := range []struct {
+		contentType string
+		size        int64
+		want        bool
+	}{
+		{"text/html; charset=utf-8", 10, true},
+		{"application/json", -1, true},
+		{"Application/JSON", 10, true},
+		{"application/json", 101, false},
+		{"text/csv", 10, false},
+		{"image/png", 10, false},
+		{"", 10, false},
+		{"text/event-stream", -1, false},
+		{"multipart/x-mixed-replace; boundary=frame", -1, false},
+	} {
+		h := http.Header{}
+		if test.contentType != "" {
+			h.Set("Content-Type", test.contentType)
+		}
+		if got := bp.records(h, test.size); got != test.want {
+			t.Errorf("%q size %d: records %v, want %v", test.contentType, test.size, got, test.want)
+		}
+	}
+
+	// no Types records everything not skipped, streams excepted
+	all := &BodyPolicy{}
+	if !all.records(http.Header{}, -1) {
+		t.Error("empty policy does not record a body without type")
+	}
+	h := http.Header{"Content-Type": {"text/event-stream"}}
+	if all.records(h, -1) {
+		t.Error("empty policy records an event stream")
+	}
+}
+
+func TestBodyPolicyBody(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 50)
+	gz, _ := EncodeBody("gzip", body)
+	for _, test := range []struct {
+		name        string
+		bp          BodyPolicy
+		encoding    string
+		wire        []byte
+		want        []byte
+		wantDecoded string
+	}{
+		{"plain", BodyPolicy{}, "", body, body, ""},
+		{"decoded", BodyPolicy{}, "gzip", gz, body, "gzip"},
+		{"encoded", BodyPolicy{Encoded: true}, "gzip", gz, gz, ""},
+		{"undecodable", BodyPolicy{}, "gzip", body, body, ""},
+		{"decodes over max", BodyPolicy{MaxSize: 40}, "gzip", gz, nil, ""},
+	} {
+		h := http.Header{}
+		if test.encoding != "" {
+			h.Set("Content-Encoding", test.encoding)
+		}
+		got, decoded := test.bp.body(h, test.wire)
+		if !bytes.Equal(got, test.want) || decoded != test.wantDecoded {
+			t.Errorf("%s: got %q %q, want %q %q", test.name, got, decoded, test.want, test.wantDecoded)
+		}
+	}
+}
+
+func TestTeeBody(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		max  int64
+		read int // bytes read before Close, -1 for all
+		want []byte
+	}{
+		{"read to the end", 0, -1, []byte("0123456789")},
+		{"within max", 10, -1, []byte("0123456789")},
+		{"over max", 9, -1, nil},
+		{"closed early", 0, 4, nil},
+	} {
+		var got []byte
+		calls := 0
+		tee := &teeBody{
+			ReadCloser: ioutil.NopCloser(bytes.NewReader([]byte("0123456789"))),
+			max:        test.max,
+			done:       func(b []byte) { got = b; calls++ },
+		}
+		var out []byte
+		if test.read < 0 {
+			out, _ = ioutil.ReadAll(tee)
+		} else {
+			out = make([]byte, test.read)
+			io.ReadFull(tee, out)
+		}
+		tee.Close()
+		if test.read < 0 && string(out) != "0123456789" {
+			t.Errorf("%s: passed on %q", test.name, out)
+		}
+		if !bytes.Equal(got, test.want) || calls != 1 {
+			t.Errorf("%s: done with %q %d times, want %q once", test.name, got, calls, test.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package cproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// fire reports whether an action applies to this flow. No probability means
+// always, a probability of 0 never.
+func (a *Action) fire() bool {
+	return a.Probability == nil || rand.Float64() < *a.Probability
+}
+
+// blockResponse answers a request with the status of the action, 403 by
+// default, and content as body.
+func blockResponse(req *http.Request, a Action) *http.Response {
+	status := a.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	h := make(http.Header)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Length", fmt.Sprint(len(a.Content)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(strings.NewReader(a.Content)),
+		ContentLength: int64(len(a.Content)),
+		Request:       req,
+	}
+}
+
+// writeFault breaks the response to the client the way the action asks:
+//
+//	close        drop the connection before any header is sent
+//	reset        send headers and the first bytes of the body, then RST
+//	truncate     send headers and the first bytes of the body, then FIN
+//	bad-chunked  send a chunked body with a broken chunk size
+//
+// Connections that cannot be hijacked (HTTP/2) get the headers with the
+// Content-Length of the whole body and only the first bytes of it, so the
+// client sees the response cut short.
+func writeFault(w http.ResponseWriter, resp *http.Response, a Action) {
+	var body []byte
+	if resp.Body != nil {
+		body, _ = ioutil.ReadAll(resp.Body)
+	}
+	n := a.Bytes
+	if n < 0 || n > len(body) {
+		n = len(body)
+	}
+
+	var conn net.Conn
+	var bufrw *bufio.ReadWriter
+	var err error = http.ErrNotSupported
+	if hj, ok := w.(http.Hijacker); ok {
+		conn, bufrw, err = hj.Hijack()
+	}
+	if err == http.ErrNotSupported {
+		if a.Option == OPT_CLOSE {
+			n = 0
+		}
+		copyHeader(w.Header(), resp.Header)
+		w.Header().Del("Transfer-Encoding")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body[:n])
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return
+	}
+	if err != nil {
+		log.Error("hijack for fault", "err", err)
+		return
+	}
+	if a.Option == OPT_CLOSE {
+		conn.Close()
+		return
+	}
+
+	h := resp.Header.Clone()
+	if a.Option == OPT_BAD_CHUNKED {
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+	} else {
+		h.Del("Transfer-Encoding")
+		h.Set("Content-Length", fmt.Sprint(len(body)))
+	}
+	writeRawHeader(bufrw.Writer, resp.StatusCode, h)
+	switch a.Option {
+	case OPT_BAD_CHUNKED:
+		fmt.Fprintf(bufrw, "%x\r\n%s\r\nzz\r\n", n, body[:n])
+	default:
+		bufrw.Write(body[:n])
+	}
+	bufrw.Flush()
+	if a.Option == OPT_RESET {
+		resetConn(conn)
+		return
+	}
+	conn.Close()
+}
+
+func writeRawHeader(w *bufio.Writer, status int, h http.Header) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	h.Write(w)
+	w.WriteString("\r\n")
+}
+
+// resetConn closes c with an RST instead of a FIN.
+func resetConn(c net.Conn) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Close()
+}
+
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// wsFault applies a fault action to a WebSocket frame from the server. It
+// returns the frame to forward, or false when the frame must not be sent.
+func wsFault(w *Conn, message []byte, a Action) ([]byte, bool) {
+	switch a.Option {
+	case OPT_BLOCK:
+		return nil, false
+	case OPT_CLOSE:
+		w.Close()
+		return nil, false
+	case OPT_RESET:
+		resetConn(w.Conn.UnderlyingConn())
+		return nil, false
+	case OPT_TRUNCATE:
+		if a.Bytes >= 0 && a.Bytes < len(message) {
+			message = message[:a.Bytes]
+		}
+	}
+	return message, true
+}
@@ -0,0 +1,168 @@
+package cproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// faultServer answers every request with body broken by a.
+func faultServer(a Action, body string) *httptest.Server {
+	return httptest.NewServer(faultHandler(a, body))
+}
+
+func faultHandler(a Action, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+		writeFault(w, resp, a)
+	})
+}
+
+func TestWriteFault(t *testing.T) {
+	for _, test := range []struct {
+		action Action
+		body   string // read before the error
+		err    string // of the read, "" for none
+	}{
+		{Action{Option: OPT_TRUNCATE, Bytes: 4}, "0123", "unexpected EOF"},
+		{Action{Option: OPT_BAD_CHUNKED, Bytes: 4}, "0123", "invalid byte in chunk length"},
+		{Action{Option: OPT_TRUNCATE}, "", "unexpected EOF"},
+	} {
+		s := faultServer(test.action, "0123456789")
+		resp, err := http.Get(s.URL)
+		if err != nil {
+			t.Errorf("%s: %v", test.action.Option, err)
+			s.Close()
+			continue
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != test.body || err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: read %q %v, want %q %s", test.action.Option, b, err, test.body, test.err)
+		}
+		s.Close()
+	}
+}
+
+func TestWriteFaultClose(t *testing.T) {
+	s := faultServer(Action{Option: OPT_CLOSE}, "0123456789")
+	defer s.Close()
+	if resp, err := http.Get(s.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("close: got %s, want no response", resp.Status)
+	}
+}
+
+func TestWriteFaultReset(t *testing.T) {
+	s := faultServer(Action{Option: OPT_RESET, Bytes: 4}, "0123456789")
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: fault.test\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if string(b) != "0123" || !isConnReset(err) {
+		t.Errorf("reset: read %q %v, want 0123 and a connection reset", b, err)
+	}
+}
+
+func TestBlockAction(t *testing.T) {
+	rules := writeTemp(t, "rules.yml", `version: 2
+rules:
+  - regex: '^/blocked'
+    actions: [{option: block, status: 503, content: down}]
+`)
+	p := NewProxy("", "", rules, "", "")
+	for _, test := range []struct {
+		uri    string
+		status int
+		body   string
+	}{
+		{"/blocked", 503, "down"},
+		{"/open", 0, ""},
+	} {
+		req := httptest.NewRequest("GET", "http://api.test"+test.uri, nil)
+		_, resp := p.BeforeRequest(newContext(p, "", "http", req.Host), req)
+		if test.status == 0 {
+			if resp != nil {
+				t.Errorf("%s: blocked with %s", test.uri, resp.Status)
+			}
+			continue
+		}
+		if resp == nil {
+			t.Errorf("%s: not blocked", test.uri)
+			continue
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != test.status || string(b) != test.body {
+			t.Errorf("%s: got %d %q, want %d %q", test.uri, resp.StatusCode, b, test.status, test.body)
+		}
+	}
+}
+
+func TestFire(t *testing.T) {
+	zero, one := 0.0, 1.0
+	for _, test := range []struct {
+		probability *float64
+		want        bool
+	}{
+		{nil, true},
+		{&one, true},
+		{&zero, false},
+	} {
+		a := Action{Option: OPT_CLOSE, Probability: test.probability}
+		for i := 0; i < 100; i++ {
+			if a.fire() != test.want {
+				t.Errorf("probability %v: fired %v, want %v", a.Probability, !test.want, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestWriteFaultNoHijack(t *testing.T) {
+	for _, test := range []struct {
+		action Action
+		body   string
+	}{
+		{Action{Option: OPT_TRUNCATE, Bytes: 4}, "0123"},
+		{Action{Option: OPT_BAD_CHUNKED, Bytes: 4}, "0123"},
+		{Action{Option: OPT_RESET, Bytes: 4}, "0123"},
+		{Action{Option: OPT_CLOSE}, ""},
+	} {
+		w := httptest.NewRecorder()
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("0123456789"))}
+		writeFault(w, resp, test.action)
+		if got := w.Body.String(); got != test.body || w.Header().Get("Content-Length") != "10" {
+			t.Errorf("%s: got %q of %s, want %q of 10", test.action.Option, got, w.Header().Get("Content-Length"), test.body)
+		}
+	}
+
+	s := httptest.NewUnstartedServer(faultHandler(Action{Option: OPT_TRUNCATE, Bytes: 4}, "0123456789"))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+	resp, err := s.Client().Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || string(b) != "0123" || err == nil {
+		t.Errorf("HTTP/%d: read %q %v, want 0123 and an error", resp.ProtoMajor, b, err)
+	}
+}
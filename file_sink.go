@@ -0,0 +1,180 @@
+package cproxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rotation says when a capture file is moved aside and a new one started.
+// Zero values never rotate. Rotated files are named path.20060102-150405 and
+// gzipped to path.20060102-150405.gz when Gzip is set.
+type Rotation struct {
+	Size  int64         // bytes
+	Every time.Duration // age of the file
+	Gzip  bool
+}
+
+// FileSink appends flows to a file as JSON lines, one record per line, the
+// same records the redis sink pushes.
+type FileSink struct {
+	Path     string
+	Rotation Rotation
+
+	file   *os.File
+	size   int64
+	opened time.Time
+	lock   sync.Mutex
+}
+
+func NewFileSink(filePath string, rotation Rotation) (*FileSink, error) {
+	s := &FileSink{Path: filePath, Rotation: rotation}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size, s.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (s *FileSink) WriteFlow(f *Flow) error {
+	b, err := EncodeFlow(f, CAPTURE_SCHEMA_LATEST)
+	if err != nil {
+		return err
+	}
+	return s.WriteRecord(b)
+}
+
+// WriteRecord appends one JSON record and a newline.
+func (s *FileSink) WriteRecord(record []byte) error {
+	_, err := s.Write(append(record, '\n'))
+	return err
+}
+
+// Write appends b as it is, rotating the file first when it is due, so the
+// sink serves as a log file as well.
+func (s *FileSink) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return 0, os.ErrClosed
+	}
+	if s.due(int64(len(b))) {
+		if err := s.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file must rotate before n more bytes. A file with
+// nothing in it is never rotated.
+func (s *FileSink) due(n int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.Rotation.Size > 0 && s.size+n > s.Rotation.Size {
+		return true
+	}
+	return s.Rotation.Every > 0 && time.Since(s.opened) >= s.Rotation.Every
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	rotated := s.Path + "." + time.Now().Format("20060102-150405")
+	for i := 1; exists(rotated) || exists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s.%d", s.Path, time.Now().Format("20060102-150405"), i)
+	}
+	if err := os.Rename(s.Path, rotated); err != nil {
+		return err
+	}
+	if s.Rotation.Gzip {
+		go func() {
+			if err := gzipFile(rotated); err != nil {
+				captureLog.Error("gzip rotated file", "path", rotated, "err", err)
+			}
+		}()
+	}
+	return s.open()
+}
+
+func (s *FileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func exists(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return err == nil
+}
+
+// gzipFile replaces filePath by filePath.gz.
+func gzipFile(filePath string) error {
+	in, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(filePath+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filePath + ".gz")
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+// ParseSize reads a byte count with an optional k, m or g suffix.
+func ParseSize(s string) (int64, error) {
+	mul := int64(1)
+	switch {
+	case strings.HasSuffix(strings.ToLower(s), "k"):
+		mul, s = 1024, s[:len(s)-1]
+	case strings.HasSuffix(strings.ToLower(s), "m"):
+		mul, s = 1024*1024, s[:len(s)-1]
+	case strings.HasSuffix(strings.ToLower(s), "g"):
+		mul, s = 1024*1024*1024, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * mul, nil
+}
@@ -0,0 +1,94 @@
+package cproxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSink(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "flows.jsonl")
+	s, err := NewFileSink(filePath, Rotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://api.test/a?b=1", nil)
+	for _, body := range []string{"one", "two"} {
+		if err := s.WriteFlow(&Flow{Request: req, ResponseBody: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+	if err := s.WriteRecord([]byte("{}")); err != os.ErrClosed {
+		t.Errorf("write after close: %v", err)
+	}
+
+	f, _ := os.Open(filePath)
+	defer f.Close()
+	var got []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		f, err := DecodeRecord(scanner.Bytes())
+		if err != nil {
+			t.Fatalf("%q: %v", scanner.Text(), err)
+		}
+		got = append(got, f.Request.URL.String()+" "+string(f.ResponseBody))
+	}
+	if want := "http://api.test/a?b=1 one http://api.test/a?b=1 two"; strings.Join(got, " ") != want {
+		t.Errorf("records %q, want %q", got, want)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "flows.jsonl")
+	s, err := NewFileSink(filePath, Rotation{Size: 10, Gzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, record := range []string{`"12345678"`, `"2"`, `"3"`} {
+		if err := s.WriteRecord([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var gz []string
+	for deadline := time.Now().Add(2 * time.Second); len(gz) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		gz, _ = filepath.Glob(filePath + ".*.gz")
+	}
+	if len(gz) != 1 {
+		t.Fatalf("rotated files %v, want one gzipped", gz)
+	}
+	f, _ := os.Open(gz[0])
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(zr); string(b) != "\"12345678\"\n" {
+		t.Errorf("rotated %q", b)
+	}
+	// the record that did not fit moved on, the next one still fits
+	if b, _ := ioutil.ReadFile(filePath); string(b) != "\"2\"\n\"3\"\n" {
+		t.Errorf("current %q", b)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{"0": 0, "512": 512, "64k": 64 << 10, "10M": 10 << 20, "1g": 1 << 30} {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Errorf("%s: %d %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "k", "-1", "1t", "ten"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package cproxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tempCA points the root CA files into a new directory for the test.
+func tempCA(t *testing.T) string {
+	dir := t.TempDir()
+	pub, priv := caPubPath, caPrivPath
+	caPubPath, caPrivPath = filepath.Join(dir, "crts", "root.crt"), filepath.Join(dir, "crts", "root.pem")
+	t.Cleanup(func() { caPubPath, caPrivPath = pub, priv })
+	return dir
+}
+
+func TestEnsureRootCA(t *testing.T) {
+	tempCA(t)
+	if err := EnsureRootCA(); err != nil {
+		t.Fatal(err)
+	}
+	crt, err := ioutil.ReadFile(caPubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(crt)
+	if block == nil {
+		t.Fatalf("no PEM in %q", crt)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || !cert.IsCA {
+		t.Fatalf("root %v: %v", cert, err)
+	}
+	if fi, err := os.Stat(caPrivPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key %v: %v", fi, err)
+	}
+
+	// kept from then on
+	if err := EnsureRootCA(); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ioutil.ReadFile(caPubPath); string(again) != string(crt) {
+		t.Error("root CA generated again")
+	}
+
+	// a certificate without its key is not replaced
+	os.Remove(caPrivPath)
+	if err := EnsureRootCA(); err == nil {
+		t.Error("certificate without key accepted")
+	}
+}
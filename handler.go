@@ -6,21 +6,19 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"io"
-	llog "log"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 )
 
-var log *llog.Logger = llog.New(os.Stdout, "", llog.LstdFlags|llog.Lshortfile)
-
 type FakeServer struct {
 	host     string
 	address  string
 	upgrader *websocket.Upgrader
 	isTls    bool
 	handler  *ProxyHander
+
+	clientAddr string
 }
 
 var defaultUpgrader = &websocket.Upgrader{
@@ -35,7 +33,7 @@ func (p *FakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if IsWebSocketRequest(r) {
 		wsConn, err := defaultUpgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Println("ws upgrade error", err)
+			log.Error("websocket upgrade", "err", err)
 			return
 		}
 		defer wsConn.Close()
@@ -64,59 +62,91 @@ func (p *FakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		proxy, _, err := websocket.DefaultDialer.Dial(u.String(), newHeader)
 		//dumpResp(resp)
 		if err != nil {
-			log.Println("client ws upgrade error", err)
+			log.Error("websocket upgrade to client", "err", err)
 			return
 		}
 		defer proxy.Close()
 		// handle Websocket request
+		ctx := p.newContext(u.Scheme, r.Host)
+		ctx.Rules = p.handler.Proxy.Regexp.MatchAll(r.Host, r.URL.RequestURI())
+		throttle := p.handler.Proxy.flowThrottle(ctx)
+		upLimiter, downLimiter := newLimiter(throttle.up()), newLimiter(throttle.down())
 		conn := NewConn(wsConn)
 		conn.AfterReadFunc = func(messageType int, data string) {
-			if err := proxy.WriteMessage(websocket.TextMessage, []byte(data)); err != nil {
-				log.Println("write to server error", err)
+			message, ok := p.handler.Proxy.BeforeWsRequest(ctx, r, messageType, []byte(data))
+			if !ok {
+				return
+			}
+			throttle.Delay()
+			upLimiter.wait(len(message))
+			if err := proxy.WriteMessage(messageType, message); err != nil {
+				log.Debug("websocket write to server", "err", err)
 			}
 		}
 		go func() {
 			for {
-				_, message, err := proxy.ReadMessage()
+				messageType, message, err := proxy.ReadMessage()
 				if err != nil {
-					log.Println("read from server error:", err)
+					log.Debug("websocket read from server", "err", err)
 					return
 				}
-				if p.handler.Proxy.BeforeWsResponse(conn, r, message){
+				throttle.Delay()
+				downLimiter.wait(len(message))
+				if p.handler.Proxy.BeforeWsResponse(ctx, conn, r, messageType, message) {
 					continue
 				}
-				if _, e := conn.Write(message); e != nil {
-					log.Println("ws write to client:", e)
+				if e := conn.WriteMessage(messageType, message); e != nil {
+					log.Debug("websocket write to client", "err", e)
 				}
 			}
 		}()
 		conn.Listen()
 
 	} else {
-		handleHttp(p.handler, w, r, true)
+		scheme := "http"
+		if p.isTls {
+			scheme = "https"
+		}
+		handleHttp(p.handler, p.newContext(scheme, r.Host), w, r)
 	}
 }
 
-func NewFakeServer(host string, p *ProxyHander) (int, *http.Server) {
+func (p *FakeServer) newContext(scheme, host string) *Context {
+	ctx := newContext(p.handler.Proxy, p.clientAddr, scheme, host)
+	ctx.tunneled = true
+	return ctx
+}
+
+// NewFakeServer starts the local server a CONNECT tunnel is spliced into.
+// clientAddr is the address of the client that sent the CONNECT.
+func NewFakeServer(host, clientAddr string, p *ProxyHander) (int, *http.Server, error) {
+	domain, port := getSplitHostPort(host)
+	var caPub, caPriv string
+	if port == "443" {
+		var err error
+		if caPub, caPriv, err = GetCAPairPath(domain); err != nil {
+			return 0, nil, err
+		}
+	}
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		panic(err)
 	}
-	domain, port := getSplitHostPort(host)
 	h := &FakeServer{
 		host:    domain,
 		address: host,
 		handler: p,
+
+		clientAddr: clientAddr,
 	}
 	server := &http.Server{Handler: h}
 	if port == "443" {
 		h.isTls = true
-		caPub, caPriv := GetCAPairPath(domain)
 		go server.ServeTLS(listener, caPub, caPriv)
 	} else {
 		go server.Serve(listener)
 	}
-	return listener.Addr().(*net.TCPAddr).Port, server
+	return listener.Addr().(*net.TCPAddr).Port, server, nil
 }
 
 type ProxyHander struct {
@@ -124,11 +154,16 @@ type ProxyHander struct {
 }
 
 func (p *ProxyHander) handleConnect(w http.ResponseWriter, r *http.Request) {
-	port, server := NewFakeServer(r.Host, p)
+	port, server, err := NewFakeServer(r.Host, r.RemoteAddr, p)
+	if err != nil {
+		log.Error("intercept", "host", r.Host, "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
 	defer server.Shutdown(context.Background())
 	proxyClient, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	if err != nil {
-		log.Println("---", r.Host, err, "---")
+		log.Error("connect to fake server", "host", r.Host, "err", err)
 		return
 	}
 	fmt.Fprint(w, "HTTP/1.1 200 Connection established\r\n\r\n")
@@ -143,58 +178,105 @@ func (p *ProxyHander) handleConnect(w http.ResponseWriter, r *http.Request) {
 	}
 	defer realClient.Close()
 	defer proxyClient.Close()
-	go io.Copy(realClient, proxyClient)
-	io.Copy(proxyClient, realClient)
+	throttle := p.Proxy.Throttle
+	throttle.Delay()
+	go func() {
+		// pass a reset injected by a rule on to the real client
+		if _, err := copyThrottled(realClient, proxyClient, throttle.down()); isConnReset(err) {
+			resetConn(realClient)
+		}
+	}()
+	copyThrottled(proxyClient, realClient, throttle.up())
 }
 
-func handleHttp(p *ProxyHander, w http.ResponseWriter, r *http.Request, ssl bool) {
-	tr := &http.Transport{}
-	scheme := "http"
-	if ssl {
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		scheme = "https"
-	}
-	if p.Proxy.GetProxy() != nil {
-		tr.Proxy = http.ProxyURL(p.Proxy.GetProxy())
-	}
-
-	client := &http.Client{Transport: tr }
+func handleHttp(p *ProxyHander, ctx *Context, w http.ResponseWriter, r *http.Request) {
+	scheme := ctx.Scheme
+	client := p.Proxy.client(scheme)
 	newUrl := fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.RequestURI())
 
 	newReq, err := http.NewRequest(r.Method, newUrl, r.Body)
 	if err != nil {
-		log.Println("creat new request error", err)
+		log.Error("create upstream request", "err", err)
 		return
 	}
 	newReq.Header = r.Header
 	newReq.Host = r.Host
 	newReq.Header.Add("Host", r.Host)
 	delHopHeaders(newReq.Header)
+	newReq, resp := p.Proxy.BeforeRequest(ctx, newReq)
+	if throttle := p.Proxy.flowThrottle(ctx); throttle != nil {
+		throttle.Delay()
+		newReq.Body = throttleReadCloser(newReq.Body, throttle.Up)
+		w = throttleResponseWriter(w, throttle.Down)
+	}
 
 	var save io.ReadCloser
 	save, newReq.Body, _ = drainBody(newReq.Body)
-	resp, err := client.Do(newReq)
-	if err != nil {
-		llog.Printf("request error: %s", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if resp == nil {
+		resp, err = client.Do(traceRequest(ctx, newReq))
+		if err != nil {
+			log.Warn("upstream request failed", "url", newUrl, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if resp.Body == nil {
+		// built by a handler or an action without one
+		resp.Body = http.NoBody
 	}
-	defer resp.Body.Close()
 	newReq.Body = save
 
-	if p.Proxy.BeforeResponse(w, newReq, resp) {
+	// the response handlers close the bodies of the responses they replace
+	resp, handled := p.Proxy.BeforeResponse(ctx, w, newReq, resp)
+	defer resp.Body.Close()
+	if handled {
 		return
 	}
 	copyHeader(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	copyBody(w, resp)
+}
+
+// copyBody writes the body to the client, flushed as it comes when its
+// length is unknown, for event streams and long polls.
+func copyBody(w http.ResponseWriter, resp *http.Response) {
+	f, ok := w.(http.Flusher)
+	if resp.ContentLength >= 0 || !ok {
+		io.Copy(w, resp.Body)
+		return
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			f.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// client returns the client requests of the scheme go upstream with.
+func (p *Proxy) client(scheme string) *http.Client {
+	tr := &http.Transport{}
+	if scheme == "https" {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if p.GetProxy() != nil {
+		tr.Proxy = http.ProxyURL(p.GetProxy())
+	}
+	return &http.Client{Transport: tr}
 }
 
 func (p *ProxyHander) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "CONNECT" {
 		p.handleConnect(w, r)
 	} else {
-		handleHttp(p, w, r, false)
+		handleHttp(p, newContext(p.Proxy, r.RemoteAddr, "http", r.Host), w, r)
 	}
 }
 
@@ -0,0 +1,465 @@
+package cproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2, see http://www.softwareishard.com/blog/har-12-spec/. Fields this
+// proxy does not know are -1 where the spec allows it.
+
+var HAR_CREATOR = HarCreator{Name: "free-proxy", Version: "1.0"}
+
+type Har struct {
+	Log HarLog `json:"log"`
+}
+
+type HarLog struct {
+	Version string     `json:"version"`
+	Creator HarCreator `json:"creator"`
+	Entries []HarEntry `json:"entries"`
+}
+
+type HarCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HarEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HarRequest  `json:"request"`
+	Response        HarResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HarTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	ID              string      `json:"_id,omitempty"` // flow id of the capture
+}
+
+type HarRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []HarCookie    `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	QueryString []HarNameValue `json:"queryString"`
+	PostData    *HarPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HarResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []HarCookie    `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	Content     HarContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HarNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HarCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HttpOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// HarPostData has no encoding field in the spec; binary bodies are base64
+// with the custom _encoding field set.
+type HarPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type HarContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HarTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// HarEntryOf converts a captured exchange. WebSocket frames have no HAR
+// entry and give nil.
+func HarEntryOf(f *Flow) *HarEntry {
+	if f.Response == nil {
+		return nil
+	}
+	req, resp := f.Request, f.Response
+	start := time.Now()
+	if f.Context != nil && !f.Context.Start.IsZero() {
+		start = f.Context.Start
+	}
+	u := *req.URL
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if f.Context != nil && f.Context.Scheme != "" {
+			u.Scheme = f.Context.Scheme
+		}
+	}
+	e := &HarEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Time:            harPhase(f.Timings.Total),
+		Request:         harRequest(req.Method, u.String(), req.Proto, req.Header, f.RequestBody, f.RequestDecoded),
+		Response:        harResponse(resp.StatusCode, resp.Proto, resp.Header, f.ResponseBody, f.ResponseDecoded),
+		Timings:         harTimings(f.Timings),
+	}
+	if f.Context != nil {
+		e.ID = f.Context.ID
+	}
+	return e
+}
+
+// Flow returns the entry as a Flow. HAR keeps content decoded, but a
+// capture with --capture-encoded wrote it as on the wire; a body that still
+// decodes as its Content-Encoding says is taken as the wire form.
+func (e *HarEntry) Flow() (*Flow, error) {
+	req, err := http.NewRequest(e.Request.Method, e.Request.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Proto = e.Request.HttpVersion
+	req.Header = harHeader(e.Request.Headers)
+	start, _ := time.Parse(time.RFC3339Nano, e.StartedDateTime)
+	f := &Flow{
+		Context:  &Context{ID: e.ID, Scheme: req.URL.Scheme, Host: req.Host, Start: start},
+		Request:  req,
+		Response: &http.Response{StatusCode: e.Response.Status, Proto: e.Response.HttpVersion, Header: harHeader(e.Response.Headers)},
+		Timings:  noTimings,
+	}
+	f.Timings.DNS, f.Timings.Connect, f.Timings.TLS = e.Timings.DNS, e.Timings.Connect, e.Timings.SSL
+	f.Timings.Send, f.Timings.Wait, f.Timings.Receive = e.Timings.Send, e.Timings.Wait, e.Timings.Receive
+	f.Timings.Total = e.Time
+	if e.Timings.SSL > 0 && e.Timings.Connect >= e.Timings.SSL {
+		f.Timings.Connect -= e.Timings.SSL
+	}
+	if pd := e.Request.PostData; pd != nil {
+		if f.RequestBody, err = harBody(pd.Text, pd.Encoding); err != nil {
+			return nil, fmt.Errorf("postData: %v", err)
+		}
+		f.RequestDecoded = harDecoded(req.Header, f.RequestBody)
+	}
+	if f.ResponseBody, err = harBody(e.Response.Content.Text, e.Response.Content.Encoding); err != nil {
+		return nil, fmt.Errorf("content: %v", err)
+	}
+	f.ResponseDecoded = harDecoded(f.Response.Header, f.ResponseBody)
+	return f, nil
+}
+
+func harHeader(list []HarNameValue) http.Header {
+	h := make(http.Header, len(list))
+	for _, nv := range list {
+		h[nv.Name] = append(h[nv.Name], nv.Value)
+	}
+	return h
+}
+
+func harBody(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+// harDecoded returns the Content-Encoding removed from a HAR body, "" when
+// the body is as on the wire.
+func harDecoded(h http.Header, body []byte) string {
+	encoding := h.Get("Content-Encoding")
+	if len(contentCodings(encoding)) == 0 || len(body) == 0 {
+		return ""
+	}
+	if _, err := DecodeBody(encoding, body); err == nil {
+		return ""
+	}
+	return encoding
+}
+
+// ReadHar reads the entries of a HAR document as flows.
+func ReadHar(r io.Reader) ([]*Flow, error) {
+	var har Har
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, err
+	}
+	flows := make([]*Flow, 0, len(har.Log.Entries))
+	for i := range har.Log.Entries {
+		f, err := har.Log.Entries[i].Flow()
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i+1, err)
+		}
+		flows = append(flows, f)
+	}
+	return flows, nil
+}
+
+// harTimings maps the phases; HAR counts the TLS handshake into connect and
+// does not allow -1 for send, wait and receive.
+func harTimings(t Timings) HarTimings {
+	h := HarTimings{
+		Blocked: -1,
+		DNS:     t.DNS,
+		Connect: t.Connect,
+		SSL:     t.TLS,
+		Send:    harPhase(t.Send),
+		Wait:    harPhase(t.Wait),
+		Receive: harPhase(t.Receive),
+	}
+	if h.Connect >= 0 && h.SSL > 0 {
+		h.Connect += h.SSL
+	}
+	return h
+}
+
+func harPhase(ms float64) float64 {
+	if ms < 0 {
+		return 0
+	}
+	return ms
+}
+
+// harRequest and harResponse take the decoded content encoding of the body;
+// the size of a decoded body on the wire is not known.
+func harRequest(method, rawurl, proto string, h http.Header, body []byte, decoded string) HarRequest {
+	r := HarRequest{
+		Method:      method,
+		Url:         rawurl,
+		HttpVersion: valueOrDefault(proto, "HTTP/1.1"),
+		Cookies:     []HarCookie{},
+		Headers:     harHeaders(h),
+		QueryString: []HarNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	for _, c := range (&http.Request{Header: h}).Cookies() {
+		r.Cookies = append(r.Cookies, HarCookie{Name: c.Name, Value: c.Value})
+	}
+	if u, err := url.Parse(rawurl); err == nil {
+		r.QueryString = harValues(u.Query())
+	}
+	if len(body) > 0 {
+		r.PostData = &HarPostData{MimeType: h.Get("Content-Type")}
+		r.PostData.Text, r.PostData.Encoding = harText(body)
+	}
+	if decoded != "" {
+		r.BodySize = -1
+	}
+	return r
+}
+
+func harResponse(status int, proto string, h http.Header, body []byte, decoded string) HarResponse {
+	r := HarResponse{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HttpVersion: valueOrDefault(proto, "HTTP/1.1"),
+		Cookies:     []HarCookie{},
+		Headers:     harHeaders(h),
+		Content:     HarContent{Size: len(body), MimeType: h.Get("Content-Type")},
+		RedirectURL: h.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	for _, c := range (&http.Response{Header: h}).Cookies() {
+		hc := HarCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HttpOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			hc.Expires = c.Expires.Format(time.RFC3339)
+		}
+		r.Cookies = append(r.Cookies, hc)
+	}
+	r.Content.Text, r.Content.Encoding = harText(body)
+	if decoded != "" {
+		r.BodySize = -1
+	}
+	return r
+}
+
+// harHeaders lists every value of every header, sorted by name.
+func harHeaders(h http.Header) []HarNameValue {
+	return harValues(url.Values(h))
+}
+
+func harValues(v url.Values) []HarNameValue {
+	names := make([]string, 0, len(v))
+	for k := range v {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	list := []HarNameValue{}
+	for _, k := range names {
+		for _, value := range v[k] {
+			list = append(list, HarNameValue{Name: k, Value: value})
+		}
+	}
+	return list
+}
+
+// harText returns body as text, or base64 and "base64" when it is not UTF-8.
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+const harTrailer = "\n]}}\n"
+
+// HarSink appends flows to a HAR file. The file is a complete HAR document
+// after every write: each entry overwrites the closing brackets and writes
+// them again behind itself. An existing file is replaced.
+type HarSink struct {
+	Path string
+
+	file *os.File
+	end  int64 // offset of the trailer
+	n    int
+	lock sync.Mutex
+}
+
+func NewHarSink(filePath string) (*HarSink, error) {
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	creator, _ := json.Marshal(HAR_CREATOR)
+	head := fmt.Sprintf(`{"log":{"version":"1.2","creator":%s,"entries":[`, creator)
+	if _, err := f.WriteString(head + harTrailer); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &HarSink{Path: filePath, file: f, end: int64(len(head))}, nil
+}
+
+func (s *HarSink) WriteFlow(f *Flow) error {
+	if e := HarEntryOf(f); e != nil {
+		return s.Append(e)
+	}
+	return nil
+}
+
+// Append writes one entry.
+func (s *HarSink) Append(e *HarEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	var buf bytes.Buffer
+	if s.n > 0 {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\n")
+	buf.Write(b)
+	n := buf.Len()
+	buf.WriteString(harTrailer)
+	if _, err := s.file.WriteAt(buf.Bytes(), s.end); err != nil {
+		return err
+	}
+	s.end += int64(n)
+	s.n++
+	return nil
+}
+
+func (s *HarSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// ConvertHar reads JSON capture records, one per line as in a redis queue
+// dump or a JSONL capture, and writes a HAR document. Empty lines are skipped.
+func ConvertHar(w io.Writer, r io.Reader, reverse bool) (int, error) {
+	var lines [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			lines = append(lines, append([]byte(nil), line...))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if reverse {
+		for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+			lines[i], lines[j] = lines[j], lines[i]
+		}
+	}
+	return WriteHar(w, lines)
+}
+
+// WriteHar writes a HAR document of JSON capture records in order, records
+// of any schema version. WebSocket frames are skipped.
+func WriteHar(w io.Writer, records [][]byte) (int, error) {
+	flows := make([]*Flow, 0, len(records))
+	for i, record := range records {
+		f, err := DecodeRecord(record)
+		if err != nil {
+			return 0, fmt.Errorf("record %d: %v", i+1, err)
+		}
+		flows = append(flows, f)
+	}
+	return WriteHarFlows(w, flows)
+}
+
+// WriteHarFlows writes a HAR document of the flows, skipping WebSocket frames.
+func WriteHarFlows(w io.Writer, flows []*Flow) (int, error) {
+	entries := []HarEntry{}
+	for _, f := range flows {
+		if e := HarEntryOf(f); e != nil {
+			entries = append(entries, *e)
+		}
+	}
+	return len(entries), writeHarEntries(w, entries)
+}
+
+func writeHarEntries(w io.Writer, entries []HarEntry) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(Har{Log: HarLog{Version: "1.2", Creator: HAR_CREATOR, Entries: entries}})
+}
@@ -0,0 +1,89 @@
+package cproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHarSink(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "flows.har")
+	s, err := NewHarSink(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	req := httptest.NewRequest("POST", "http://api.test/login?next=%2Fhome", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := &http.Response{StatusCode: 201, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"application/json"}}}
+	for i, f := range []*Flow{
+		{Request: req, Response: resp, RequestBody: []byte("user=u"), ResponseBody: []byte(`{"ok":true}`), Timings: Timings{-1, -1, -1, 1, 20, 25, 2, 27}},
+		{Request: req, ResponseBody: []byte("a websocket frame")},
+		{Request: req, Response: resp, ResponseBody: []byte{0xff, 0xfe}},
+	} {
+		if err := s.WriteFlow(f); err != nil {
+			t.Fatalf("flow %d: %v", i, err)
+		}
+		// the file is a complete document after every write
+		b, _ := ioutil.ReadFile(filePath)
+		var har Har
+		if err := json.Unmarshal(b, &har); err != nil {
+			t.Fatalf("after flow %d: %v\n%s", i, err, b)
+		}
+	}
+
+	b, _ := ioutil.ReadFile(filePath)
+	var har Har
+	json.Unmarshal(b, &har)
+	if len(har.Log.Entries) != 2 {
+		t.Fatalf("%d entries, want 2 without the frame", len(har.Log.Entries))
+	}
+	e := har.Log.Entries[0]
+	if e.Request.Method != "POST" || e.Request.Url != "http://api.test/login?next=%2Fhome" || e.Request.PostData == nil ||
+		e.Request.PostData.Text != "user=u" || e.Response.Status != 201 || e.Response.Content.Text != `{"ok":true}` || e.Timings.Wait != 20 {
+		t.Errorf("entry %+v", e)
+	}
+	if e := har.Log.Entries[1]; e.Response.Content.Encoding != "base64" {
+		t.Errorf("binary body: %+v", e.Response.Content)
+	}
+}
+
+func TestConvertHar(t *testing.T) {
+	in := `{"url":"/a","method":"GET","req-header":{"Host":"api.test"},"resp":"b2s=","status":200}
+
+{"url":"http://api.test/b","method":"DELETE","resp":"","status":204}
+`
+	for _, test := range []struct {
+		reverse bool
+		want    string
+	}{
+		{false, "http://api.test/a http://api.test/b"},
+		{true, "http://api.test/b http://api.test/a"},
+	} {
+		var b bytes.Buffer
+		n, err := ConvertHar(&b, strings.NewReader(in), test.reverse)
+		if err != nil || n != 2 {
+			t.Fatalf("converted %d %v", n, err)
+		}
+		var har Har
+		if err := json.Unmarshal(b.Bytes(), &har); err != nil {
+			t.Fatal(err)
+		}
+		var urls []string
+		for _, e := range har.Log.Entries {
+			urls = append(urls, e.Request.Url)
+		}
+		if strings.Join(urls, " ") != test.want {
+			t.Errorf("reverse %v: %v, want %s", test.reverse, urls, test.want)
+		}
+	}
+	if _, err := ConvertHar(ioutil.Discard, strings.NewReader(`{"resp":"not base64!"}`), false); err == nil {
+		t.Error("bad base64 converted")
+	}
+}
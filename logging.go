@@ -0,0 +1,379 @@
+package cproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LOG_CONSOLE = "console"
+	LOG_JSON    = "json"
+)
+
+// The loggers of the proxy, one per component, each with a level of its own.
+// They write through the configuration of SetupLogging, whenever it is set.
+var (
+	log           = Logger("proxy")
+	rulesLog      = Logger("rules")
+	scriptLog     = Logger("script")
+	captureLog    = Logger("capture")
+	replayLog     = Logger("replay")
+	adminLog      = Logger("admin")
+	breakpointLog = Logger("breakpoint")
+)
+
+// Logging says where the operational log and the traffic log go and how
+// they look. The traffic log is the dump of flows that the proxy Level asks
+// for; the operational log is everything else, filtered by the levels.
+type Logging struct {
+	Format        string                // LOG_CONSOLE or LOG_JSON
+	File          string                // of the operational log, "" for stdout
+	Traffic       string                // of the traffic log, "" for stdout
+	TrafficFormat string                // "" for Format
+	Rotation      Rotation              // of both files
+	Level         slog.Level            // of the components without a level of their own
+	Levels        map[string]slog.Level // by component
+}
+
+var DefaultLogging = Logging{Format: LOG_CONSOLE, Level: slog.LevelInfo}
+
+type logState struct {
+	Logging
+	out, traffic io.Writer
+	files        []io.Closer
+}
+
+var logs atomic.Pointer[logState]
+
+func init() {
+	logs.Store(&logState{Logging: DefaultLogging, out: os.Stdout, traffic: os.Stdout})
+}
+
+// SetupLogging sends the logs where l says, closing the files of the
+// previous setup.
+func SetupLogging(l Logging) error {
+	for _, format := range []string{l.Format, l.TrafficFormat} {
+		switch format {
+		case "", LOG_CONSOLE, LOG_JSON:
+		default:
+			return fmt.Errorf("log format must be %s or %s", LOG_CONSOLE, LOG_JSON)
+		}
+	}
+	if l.Format == "" {
+		l.Format = LOG_CONSOLE
+	}
+	if l.TrafficFormat == "" {
+		l.TrafficFormat = l.Format
+	}
+	st := &logState{Logging: l, out: os.Stdout, traffic: os.Stdout}
+	open := func(filePath string) (io.Writer, error) {
+		for _, f := range st.files {
+			if s := f.(*FileSink); s.Path == filePath {
+				return s, nil
+			}
+		}
+		s, err := NewFileSink(filePath, l.Rotation)
+		if err != nil {
+			return nil, err
+		}
+		st.files = append(st.files, s)
+		return s, nil
+	}
+	var err error
+	if l.File != "" {
+		if st.out, err = open(l.File); err != nil {
+			st.close()
+			return err
+		}
+	}
+	if l.Traffic != "" {
+		if st.traffic, err = open(l.Traffic); err != nil {
+			st.close()
+			return err
+		}
+	}
+	logs.Swap(st).close()
+	return nil
+}
+
+// SetLogLevels changes the levels of the running loggers, spec as for
+// ParseLogLevels.
+func SetLogLevels(spec string) error {
+	level, levels, err := ParseLogLevels(spec)
+	if err != nil {
+		return err
+	}
+	for {
+		old := logs.Load()
+		st := *old
+		st.Level, st.Levels = level, levels
+		if logs.CompareAndSwap(old, &st) {
+			return nil
+		}
+	}
+}
+
+// LogLevels returns the levels in the form ParseLogLevels reads.
+func LogLevels() string {
+	st := logs.Load()
+	spec := []string{strings.ToLower(st.Level.String())}
+	for _, c := range sortedKeys(st.Levels) {
+		spec = append(spec, c+"="+strings.ToLower(st.Levels[c].String()))
+	}
+	return strings.Join(spec, ",")
+}
+
+// ParseLogLevels reads a level, debug, info, warn or error, optionally
+// followed by levels of single components: warn,capture=debug,rules=info.
+func ParseLogLevels(spec string) (slog.Level, map[string]slog.Level, error) {
+	level := slog.LevelInfo
+	levels := make(map[string]slog.Level)
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		component, name := "", part
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			component, name = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(name)); err != nil {
+			return 0, nil, fmt.Errorf("log level %q, want debug, info, warn or error", name)
+		}
+		if component == "" {
+			level = l
+		} else {
+			levels[component] = l
+		}
+	}
+	return level, levels, nil
+}
+
+func (st *logState) close() {
+	for _, f := range st.files {
+		f.Close()
+	}
+}
+
+func (st *logState) level(component string) slog.Level {
+	if l, ok := st.Levels[component]; ok {
+		return l
+	}
+	return st.Level
+}
+
+// Logger returns the logger of a component, for handlers and scripts built
+// on the proxy to log the way it does.
+func Logger(component string) *slog.Logger {
+	return slog.New(&componentHandler{component: component})
+}
+
+// componentHandler checks the level of its component and hands the record
+// to the output of the current setup.
+type componentHandler struct {
+	component string
+	with      []func(slog.Handler) slog.Handler
+}
+
+func (h *componentHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= logs.Load().level(h.component)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	st := logs.Load()
+	var out slog.Handler
+	if st.Format == LOG_JSON {
+		out = slog.NewJSONHandler(st.out, &slog.HandlerOptions{
+			Level:       slog.LevelDebug,
+			AddSource:   true,
+			ReplaceAttr: shortSource,
+		}).WithAttrs([]slog.Attr{slog.String("component", h.component)})
+	} else {
+		out = &consoleHandler{w: st.out, component: h.component, color: colored(st.out)}
+	}
+	for _, with := range h.with {
+		out = with(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.wrap(func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.wrap(func(out slog.Handler) slog.Handler { return out.WithGroup(name) })
+}
+
+func (h *componentHandler) wrap(with func(slog.Handler) slog.Handler) slog.Handler {
+	return &componentHandler{component: h.component, with: append(h.with[:len(h.with):len(h.with)], with)}
+}
+
+// shortSource writes the source of a JSON record as file:line, as the
+// console does.
+func shortSource(groups []string, a slog.Attr) slog.Attr {
+	if s, ok := a.Value.Any().(*slog.Source); ok && len(groups) == 0 {
+		return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(s.File), s.Line))
+	}
+	return a
+}
+
+// consoleHandler writes a record as one line,
+//
+//	2006/01/02 15:04:05 WARN  capture  redis_sink.go:237 retrying records=12 err="..."
+//
+// with the level and component in color on a terminal.
+type consoleHandler struct {
+	w         io.Writer
+	component string
+	color     bool
+	attrs     []byte // key=value pairs of WithAttrs, formatted already
+	group     string // prefix of the keys, from WithGroup
+}
+
+var levelColors = map[slog.Level]string{
+	slog.LevelDebug: "\033[90m",
+	slog.LevelInfo:  "\033[32m",
+	slog.LevelWarn:  "\033[33m",
+	slog.LevelError: "\033[31m",
+}
+
+func (h *consoleHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	buf.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	level := fmt.Sprintf("%-5s", r.Level.String())
+	if h.color {
+		color := levelColors[slog.LevelError]
+		for l := slog.LevelDebug; l <= slog.LevelError; l += 4 {
+			if r.Level >= l {
+				color = levelColors[l]
+			}
+		}
+		fmt.Fprintf(&buf, "%s%s\033[0m \033[36m%-8s\033[0m ", color, level, h.component)
+	} else {
+		fmt.Fprintf(&buf, "%s %-8s ", level, h.component)
+	}
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		fmt.Fprintf(&buf, "%s:%d ", filepath.Base(frame.File), frame.Line)
+	}
+	buf.WriteString(r.Message)
+	buf.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendConsoleAttr(&buf, h.group, a)
+		return true
+	})
+	buf.WriteByte('\n')
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	buf.Write(h.attrs)
+	for _, a := range attrs {
+		appendConsoleAttr(&buf, h.group, a)
+	}
+	c := *h
+	c.attrs = buf.Bytes()
+	return &c
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.group = h.group + name + "."
+	return &c
+}
+
+func appendConsoleAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			appendConsoleAttr(buf, prefix, ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	var s string
+	switch v.Kind() {
+	case slog.KindTime:
+		s = v.Time().Format(time.RFC3339)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			s = err.Error()
+		} else {
+			s = fmt.Sprint(v.Any())
+		}
+	default:
+		s = v.String()
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		s = strconv.Quote(s)
+	}
+	fmt.Fprintf(buf, " %s%s=%s", prefix, a.Key, s)
+}
+
+// colored reports whether w is a terminal that takes colors.
+func colored(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+var trafficLock sync.Mutex
+
+// logTraffic writes an entry of the traffic log: text as it is in console
+// format, msg and args as a JSON line in JSON format.
+func logTraffic(text string, msg string, args ...interface{}) {
+	st := logs.Load()
+	if st.TrafficFormat == LOG_JSON {
+		slog.New(slog.NewJSONHandler(st.traffic, nil)).Info(msg, args...)
+		return
+	}
+	trafficLock.Lock()
+	defer trafficLock.Unlock()
+	io.WriteString(st.traffic, text)
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...interface{}) {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	r := slog.NewRecord(time.Now(), slog.LevelError, msg, pcs[0])
+	r.Add(args...)
+	log.Handler().Handle(context.Background(), r)
+	os.Exit(1)
+}
+
+func sortedKeys(m map[string]slog.Level) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
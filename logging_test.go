@@ -0,0 +1,168 @@
+package cproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupTestLogging sends the logs as l says for the test, back to the
+// default afterwards.
+func setupTestLogging(t *testing.T, l Logging) {
+	t.Helper()
+	if err := SetupLogging(l); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetupLogging(DefaultLogging) })
+}
+
+func readLines(t *testing.T, filePath string) []string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+}
+
+func TestParseLogLevels(t *testing.T) {
+	for _, test := range []struct {
+		spec   string
+		level  slog.Level
+		levels string
+	}{
+		{"", slog.LevelInfo, ""},
+		{"debug", slog.LevelDebug, ""},
+		{"warn,capture=debug, rules = error", slog.LevelWarn, "capture=DEBUG rules=ERROR"},
+		{"script=warn", slog.LevelInfo, "script=WARN"},
+	} {
+		level, levels, err := ParseLogLevels(test.spec)
+		var got []string
+		for _, c := range sortedKeys(levels) {
+			got = append(got, c+"="+levels[c].String())
+		}
+		if err != nil || level != test.level || strings.Join(got, " ") != test.levels {
+			t.Errorf("%q: %v %q %v, want %v %q", test.spec, level, got, err, test.level, test.levels)
+		}
+	}
+	for _, spec := range []string{"loud", "capture=", "info,rules=verbose"} {
+		if _, _, err := ParseLogLevels(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "proxy.log")
+	setupTestLogging(t, Logging{File: filePath, Level: slog.LevelInfo})
+	if err := SetLogLevels("warn,capture=debug"); err != nil {
+		t.Fatal(err)
+	}
+	if got := LogLevels(); got != "warn,capture=debug" {
+		t.Errorf("levels %q", got)
+	}
+	rulesLog.Info("dropped")
+	rulesLog.Warn("kept", "file", "rules.yml")
+	captureLog.Debug("kept too", "records", 2)
+	replayLog.Info("dropped")
+
+	lines := readLines(t, filePath)
+	if len(lines) != 2 {
+		t.Fatalf("lines %q", lines)
+	}
+	for i, want := range []string{"WARN  rules    logging_test.go:", "DEBUG capture  logging_test.go:"} {
+		if !strings.Contains(lines[i], want) {
+			t.Errorf("line %q, want %q", lines[i], want)
+		}
+	}
+	if !strings.HasSuffix(lines[0], "kept file=rules.yml") || !strings.HasSuffix(lines[1], "kept too records=2") {
+		t.Errorf("lines %q", lines)
+	}
+	if err := SetLogLevels("info,rules=loud"); err == nil || LogLevels() != "warn,capture=debug" {
+		t.Errorf("bad spec changed the levels to %q: %v", LogLevels(), err)
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "proxy.log")
+	setupTestLogging(t, Logging{Format: LOG_JSON, File: filePath, Level: slog.LevelInfo})
+	adminLog.With("addr", ":8081").Info("admin listening", "n", 1)
+
+	var entry map[string]interface{}
+	lines := readLines(t, filePath)
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil || len(lines) != 1 {
+		t.Fatalf("%q: %v", lines, err)
+	}
+	if entry["msg"] != "admin listening" || entry["component"] != "admin" || entry["level"] != "INFO" ||
+		entry["addr"] != ":8081" || entry["n"] != 1.0 || !strings.HasPrefix(entry["source"].(string), "logging_test.go:") {
+		t.Errorf("entry %s", lines[0])
+	}
+}
+
+func TestTrafficLog(t *testing.T) {
+	dir := t.TempDir()
+	logPath, trafficPath := filepath.Join(dir, "proxy.log"), filepath.Join(dir, "traffic.log")
+	reqMsg := &MessageReq{Method: "GET", Url: "/a", Header: http.Header{"X-A": {"1"}}, Content: []byte("q")}
+	respMsg := &MessageResp{Status: 200, Header: http.Header{"X-B": {"2"}}, Content: []byte("r")}
+	ctx := &Context{ID: "f1"}
+
+	for _, test := range []struct {
+		level int
+		want  string
+	}{
+		{LEVEL_1, "---------------\n> GET /a\n\n< 200 \n"},
+		{LEVEL_2, "---------------\n> GET /a\n> X-A: 1\n\n< 200 \n< X-B: 2\n"},
+		{LEVEL_3, "---------------\n> GET /a\n> X-A: 1\n\n> q\n\n< 200 \n< X-B: 2\n\n< r\n"},
+	} {
+		setupTestLogging(t, Logging{File: logPath, Traffic: trafficPath})
+		logFlow(ctx, test.level, reqMsg, respMsg)
+		SetupLogging(DefaultLogging)
+		b, _ := ioutil.ReadFile(trafficPath)
+		if !strings.HasSuffix(string(b), test.want) {
+			t.Errorf("level %d: %q, want %q", test.level, b, test.want)
+		}
+	}
+	if b, _ := ioutil.ReadFile(logPath); len(b) != 0 {
+		t.Errorf("flows in the operational log: %q", b)
+	}
+
+	jsonPath := filepath.Join(dir, "traffic.jsonl")
+	setupTestLogging(t, Logging{Traffic: jsonPath, TrafficFormat: LOG_JSON})
+	logFlow(ctx, LEVEL_2, reqMsg, respMsg)
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(readLines(t, jsonPath)[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "flow" || entry["id"] != "f1" || entry["url"] != "/a" || entry["status"] != 200.0 ||
+		entry["request_headers"] == nil || entry["request_body"] != nil {
+		t.Errorf("entry %v", entry)
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "proxy.log")
+	setupTestLogging(t, Logging{File: filePath, Level: slog.LevelInfo, Rotation: Rotation{Size: 200}})
+	for i := 0; i < 10; i++ {
+		log.Info("a line of about sixty bytes with the time", "i", i)
+	}
+	var rotated []string
+	for deadline := time.Now().Add(2 * time.Second); len(rotated) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rotated, _ = filepath.Glob(filePath + ".*")
+	}
+	if len(rotated) < 2 {
+		t.Fatalf("rotated files %v", rotated)
+	}
+	for _, line := range readLines(t, filePath) {
+		if !strings.Contains(line, "a line of about sixty bytes") {
+			t.Errorf("current file has %q", line)
+		}
+	}
+	if err := SetupLogging(Logging{Format: "xml"}); err == nil {
+		t.Error("xml format set up")
+	}
+}
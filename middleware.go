@@ -0,0 +1,164 @@
+package cproxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Context follows one flow through the proxy: a single HTTP exchange, or a
+// whole WebSocket connection with all of its frames.
+type Context struct {
+	Proxy      *Proxy
+	ID         string // unique per flow, shared by the frames of a WebSocket
+	ClientAddr string // address of the real client, also behind CONNECT
+	Scheme     string // http, https, ws or wss
+	Host       string // host and port the client asked for
+	Start      time.Time
+	Rules      []Rule                 // rules matched by the request, or the handshake of a WebSocket
+	Scratch    map[string]interface{} // free for handlers, lives as long as the flow
+
+	tunneled     bool
+	held         string // what the request breakpoint decided, if one held the flow
+	trace        *flowTrace
+	serverFrames int
+	clientFrames int
+	wsLock       sync.Mutex // one frame handler at a time, the directions run concurrently
+}
+
+func newContext(p *Proxy, clientAddr, scheme, host string) *Context {
+	return &Context{
+		Proxy:      p,
+		ID:         newFlowID(),
+		ClientAddr: clientAddr,
+		Scheme:     scheme,
+		Host:       host,
+		Start:      time.Now(),
+		Scratch:    make(map[string]interface{}),
+	}
+}
+
+// Rule returns the first matched rule of the flow.
+func (c *Context) Rule() (Rule, bool) {
+	if len(c.Rules) == 0 {
+		return Rule{}, false
+	}
+	return c.Rules[0], true
+}
+
+// RequestHandler sees every request after the rule actions, before it is
+// sent upstream. It returns the request to send on, nil to keep req, or a
+// response that answers the client directly; a nil Body is an empty one.
+type RequestHandler interface {
+	HandleRequest(ctx *Context, req *http.Request) (*http.Request, *http.Response)
+}
+
+// ResponseHandler sees every response before the rule actions and before it
+// is written to the client. It returns the response to send on, nil to keep
+// resp; a nil Body is an empty one. The body of a replaced response is
+// closed, a handler still reading it should set resp.Body and return resp.
+type ResponseHandler interface {
+	HandleResponse(ctx *Context, req *http.Request, resp *http.Response) *http.Response
+}
+
+// WsFrame is a single WebSocket message. Handlers may change Data in place.
+type WsFrame struct {
+	Type       int // websocket.TextMessage or websocket.BinaryMessage
+	Data       []byte
+	FromClient bool
+	Seq        int // counted from 1 in each direction
+}
+
+// WsFrameHandler sees every WebSocket frame in both directions. The calls
+// for one connection never overlap, so a handler may use ctx.Scratch freely.
+// Returning false drops the frame.
+type WsFrameHandler interface {
+	HandleWsFrame(ctx *Context, req *http.Request, frame *WsFrame) bool
+}
+
+type RequestHandlerFunc func(ctx *Context, req *http.Request) (*http.Request, *http.Response)
+
+func (f RequestHandlerFunc) HandleRequest(ctx *Context, req *http.Request) (*http.Request, *http.Response) {
+	return f(ctx, req)
+}
+
+type ResponseHandlerFunc func(ctx *Context, req *http.Request, resp *http.Response) *http.Response
+
+func (f ResponseHandlerFunc) HandleResponse(ctx *Context, req *http.Request, resp *http.Response) *http.Response {
+	return f(ctx, req, resp)
+}
+
+type WsFrameHandlerFunc func(ctx *Context, req *http.Request, frame *WsFrame) bool
+
+func (f WsFrameHandlerFunc) HandleWsFrame(ctx *Context, req *http.Request, frame *WsFrame) bool {
+	return f(ctx, req, frame)
+}
+
+// Use registers handlers in order. A handler implementing several of the
+// handler interfaces is registered for each of them.
+func (p *Proxy) Use(handlers ...interface{}) {
+	for _, h := range handlers {
+		used := false
+		if rh, ok := h.(RequestHandler); ok {
+			p.requestHandlers = append(p.requestHandlers, rh)
+			used = true
+		}
+		if rh, ok := h.(ResponseHandler); ok {
+			p.responseHandlers = append(p.responseHandlers, rh)
+			used = true
+		}
+		if wh, ok := h.(WsFrameHandler); ok {
+			p.wsFrameHandlers = append(p.wsFrameHandlers, wh)
+			used = true
+		}
+		if !used {
+			panic("cproxy: Use of a value that is not a handler")
+		}
+	}
+}
+
+// runRequestHandlers runs the request handlers in order. A handler that
+// returns no request leaves the one it got.
+func (p *Proxy) runRequestHandlers(ctx *Context, req *http.Request) (*http.Request, *http.Response) {
+	for _, h := range p.requestHandlers {
+		next, resp := h.HandleRequest(ctx, req)
+		if next != nil {
+			req = next
+		}
+		if resp != nil {
+			if resp.Body == nil {
+				resp.Body = http.NoBody
+			}
+			return req, resp
+		}
+	}
+	return req, nil
+}
+
+// runResponseHandlers runs the response handlers in order. A handler that
+// returns no response leaves the one it got.
+func (p *Proxy) runResponseHandlers(ctx *Context, req *http.Request, resp *http.Response) *http.Response {
+	for _, h := range p.responseHandlers {
+		if next := h.HandleResponse(ctx, req, resp); next != nil {
+			if next != resp && next.Body != resp.Body {
+				resp.Body.Close()
+			}
+			resp = next
+		}
+		if resp.Body == nil {
+			resp.Body = http.NoBody
+		}
+	}
+	return resp
+}
+
+func (p *Proxy) runWsFrameHandlers(ctx *Context, req *http.Request, frame *WsFrame) bool {
+	ctx.wsLock.Lock()
+	defer ctx.wsLock.Unlock()
+	for _, h := range p.wsFrameHandlers {
+		if !h.HandleWsFrame(ctx, req, frame) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+package cproxy
+
+import (
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// proxyGet sends a GET of rawurl through a proxy using handlers.
+func proxyGet(t *testing.T, rawurl string, handlers ...interface{}) (*http.Response, string) {
+	t.Helper()
+	p := NewProxy("", "", "", "", "")
+	p.Use(handlers...)
+	proxy := httptest.NewServer(p.proxyHander)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestHandlers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen", r.Header.Get("X-Added"))
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	for _, test := range []struct {
+		name     string
+		handlers []interface{}
+		status   int
+		body     string
+		seen     string
+	}{
+		{"none", nil, 200, "upstream", ""},
+		{"request changed", []interface{}{RequestHandlerFunc(func(ctx *Context, req *http.Request) (*http.Request, *http.Response) {
+			req.Header.Set("X-Added", "1")
+			return req, nil
+		})}, 200, "upstream", "1"},
+		{"nil request kept", []interface{}{RequestHandlerFunc(func(ctx *Context, req *http.Request) (*http.Request, *http.Response) {
+			req.Header.Set("X-Added", "2")
+			return nil, nil
+		})}, 200, "upstream", "2"},
+		{"answered without body", []interface{}{RequestHandlerFunc(func(ctx *Context, req *http.Request) (*http.Request, *http.Response) {
+			return req, &http.Response{StatusCode: http.StatusNoContent, Header: http.Header{}, Request: req}
+		})}, 204, "", ""},
+		{"nil response kept", []interface{}{ResponseHandlerFunc(func(ctx *Context, req *http.Request, resp *http.Response) *http.Response {
+			return nil
+		})}, 200, "upstream", ""},
+		{"response without body", []interface{}{ResponseHandlerFunc(func(ctx *Context, req *http.Request, resp *http.Response) *http.Response {
+			return &http.Response{StatusCode: http.StatusAccepted, Header: http.Header{}, Request: req}
+		})}, 202, "", ""},
+	} {
+		resp, body := proxyGet(t, upstream.URL, test.handlers...)
+		if resp.StatusCode != test.status || body != test.body || resp.Header.Get("X-Seen") != test.seen {
+			t.Errorf("%s: got %d %q seen %q, want %d %q seen %q", test.name,
+				resp.StatusCode, body, resp.Header.Get("X-Seen"), test.status, test.body, test.seen)
+		}
+	}
+}
+
+type closeTracker struct {
+	io.ReadCloser
+	closed int32
+}
+
+func (c *closeTracker) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.ReadCloser.Close()
+}
+
+func TestReplacedResponseClosed(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	tracker := &closeTracker{}
+	resp, body := proxyGet(t, upstream.URL,
+		ResponseHandlerFunc(func(ctx *Context, req *http.Request, resp *http.Response) *http.Response {
+			tracker.ReadCloser = resp.Body
+			resp.Body = tracker
+			return resp
+		}),
+		ResponseHandlerFunc(func(ctx *Context, req *http.Request, resp *http.Response) *http.Response {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("local")), Request: req}
+		}))
+	if closed := atomic.LoadInt32(&tracker.closed) == 1; resp.StatusCode != 200 || body != "local" || !closed {
+		t.Errorf("got %d %q, upstream body closed %v", resp.StatusCode, body, closed)
+	}
+}
+
+func TestWsFrameHandlers(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := defaultUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- NewConn(c)
+	}))
+	defer server.Close()
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := <-conns
+	defer conn.Close()
+
+	const frames = 50
+	seqs := map[bool]int{}
+	p := NewProxy("", "", "", "", "")
+	p.Use(WsFrameHandlerFunc(func(ctx *Context, req *http.Request, frame *WsFrame) bool {
+		n, _ := ctx.Scratch["frames"].(int)
+		ctx.Scratch["frames"] = n + 1
+		seqs[frame.FromClient] = frame.Seq
+		if !frame.FromClient {
+			frame.Data = append([]byte("s:"), frame.Data...)
+		}
+		return true
+	}))
+	ctx := newContext(p, "", "ws", "ws.test")
+	req := httptest.NewRequest("GET", "http://ws.test/socket", nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < frames; i++ {
+			p.BeforeWsRequest(ctx, req, websocket.TextMessage, []byte("c"))
+		}
+	}()
+	for i := 0; i < frames; i++ {
+		if !p.BeforeWsResponse(ctx, conn, req, websocket.BinaryMessage, []byte{0, 1}) {
+			t.Fatal("changed frame not written")
+		}
+		messageType, message, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.BinaryMessage || string(message) != "s:\x00\x01" {
+			t.Fatalf("got type %d %q, want binary s:\\x00\\x01", messageType, message)
+		}
+	}
+	<-done
+	if ctx.Scratch["frames"] != 2*frames || seqs[true] != frames || seqs[false] != frames {
+		t.Errorf("got %v frames, seqs %v, want %d in each direction", ctx.Scratch["frames"], seqs, frames)
+	}
+}
@@ -0,0 +1,124 @@
+package cproxy
+
+import (
+	"sync"
+)
+
+// RECENT_FLOWS is how many flows the buffer of the admin API keeps.
+var RECENT_FLOWS = 1000
+
+// SUBSCRIBER_QUEUE is how many flows a subscriber may fall behind before it
+// is cut off.
+var SUBSCRIBER_QUEUE = 256
+
+// RecentFlow is a flow in a FlowBuffer. Seq numbers the flows in the order
+// they were added, from 1.
+type RecentFlow struct {
+	Seq  uint64
+	Flow *Flow
+}
+
+// FlowBuffer keeps the latest flows in memory, the oldest dropped once it
+// is full, and hands new flows to its subscribers. It is a Sink, so it can
+// be added to the capture as well.
+type FlowBuffer struct {
+	flows []RecentFlow
+	next  int // where the next flow goes once flows is full
+	seq   uint64
+	subs  map[chan RecentFlow]bool
+	lock  sync.RWMutex
+}
+
+func NewFlowBuffer(size int) *FlowBuffer {
+	if size <= 0 {
+		size = RECENT_FLOWS
+	}
+	return &FlowBuffer{flows: make([]RecentFlow, 0, size)}
+}
+
+func (b *FlowBuffer) WriteFlow(f *Flow) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.seq++
+	rf := RecentFlow{Seq: b.seq, Flow: f}
+	if len(b.flows) < cap(b.flows) {
+		b.flows = append(b.flows, rf)
+	} else {
+		b.flows[b.next] = rf
+		b.next = (b.next + 1) % len(b.flows)
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- rf:
+		default:
+			// too slow; it can come back for what it missed with Subscribe
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// Subscribe returns the kept flows added after the flow numbered after, and
+// a channel of the flows added from now on. The channel is closed when the
+// subscriber falls SUBSCRIBER_QUEUE flows behind, or by cancel.
+func (b *FlowBuffer) Subscribe(after uint64) (backlog []RecentFlow, flows <-chan RecentFlow, cancel func()) {
+	ch := make(chan RecentFlow, SUBSCRIBER_QUEUE)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if after > 0 {
+		backlog = b.after(after, 0)
+	}
+	if b.subs == nil {
+		b.subs = make(map[chan RecentFlow]bool)
+	}
+	b.subs[ch] = true
+	return backlog, ch, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.subs[ch] {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *FlowBuffer) Close() error {
+	return nil
+}
+
+// Flows returns up to n flows added after the flow numbered after, oldest
+// first; the latest n when after is 0, all of them when n is 0.
+func (b *FlowBuffer) Flows(after uint64, n int) []RecentFlow {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.after(after, n)
+}
+
+func (b *FlowBuffer) after(after uint64, n int) []RecentFlow {
+	flows := make([]RecentFlow, 0, len(b.flows))
+	for i := range b.flows {
+		if rf := b.flows[(b.next+i)%len(b.flows)]; rf.Seq > after {
+			flows = append(flows, rf)
+		}
+	}
+	if n > 0 && len(flows) > n {
+		if after == 0 {
+			return flows[len(flows)-n:]
+		}
+		return flows[:n]
+	}
+	return flows
+}
+
+// Find returns the kept flows with the flow id: an exchange, or the frames
+// of a WebSocket connection.
+func (b *FlowBuffer) Find(id string) []RecentFlow {
+	var found []RecentFlow
+	for _, rf := range b.Flows(0, 0) {
+		if rf.Flow.Context != nil && rf.Flow.Context.ID == id {
+			found = append(found, rf)
+		}
+	}
+	return found
+}
@@ -0,0 +1,310 @@
+package cproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Capture schema versions. Version 1 is the Message of the redis queue,
+// version 2 the Record.
+const (
+	CAPTURE_SCHEMA_1      = 1
+	CAPTURE_SCHEMA_2      = 2
+	CAPTURE_SCHEMA_LATEST = CAPTURE_SCHEMA_2
+)
+
+// Record is the capture record of the JSON sinks (redis, file, webhook).
+// Headers keep every value, names sorted and values in received order.
+// Bodies are base64 in JSON; a compressed body is recorded decompressed,
+// with decoded set to the Content-Encoding that was removed. A WebSocket
+// frame from the server is a record of kind ws with the handshake request,
+// no response and the frame.
+type Record struct {
+	Schema     int             `json:"schema"`
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	Time       time.Time       `json:"time"`
+	ClientAddr string          `json:"client"`
+	Request    RecordRequest   `json:"request"`
+	Response   *RecordResponse `json:"response,omitempty"`
+	Frame      *RecordFrame    `json:"frame,omitempty"`
+	Timings    Timings         `json:"timings"`
+}
+
+type RecordRequest struct {
+	Method  string        `json:"method"`
+	Url     string        `json:"url"`
+	Proto   string        `json:"proto"`
+	Headers []HeaderField `json:"headers"`
+	Body    []byte        `json:"body,omitempty"`
+	Decoded string        `json:"decoded,omitempty"`
+}
+
+type RecordResponse struct {
+	Status  int           `json:"status"`
+	Proto   string        `json:"proto"`
+	Headers []HeaderField `json:"headers"`
+	Body    []byte        `json:"body,omitempty"`
+	Decoded string        `json:"decoded,omitempty"`
+}
+
+type RecordFrame struct {
+	Seq  int    `json:"seq"`
+	Data []byte `json:"data"`
+}
+
+type HeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Timings are the phases of an exchange in milliseconds, -1 for a phase that
+// did not happen, e.g. no DNS, connect and TLS on a reused connection.
+//
+//	dns, connect, tls  resolving, dialing and the TLS handshake upstream
+//	send               writing the request
+//	wait               request written to the first response byte
+//	ttfb               start of the flow to the first response byte
+//	receive            reading the response body
+//	total              start of the flow to the end of the response body
+type Timings struct {
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	TLS     float64 `json:"tls"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	TTFB    float64 `json:"ttfb"`
+	Receive float64 `json:"receive"`
+	Total   float64 `json:"total"`
+}
+
+var noTimings = Timings{-1, -1, -1, -1, -1, -1, -1, -1}
+
+// flowTrace collects the httptrace events of one upstream request.
+type flowTrace struct {
+	lock                 sync.Mutex
+	start                time.Time
+	dnsStart, dnsDone    time.Time
+	connStart, connDone  time.Time
+	tlsStart, tlsDone    time.Time
+	wroteStart, wroteEnd time.Time
+	firstByte            time.Time
+}
+
+func (t *flowTrace) mark(at *time.Time) {
+	t.lock.Lock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+	t.lock.Unlock()
+}
+
+func (t *flowTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.mark(&t.dnsDone) },
+		ConnectStart:         func(string, string) { t.mark(&t.connStart) },
+		ConnectDone:          func(string, string, error) { t.mark(&t.connDone) },
+		TLSHandshakeStart:    func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.mark(&t.tlsDone) },
+		GotConn:              func(httptrace.GotConnInfo) { t.mark(&t.wroteStart) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteEnd) },
+		GotFirstResponseByte: func() { t.mark(&t.firstByte) },
+	}
+}
+
+// traceRequest returns req reporting its phases to ctx.
+func traceRequest(ctx *Context, req *http.Request) *http.Request {
+	ctx.trace = &flowTrace{start: ctx.Start}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), ctx.trace.clientTrace()))
+}
+
+// timings returns the phases of the flow, the response body read by end.
+func (c *Context) timings(end time.Time) Timings {
+	tm := noTimings
+	tm.Total = millis(end.Sub(c.Start))
+	t := c.trace
+	if t == nil {
+		return tm
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	span := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() {
+			return -1
+		}
+		return millis(to.Sub(from))
+	}
+	tm.DNS = span(t.dnsStart, t.dnsDone)
+	tm.Connect = span(t.connStart, t.connDone)
+	tm.TLS = span(t.tlsStart, t.tlsDone)
+	tm.Send = span(t.wroteStart, t.wroteEnd)
+	tm.Wait = span(t.wroteEnd, t.firstByte)
+	tm.TTFB = span(t.start, t.firstByte)
+	tm.Receive = span(t.firstByte, end)
+	return tm
+}
+
+func newFlowID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func headerFields(h http.Header) []HeaderField {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fields := []HeaderField{}
+	for _, k := range names {
+		for _, v := range h[k] {
+			fields = append(fields, HeaderField{k, v})
+		}
+	}
+	return fields
+}
+
+// fieldsHeader returns the fields as an http.Header.
+func fieldsHeader(fields []HeaderField) http.Header {
+	h := make(http.Header, len(fields))
+	for _, f := range fields {
+		h[f.Name] = append(h[f.Name], f.Value)
+	}
+	return h
+}
+
+// Record returns the flow in the latest capture schema.
+func (f *Flow) Record() *Record {
+	req := f.Request
+	u := *req.URL
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if f.Context != nil && f.Context.Scheme != "" {
+			u.Scheme = f.Context.Scheme
+		}
+	}
+	r := &Record{
+		Schema: CAPTURE_SCHEMA_2,
+		Kind:   FLOW_WS,
+		Time:   time.Now(),
+		Request: RecordRequest{
+			Method:  valueOrDefault(req.Method, "GET"),
+			Url:     u.String(),
+			Proto:   valueOrDefault(req.Proto, "HTTP/1.1"),
+			Headers: headerFields(req.Header),
+		},
+		Timings: f.Timings,
+	}
+	if f.Context != nil {
+		r.ID, r.Time, r.ClientAddr = f.Context.ID, f.Context.Start, f.Context.ClientAddr
+	}
+	if f.Response == nil {
+		r.Frame = &RecordFrame{Seq: f.Seq, Data: f.ResponseBody}
+		return r
+	}
+	r.Kind = FLOW_HTTP
+	r.Request.Body, r.Request.Decoded = f.RequestBody, f.RequestDecoded
+	r.Response = &RecordResponse{
+		Status:  f.Response.StatusCode,
+		Proto:   valueOrDefault(f.Response.Proto, "HTTP/1.1"),
+		Headers: headerFields(f.Response.Header),
+		Body:    f.ResponseBody,
+		Decoded: f.ResponseDecoded,
+	}
+	return r
+}
+
+// Flow returns the record as a Flow, for the HAR and store conversions.
+func (r *Record) Flow() (*Flow, error) {
+	req, err := http.NewRequest(r.Request.Method, r.Request.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Proto = r.Request.Proto
+	req.Header = fieldsHeader(r.Request.Headers)
+	f := &Flow{
+		Context:        &Context{ID: r.ID, ClientAddr: r.ClientAddr, Scheme: req.URL.Scheme, Host: req.Host, Start: r.Time},
+		Request:        req,
+		RequestBody:    r.Request.Body,
+		RequestDecoded: r.Request.Decoded,
+		Timings:        r.Timings,
+	}
+	if r.Response != nil {
+		f.Response = &http.Response{StatusCode: r.Response.Status, Proto: r.Response.Proto, Header: fieldsHeader(r.Response.Headers)}
+		f.ResponseBody, f.ResponseDecoded = r.Response.Body, r.Response.Decoded
+	} else if r.Frame != nil {
+		f.Seq, f.ResponseBody = r.Frame.Seq, r.Frame.Data
+	}
+	return f, nil
+}
+
+// EncodeFlow returns the JSON record of the flow in the given schema.
+func EncodeFlow(f *Flow, schema int) ([]byte, error) {
+	if schema == CAPTURE_SCHEMA_1 {
+		return json.Marshal(f.Message())
+	}
+	return json.Marshal(f.Record())
+}
+
+// DecodeRecord reads a JSON record of any schema version.
+func DecodeRecord(b []byte) (*Flow, error) {
+	var probe struct {
+		Schema int `json:"schema"`
+	}
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return nil, err
+	}
+	switch probe.Schema {
+	case 0:
+		var m Message
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		return m.Flow()
+	case CAPTURE_SCHEMA_2:
+		var r Record
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, err
+		}
+		return r.Flow()
+	}
+	return nil, fmt.Errorf("unknown capture schema %d", probe.Schema)
+}
+
+// ReadRecords reads JSON capture records of any schema, one per line as in a
+// JSONL capture. Empty lines are skipped.
+func ReadRecords(r io.Reader) ([]*Flow, error) {
+	var flows []*Flow
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		f, err := DecodeRecord(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		flows = append(flows, f)
+	}
+	return flows, scanner.Err()
+}
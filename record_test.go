@@ -0,0 +1,65 @@
+package cproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://api.test/v1/users?a=1", nil)
+	req.Header.Add("X-A", "1")
+	req.Header.Add("X-A", "2")
+	resp := &http.Response{StatusCode: 201, Proto: "HTTP/1.1", Header: http.Header{"Set-Cookie": {"a=1", "b=2"}}}
+	ctx := &Context{ID: "f1", ClientAddr: "127.0.0.1:1", Scheme: "http", Start: time.Unix(1700000000, 0).UTC()}
+	flow := &Flow{Context: ctx, Request: req, Response: resp, RequestBody: []byte("name=u"), ResponseBody: []byte{0, 1, 2},
+		Timings: Timings{-1, -1, -1, 1, 2, 3, 4, 5}}
+
+	b, err := EncodeFlow(flow, CAPTURE_SCHEMA_LATEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte(`{"schema":2,"id":"f1","kind":"http"`)) {
+		t.Errorf("record %s", b)
+	}
+	got, err := DecodeRecord(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Request.URL.String() != "http://api.test/v1/users?a=1" || strings.Join(got.Request.Header["X-A"], ",") != "1,2" ||
+		string(got.RequestBody) != "name=u" || got.Response.StatusCode != 201 ||
+		strings.Join(got.Response.Header["Set-Cookie"], ",") != "a=1,b=2" || !bytes.Equal(got.ResponseBody, []byte{0, 1, 2}) ||
+		got.Timings != flow.Timings || got.Context.ID != "f1" || !got.Context.Start.Equal(ctx.Start) {
+		t.Errorf("decoded %+v", got)
+	}
+
+	// a WebSocket frame keeps its sequence number
+	frame := &Flow{Context: ctx, Request: req, ResponseBody: []byte("hi"), Seq: 3, Timings: noTimings}
+	b, _ = EncodeFlow(frame, CAPTURE_SCHEMA_2)
+	if got, err := DecodeRecord(b); err != nil || got.Response != nil || got.Seq != 3 || string(got.ResponseBody) != "hi" {
+		t.Errorf("frame %s: %+v %v", b, got, err)
+	}
+}
+
+func TestRecordSchema1(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://api.test/a", nil)
+	flow := &Flow{Request: req, Response: &http.Response{StatusCode: 200, Header: http.Header{}}, ResponseBody: []byte("ok")}
+	b, err := EncodeFlow(flow, CAPTURE_SCHEMA_1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Message
+	if err := json.Unmarshal(b, &m); err != nil || m.Url != "/a" || m.RespContent != "b2s=" || m.Status != 200 {
+		t.Errorf("message %s: %+v %v", b, m, err)
+	}
+	if got, err := DecodeRecord(b); err != nil || string(got.ResponseBody) != "ok" || got.Response.StatusCode != 200 {
+		t.Errorf("decoded %+v %v", got, err)
+	}
+	if _, err := DecodeRecord([]byte(`{"schema":9}`)); err == nil {
+		t.Error("unknown schema decoded")
+	}
+}
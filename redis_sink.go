@@ -0,0 +1,359 @@
+package cproxy
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	REDIS_LIST    = "list"    // LPUSH onto a list
+	REDIS_STREAM  = "stream"  // XADD to a stream, the record in field "message"
+	REDIS_PUBLISH = "publish" // PUBLISH to a channel
+)
+
+// REDIS_QUEUE is the default key to-redis writes to.
+var REDIS_QUEUE = "http-message-queue"
+
+// RedisTarget says where and how to-redis writes a flow.
+type RedisTarget struct {
+	Mode   string
+	Key    string
+	MaxLen int64         // trim a list or stream to about this many records, 0 keeps all
+	TTL    time.Duration // expire the key this long after the last write, 0 never
+}
+
+var DefaultRedisTarget = RedisTarget{Mode: REDIS_LIST, Key: REDIS_QUEUE}
+
+func (t RedisTarget) Validate() error {
+	switch t.Mode {
+	case REDIS_LIST, REDIS_STREAM:
+	case REDIS_PUBLISH:
+		if t.MaxLen > 0 || t.TTL > 0 {
+			return fmt.Errorf("maxlen and ttl do not apply to publish")
+		}
+	default:
+		return fmt.Errorf("unknown redis mode %q, want list, stream or publish", t.Mode)
+	}
+	if t.Key == "" {
+		return fmt.Errorf("redis key is empty")
+	}
+	if t.MaxLen < 0 {
+		return fmt.Errorf("maxlen must not be negative")
+	}
+	return nil
+}
+
+// redisTarget returns the target of a to-redis action: def with the mode,
+// key, maxlen and ttl of the action on top. A publish action does not take
+// maxlen and ttl from a list or stream default.
+func (a *Action) redisTarget(def RedisTarget) (RedisTarget, error) {
+	t := def
+	if a.Mode != "" {
+		t.Mode = a.Mode
+	}
+	if a.Key != "" {
+		t.Key = a.Key
+	}
+	if a.MaxLen != 0 {
+		t.MaxLen = int64(a.MaxLen)
+	}
+	if a.TTL != "" {
+		d, err := time.ParseDuration(a.TTL)
+		if err != nil {
+			return t, fmt.Errorf("ttl: %v", err)
+		}
+		t.TTL = d
+	}
+	if t.Mode == REDIS_PUBLISH && t.Mode != def.Mode {
+		// a channel keeps nothing, the defaults are for the list or stream
+		if a.MaxLen == 0 {
+			t.MaxLen = 0
+		}
+		if a.TTL == "" {
+			t.TTL = 0
+		}
+	}
+	return t, t.Validate()
+}
+
+// RedisSink writes flows as JSON records to a redis list, stream or channel.
+// Writing only queues the record; a full queue drops it.
+type RedisSink struct {
+	Writer *RedisWriter
+	RedisTarget
+	Schema int // capture schema, 0 for the latest, 1 for consumers of the old format
+}
+
+func (s *RedisSink) WriteFlow(f *Flow) error {
+	msg, err := EncodeFlow(f, s.Schema)
+	if err != nil {
+		return err
+	}
+	s.Writer.Push(s.RedisTarget, msg)
+	return nil
+}
+
+// Close leaves the writer open, it is shared by all targets.
+func (s *RedisSink) Close() error {
+	return nil
+}
+
+var (
+	REDIS_QUEUE_SIZE = 10000
+	REDIS_WORKERS    = 4
+	REDIS_BATCH      = 100
+	REDIS_RETRY_MAX  = 5 * time.Second
+	REDIS_REPORT     = 10 * time.Second
+)
+
+type redisRecord struct {
+	target RedisTarget
+	msg    []byte
+}
+
+// RedisWriter delivers records to redis off the request path: a bounded
+// queue, drained by workers that send up to REDIS_BATCH records at a time in
+// one pipeline. While redis is unreachable a worker retries its batch with
+// backoff, and new records are dropped once the queue is full.
+type RedisWriter struct {
+	Pool *redis.Pool
+
+	queue chan redisRecord
+	done  chan struct{}
+	wg    sync.WaitGroup
+	once  sync.Once
+
+	written, dropped, failed, retries uint64
+}
+
+func NewRedisWriter(pool *redis.Pool) *RedisWriter {
+	w := &RedisWriter{
+		Pool:  pool,
+		queue: make(chan redisRecord, REDIS_QUEUE_SIZE),
+		done:  make(chan struct{}),
+	}
+	for i := 0; i < REDIS_WORKERS; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+	go w.report()
+	return w
+}
+
+// Push queues a record without ever blocking.
+func (w *RedisWriter) Push(t RedisTarget, msg []byte) {
+	select {
+	case <-w.done:
+		atomic.AddUint64(&w.dropped, 1)
+		return
+	default:
+	}
+	select {
+	case w.queue <- redisRecord{t, msg}:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+func (w *RedisWriter) Stats() DeliveryStats {
+	return DeliveryStats{
+		Queued:  len(w.queue),
+		Written: atomic.LoadUint64(&w.written),
+		Dropped: atomic.LoadUint64(&w.dropped),
+		Failed:  atomic.LoadUint64(&w.failed),
+		Retries: atomic.LoadUint64(&w.retries),
+	}
+}
+
+// Close stops taking records and gives the workers SINK_DRAIN_TIMEOUT to
+// deliver what is queued. Records left after that count as dropped.
+func (w *RedisWriter) Close() error {
+	w.once.Do(func() { close(w.done) })
+	finished := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(SINK_DRAIN_TIMEOUT):
+	}
+	return nil
+}
+
+func (w *RedisWriter) work() {
+	defer w.wg.Done()
+	batch := make([]redisRecord, 0, REDIS_BATCH)
+	for {
+		batch = batch[:0]
+		select {
+		case r := <-w.queue:
+			batch = append(batch, r)
+		case <-w.done:
+			// drain what is left, then stop
+			select {
+			case r := <-w.queue:
+				batch = append(batch, r)
+			default:
+				return
+			}
+		}
+	fill:
+		for len(batch) < REDIS_BATCH {
+			select {
+			case r := <-w.queue:
+				batch = append(batch, r)
+			default:
+				break fill
+			}
+		}
+		w.deliver(batch)
+	}
+}
+
+// deliver sends a batch until redis takes it. Connection errors are retried
+// with backoff until the writer closes; errors of single commands are not.
+func (w *RedisWriter) deliver(batch []redisRecord) {
+	backoff := 100 * time.Millisecond
+	for {
+		failed, err := w.send(batch)
+		if err == nil {
+			atomic.AddUint64(&w.written, uint64(len(batch)-failed))
+			atomic.AddUint64(&w.failed, uint64(failed))
+			return
+		}
+		select {
+		case <-w.done:
+			captureLog.Error("redis write failed, dropping records", "records", len(batch), "err", err)
+			atomic.AddUint64(&w.dropped, uint64(len(batch)))
+			return
+		default:
+		}
+		captureLog.Warn("redis write failed, retrying", "records", len(batch), "backoff", backoff, "err", err)
+		atomic.AddUint64(&w.retries, 1)
+		select {
+		case <-time.After(backoff):
+		case <-w.done:
+		}
+		if backoff *= 2; backoff > REDIS_RETRY_MAX {
+			backoff = REDIS_RETRY_MAX
+		}
+	}
+}
+
+// send pipelines the batch on one connection. Records for the same list go
+// out as a single LPUSH. It returns how many records redis refused.
+func (w *RedisWriter) send(batch []redisRecord) (failed int, err error) {
+	c := w.Pool.Get()
+	defer c.Close()
+	var counts []int // records per command that stores records, 0 for trim/expire
+	for i := 0; i < len(batch); {
+		t := batch[i].target
+		switch t.Mode {
+		case REDIS_STREAM:
+			args := redis.Args{t.Key}
+			if t.MaxLen > 0 {
+				args = args.Add("MAXLEN", "~", t.MaxLen)
+			}
+			c.Send("XADD", args.Add("*", "message", batch[i].msg)...)
+			counts = append(counts, 1)
+			i++
+		case REDIS_PUBLISH:
+			c.Send("PUBLISH", t.Key, batch[i].msg)
+			counts = append(counts, 1)
+			i++
+		default:
+			args := redis.Args{t.Key}
+			for ; i < len(batch) && batch[i].target == t; i++ {
+				args = args.Add(batch[i].msg)
+			}
+			c.Send("LPUSH", args...)
+			counts = append(counts, len(args)-1)
+			if t.MaxLen > 0 {
+				c.Send("LTRIM", t.Key, 0, t.MaxLen-1)
+				counts = append(counts, 0)
+			}
+		}
+		if t.TTL > 0 && t.Mode != REDIS_PUBLISH {
+			c.Send("PEXPIRE", t.Key, int64(t.TTL/time.Millisecond))
+			counts = append(counts, 0)
+		}
+	}
+	replies, err := redis.Values(c.Do(""))
+	if err != nil {
+		return 0, err
+	}
+	for i, reply := range replies {
+		if e, ok := reply.(redis.Error); ok {
+			if i < len(counts) {
+				failed += counts[i]
+			}
+			captureLog.Error("redis refused a record", "err", e)
+		}
+	}
+	return failed, nil
+}
+
+// report logs when records were dropped or refused since the last report.
+func (w *RedisWriter) report() {
+	ticker := time.NewTicker(REDIS_REPORT)
+	defer ticker.Stop()
+	var last DeliveryStats
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+		st := w.Stats()
+		if st.Dropped != last.Dropped || st.Failed != last.Failed {
+			captureLog.Warn("redis records lost", "dropped", st.Dropped-last.Dropped, "failed", st.Failed-last.Failed,
+				"queued", st.Queued, "written", st.Written)
+		}
+		last = st
+	}
+}
+
+// DialRedis connects to host:port, or to a redis:// or rediss:// URI with
+// password and database, e.g. redis://:secret@localhost:6379/2. A user name
+// in the URI logs in as that ACL user.
+func DialRedis(uri string) (redis.Conn, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(5 * time.Second),
+		redis.DialReadTimeout(10 * time.Second),
+		redis.DialWriteTimeout(10 * time.Second),
+	}
+	if !strings.Contains(uri, "://") {
+		return redis.Dial("tcp", uri, options...)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	user := u.User.Username()
+	password, ok := u.User.Password()
+	if user == "" || !ok {
+		return redis.DialURL(uri, options...)
+	}
+	// redigo only sends AUTH password, and selects the database before
+	// any AUTH of ours, so both are done here
+	db := strings.Trim(u.Path, "/")
+	u.User, u.Path = nil, ""
+	c, err := redis.DialURL(u.String(), options...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.Do("AUTH", user, password); err == nil && db != "" {
+		_, err = c.Do("SELECT", db)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,281 @@
+package cproxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers pipelines without a server and records them, one string
+// per pipeline. Records show as {json}; the key "wrong" gets WRONGTYPE.
+type fakeRedis struct {
+	dialErrs int           // dials to refuse before accepting
+	gate     chan struct{} // when set, each pipeline waits for a value
+	flushing chan struct{} // when set, told about each pipeline before the gate
+
+	pipelines []string
+	records   []string // the JSON records sent, in order
+	dials     int
+	lock      sync.Mutex
+}
+
+func (f *fakeRedis) pool() *redis.Pool {
+	return &redis.Pool{Dial: func() (redis.Conn, error) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.dials++; f.dials <= f.dialErrs {
+			return nil, errors.New("connection refused")
+		}
+		return &fakeConn{f: f}, nil
+	}}
+}
+
+func (f *fakeRedis) log() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.pipelines...)
+}
+
+type fakeConn struct {
+	f       *fakeRedis
+	pending []string
+	replies []interface{}
+}
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	var b strings.Builder
+	b.WriteString(cmd)
+	var reply interface{} = "OK"
+	for _, arg := range args {
+		if p, ok := arg.([]byte); ok && len(p) > 0 && p[0] == '{' {
+			c.f.lock.Lock()
+			c.f.records = append(c.f.records, string(p))
+			c.f.lock.Unlock()
+			arg = "{json}"
+		}
+		if arg == "wrong" {
+			reply = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		fmt.Fprintf(&b, " %v", arg)
+	}
+	c.pending = append(c.pending, b.String())
+	c.replies = append(c.replies, reply)
+	return nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		c.Send(cmd, args...)
+	}
+	if len(c.pending) == 0 {
+		return nil, nil
+	}
+	if c.f.flushing != nil {
+		c.f.flushing <- struct{}{}
+	}
+	if c.f.gate != nil {
+		<-c.f.gate
+	}
+	c.f.lock.Lock()
+	c.f.pipelines = append(c.f.pipelines, strings.Join(c.pending, ", "))
+	c.f.lock.Unlock()
+	replies := c.replies
+	c.pending, c.replies = nil, nil
+	if cmd != "" {
+		return replies[0], nil
+	}
+	return replies, nil
+}
+
+func (c *fakeConn) Flush() error                  { return nil }
+func (c *fakeConn) Receive() (interface{}, error) { return nil, errors.New("not pipelined") }
+func (c *fakeConn) Err() error                    { return nil }
+func (c *fakeConn) Close() error                  { return nil }
+
+func TestRedisSinkModes(t *testing.T) {
+	flow := &Flow{Request: httptest.NewRequest("GET", "http://api.test/", nil)}
+	for _, test := range []struct {
+		target RedisTarget
+		want   string
+	}{
+		{DefaultRedisTarget, "LPUSH http-message-queue {json}"},
+		{RedisTarget{Mode: REDIS_LIST, Key: "q", MaxLen: 100, TTL: time.Minute},
+			"LPUSH q {json}, LTRIM q 0 99, PEXPIRE q 60000"},
+		{RedisTarget{Mode: REDIS_STREAM, Key: "s", MaxLen: 10}, "XADD s MAXLEN ~ 10 * message {json}"},
+		{RedisTarget{Mode: REDIS_STREAM, Key: "s", TTL: time.Second}, "XADD s * message {json}, PEXPIRE s 1000"},
+		{RedisTarget{Mode: REDIS_PUBLISH, Key: "c"}, "PUBLISH c {json}"},
+	} {
+		f := &fakeRedis{}
+		w := NewRedisWriter(f.pool())
+		s := &RedisSink{Writer: w, RedisTarget: test.target}
+		if err := s.WriteFlow(flow); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		if got := strings.Join(f.log(), " | "); got != test.want {
+			t.Errorf("%+v: sent %q, want %q", test.target, got, test.want)
+		}
+	}
+}
+
+func TestRedisSinkSchema(t *testing.T) {
+	flow := &Flow{Request: httptest.NewRequest("GET", "http://api.test/", nil)}
+	for _, test := range []struct {
+		schema int
+		want   string // a prefix of the record
+	}{
+		{0, `{"schema":2,`},
+		{CAPTURE_SCHEMA_2, `{"schema":2,`},
+		{CAPTURE_SCHEMA_1, `{"url":"/","method":"GET",`},
+	} {
+		f := &fakeRedis{}
+		w := NewRedisWriter(f.pool())
+		s := &RedisSink{Writer: w, RedisTarget: DefaultRedisTarget, Schema: test.schema}
+		if err := s.WriteFlow(flow); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		if len(f.records) != 1 || !strings.HasPrefix(f.records[0], test.want) {
+			t.Errorf("schema %d: sent %q, want %s...", test.schema, f.records, test.want)
+		}
+	}
+}
+
+func TestRedisTargetOfAction(t *testing.T) {
+	def := RedisTarget{Mode: REDIS_LIST, Key: "q", MaxLen: 1000, TTL: time.Hour}
+	for _, test := range []struct {
+		action Action
+		want   RedisTarget
+	}{
+		{Action{}, def},
+		{Action{Key: "other", TTL: "10s"}, RedisTarget{Mode: REDIS_LIST, Key: "other", MaxLen: 1000, TTL: 10 * time.Second}},
+		{Action{Mode: REDIS_STREAM, MaxLen: 5}, RedisTarget{Mode: REDIS_STREAM, Key: "q", MaxLen: 5, TTL: time.Hour}},
+		// a channel does not take the trimming of the default list
+		{Action{Mode: REDIS_PUBLISH, Key: "c"}, RedisTarget{Mode: REDIS_PUBLISH, Key: "c"}},
+	} {
+		got, err := test.action.redisTarget(def)
+		if err != nil || got != test.want {
+			t.Errorf("%+v: got %+v %v, want %+v", test.action, got, err, test.want)
+		}
+	}
+	for _, a := range []Action{
+		{Mode: "queue"},
+		{TTL: "forever"},
+		{MaxLen: -1},
+		{Mode: REDIS_PUBLISH, MaxLen: 5},
+	} {
+		if _, err := a.redisTarget(DefaultRedisTarget); err == nil {
+			t.Errorf("%+v: no error", a)
+		}
+	}
+}
+
+// oneRedisWorker makes new writers use one worker and a queue of size.
+func oneRedisWorker(t *testing.T, size int) {
+	workers, queueSize := REDIS_WORKERS, REDIS_QUEUE_SIZE
+	REDIS_WORKERS, REDIS_QUEUE_SIZE = 1, size
+	t.Cleanup(func() { REDIS_WORKERS, REDIS_QUEUE_SIZE = workers, queueSize })
+}
+
+func TestRedisWriterBatch(t *testing.T) {
+	oneRedisWorker(t, 100)
+	f := &fakeRedis{gate: make(chan struct{}), flushing: make(chan struct{})}
+	w := NewRedisWriter(f.pool())
+	q := RedisTarget{Mode: REDIS_LIST, Key: "q", MaxLen: 10}
+	w.Push(q, []byte("{1}"))
+	<-f.flushing // the worker holds the first record
+	for i := 2; i <= 4; i++ {
+		w.Push(q, []byte(fmt.Sprintf("{%d}", i)))
+	}
+	w.Push(RedisTarget{Mode: REDIS_PUBLISH, Key: "c"}, []byte("{5}"))
+	w.Push(q, []byte("{6}"))
+	f.gate <- struct{}{}
+	<-f.flushing
+	f.gate <- struct{}{}
+	w.Close()
+
+	want := []string{
+		"LPUSH q {json}, LTRIM q 0 9",
+		// the records queued meanwhile go out as one pipeline, a run of
+		// records for the same list as one LPUSH
+		"LPUSH q {json} {json} {json}, LTRIM q 0 9, PUBLISH c {json}, LPUSH q {json}, LTRIM q 0 9",
+	}
+	if got := f.log(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("pipelines\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if st := w.Stats(); st.Written != 6 || st.Dropped != 0 || st.Queued != 0 {
+		t.Errorf("stats %+v, want 6 written", st)
+	}
+}
+
+func TestRedisWriterFullQueue(t *testing.T) {
+	oneRedisWorker(t, 2)
+	f := &fakeRedis{gate: make(chan struct{}), flushing: make(chan struct{})}
+	w := NewRedisWriter(f.pool())
+	w.Push(DefaultRedisTarget, []byte("{1}"))
+	<-f.flushing
+	for i := 2; i <= 5; i++ {
+		w.Push(DefaultRedisTarget, []byte(fmt.Sprintf("{%d}", i)))
+	}
+	if st := w.Stats(); st.Queued != 2 || st.Dropped != 2 {
+		t.Errorf("while redis hangs: %+v, want 2 queued and 2 dropped", st)
+	}
+	go func() {
+		for range f.flushing {
+		}
+	}()
+	close(f.gate)
+	w.Close()
+	close(f.flushing)
+	if st := w.Stats(); st.Written != 3 || st.Dropped != 2 || st.Queued != 0 {
+		t.Errorf("after close: %+v, want 3 written and 2 dropped", st)
+	}
+	w.Push(DefaultRedisTarget, []byte("{6}"))
+	if st := w.Stats(); st.Dropped != 3 {
+		t.Errorf("push after close: %+v, want it dropped", st)
+	}
+}
+
+func TestRedisWriterRetry(t *testing.T) {
+	oneRedisWorker(t, 100)
+	f := &fakeRedis{dialErrs: 2}
+	w := NewRedisWriter(f.pool())
+	w.Push(DefaultRedisTarget, []byte("{1}"))
+	for deadline := time.Now().Add(3 * time.Second); w.Stats().Written == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.Close()
+	if st := w.Stats(); st.Written != 1 || st.Retries != 2 || st.Dropped != 0 {
+		t.Errorf("stats %+v, want written after 2 retries", st)
+	}
+	if got := f.log(); len(got) != 1 {
+		t.Errorf("pipelines %q, want the batch sent once", got)
+	}
+}
+
+func TestRedisWriterFailed(t *testing.T) {
+	oneRedisWorker(t, 100)
+	f := &fakeRedis{gate: make(chan struct{}), flushing: make(chan struct{})}
+	w := NewRedisWriter(f.pool())
+	w.Push(DefaultRedisTarget, []byte("{1}"))
+	<-f.flushing
+	w.Push(RedisTarget{Mode: REDIS_LIST, Key: "wrong"}, []byte("{2}"))
+	w.Push(RedisTarget{Mode: REDIS_LIST, Key: "wrong"}, []byte("{3}"))
+	w.Push(DefaultRedisTarget, []byte("{4}"))
+	go func() {
+		for range f.flushing {
+		}
+	}()
+	close(f.gate)
+	w.Close()
+	close(f.flushing)
+	// refused commands are not retried
+	if st := w.Stats(); st.Written != 2 || st.Failed != 2 || st.Retries != 0 {
+		t.Errorf("stats %+v, want 2 written and 2 failed", st)
+	}
+}
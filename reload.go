@@ -0,0 +1,64 @@
+package cproxy
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var RULE_WATCH_INTERVAL = 2 * time.Second
+
+// WatchRules reloads the rule file when it, or anything it includes, changes
+// on disk or the process receives SIGHUP. A file that fails to load leaves
+// the previous rules active.
+func (r *RuleOperator) WatchRules(interval time.Duration) {
+	if r.filePath == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last := ruleFileStamp(r.watchedFiles())
+	for {
+		select {
+		case <-hup:
+			rulesLog.Info("SIGHUP received, reloading rules")
+		case <-tick:
+			if ruleFileStamp(r.watchedFiles()) == last {
+				continue
+			}
+		}
+		if n, err := r.Reload(); err != nil {
+			rulesLog.Error("reload rules failed, keeping the previous rules", "file", r.filePath, "err", err)
+		} else {
+			rulesLog.Info("rules reloaded", "file", r.filePath, "rules", n)
+		}
+		last = ruleFileStamp(r.watchedFiles())
+	}
+}
+
+func (r *RuleOperator) watchedFiles() []string {
+	if files := r.Files(); len(files) > 0 {
+		return files
+	}
+	return []string{r.filePath}
+}
+
+func ruleFileStamp(files []string) string {
+	var stamp strings.Builder
+	for _, filePath := range files {
+		if fi, err := os.Stat(filePath); err == nil {
+			fmt.Fprintf(&stamp, "%s/%d/%d;", filePath, fi.ModTime().UnixNano(), fi.Size())
+		}
+	}
+	return stamp.String()
+}
@@ -0,0 +1,61 @@
+package cproxy
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	rules := writeTemp(t, "rules.yml", "rules:\n  - regex: '^/a'\n    option: to-stdout\n")
+	op := NewRuleOperator(rules, "")
+	if _, ok := op.Match("any.test", "/a"); !ok {
+		t.Fatal("rule not loaded")
+	}
+
+	write := func(yml string) {
+		if err := ioutil.WriteFile(rules, []byte(yml), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("rules:\n  - regex: '^/b'\n    option: to-stdout\n  - regex: '^/c'\n    option: to-stdout\n")
+	if n, err := op.Reload(); err != nil || n != 2 {
+		t.Fatalf("Reload: %d %v, want 2 rules", n, err)
+	}
+	if _, ok := op.Match("any.test", "/a"); ok {
+		t.Error("old rule still matches")
+	}
+	if _, ok := op.Match("any.test", "/b"); !ok {
+		t.Error("new rule does not match")
+	}
+
+	// a broken file keeps the previous rules
+	write("rules:\n  - regex: '('\n    option: to-stdout\n")
+	if _, err := op.Reload(); err == nil {
+		t.Error("bad regex reloaded")
+	}
+	if _, ok := op.Match("any.test", "/b"); !ok {
+		t.Error("previous rules dropped by a failed reload")
+	}
+
+	if _, err := NewRuleOperator("", "").Reload(); err == nil {
+		t.Error("reload without a rule file")
+	}
+}
+
+func TestWatchRules(t *testing.T) {
+	rules := writeTemp(t, "rules.yml", "rules:\n  - regex: '^/a'\n    option: to-stdout\n")
+	op := NewRuleOperator(rules, "")
+	go op.WatchRules(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond) // let the watcher take its first stamp
+
+	if err := ioutil.WriteFile(rules, []byte("rules:\n  - regex: '^/changed'\n    option: to-stdout\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, ok := op.Match("any.test", "/changed"); ok {
+			return
+		}
+	}
+	t.Error("changed rule file not picked up")
+}
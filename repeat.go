@@ -0,0 +1,272 @@
+package cproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FlowEdit changes a captured request before it is sent again. Zero fields
+// keep what was captured.
+type FlowEdit struct {
+	Method string
+	URL    string
+	Header http.Header // replaces the captured values; an empty value removes the header
+	Body   []byte      // plain, compressed as the Content-Encoding header says
+}
+
+// FindFlow returns the flow with the id, or for a number n the n-th flow.
+func FindFlow(flows []*Flow, id string) *Flow {
+	for _, f := range flows {
+		if f.Context != nil && f.Context.ID == id {
+			return f
+		}
+	}
+	if n, err := strconv.Atoi(id); err == nil && n >= 1 && n <= len(flows) {
+		return flows[n-1]
+	}
+	return nil
+}
+
+// Resend sends the request of a captured flow again, with the edits, the
+// way the proxy sends requests upstream, and returns the new exchange.
+// Redirects are returned, not followed.
+func (p *Proxy) Resend(f *Flow, edit *FlowEdit) (*Flow, error) {
+	if f.Response == nil {
+		return nil, fmt.Errorf("a WebSocket frame cannot be sent again")
+	}
+	if edit == nil {
+		edit = &FlowEdit{}
+	}
+	u := *f.Request.URL
+	if u.Host == "" {
+		u.Host = f.Request.Host
+	}
+	if u.Scheme == "" && f.Context != nil {
+		u.Scheme = f.Context.Scheme
+	}
+	rawurl := u.String()
+	if edit.URL != "" {
+		rawurl = edit.URL
+	}
+	target, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("%s: not an absolute URL", rawurl)
+	}
+
+	h := make(http.Header, len(f.Request.Header))
+	for k, v := range f.Request.Header {
+		h[k] = append([]string(nil), v...)
+	}
+	for k, v := range edit.Header {
+		if len(v) == 0 || len(v) == 1 && v[0] == "" {
+			h.Del(k)
+		} else {
+			h[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+		}
+	}
+	host := h.Get("Host")
+	if edit.URL != "" && edit.Header.Get("Host") == "" {
+		host = ""
+	}
+	for _, k := range []string{"Host", "Content-Length", "Transfer-Encoding", "Connection", "Proxy-Connection"} {
+		h.Del(k)
+	}
+
+	body, plain := f.RequestBody, f.RequestDecoded != ""
+	if edit.Body != nil {
+		body, plain = edit.Body, true
+	}
+	if encoding := h.Get("Content-Encoding"); plain && encoding != "" {
+		if body, err = EncodeBody(encoding, body); err != nil {
+			return nil, err
+		}
+	}
+
+	method := valueOrDefault(edit.Method, valueOrDefault(f.Request.Method, "GET"))
+	req, err := http.NewRequest(method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = h
+	if host != "" {
+		req.Host = host
+	}
+	if len(body) == 0 {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+
+	ctx := newContext(p, "", target.Scheme, req.Host)
+	client := p.client(target.Scheme)
+	// the request goes out as captured, Accept-Encoding included
+	client.Transport.(*http.Transport).DisableCompression = true
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(traceRequest(ctx, req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	flow := &Flow{
+		Context:      ctx,
+		Request:      req,
+		Response:     resp,
+		RequestBody:  body,
+		ResponseBody: respBody,
+		Timings:      ctx.timings(time.Now()),
+	}
+	if plain && h.Get("Content-Encoding") != "" {
+		flow.RequestBody, flow.RequestDecoded = plainBody(h, body), h.Get("Content-Encoding")
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); len(contentCodings(encoding)) > 0 && len(respBody) > 0 {
+		if decoded, err := DecodeBody(encoding, respBody); err == nil {
+			flow.ResponseBody, flow.ResponseDecoded = decoded, encoding
+		}
+	}
+	return flow, nil
+}
+
+// WriteSideBySide prints two exchanges in columns, width characters wide in
+// all, headers sorted and JSON bodies indented. Rows that differ are marked
+// with * between the columns.
+func WriteSideBySide(w io.Writer, left, right *Flow, leftTitle, rightTitle string, width int) {
+	col := (width - 3) / 2
+	if col < 20 {
+		col = 20
+	}
+	put := func(l, r, mark string) {
+		ll, rl := wrapColumn(l, col), wrapColumn(r, col)
+		for i := 0; i < len(ll) || i < len(rl); i++ {
+			var a, b string
+			if i < len(ll) {
+				a = ll[i]
+			}
+			if i < len(rl) {
+				b = rl[i]
+			}
+			fmt.Fprintf(w, "%s%s %s %s\n", a, strings.Repeat(" ", col-utf8.RuneCountInString(a)), mark, b)
+		}
+	}
+	row := func(l, r string) {
+		if l == r {
+			put(l, r, "|")
+		} else {
+			put(l, r, "*")
+		}
+	}
+	put(leftTitle, rightTitle, "|")
+	put(strings.Repeat("-", col), strings.Repeat("-", col), "|")
+	row(requestLine(left), requestLine(right))
+	row(statusLine(left), statusLine(right))
+
+	lh, rh := responseHeader(left), responseHeader(right)
+	names := make([]string, 0, len(lh)+len(rh))
+	for k := range lh {
+		names = append(names, k)
+	}
+	for k := range rh {
+		if _, ok := lh[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		lv, rv := lh[k], rh[k]
+		for i := 0; i < len(lv) || i < len(rv); i++ {
+			var a, b string
+			if i < len(lv) {
+				a = k + ": " + lv[i]
+			}
+			if i < len(rv) {
+				b = k + ": " + rv[i]
+			}
+			row(a, b)
+		}
+	}
+	row("", "")
+	lb, rb := bodyLines(left), bodyLines(right)
+	for i := 0; i < len(lb) || i < len(rb); i++ {
+		var a, b string
+		if i < len(lb) {
+			a = lb[i]
+		}
+		if i < len(rb) {
+			b = rb[i]
+		}
+		row(a, b)
+	}
+}
+
+func requestLine(f *Flow) string {
+	u := *f.Request.URL
+	if u.Host == "" {
+		u.Host = f.Request.Host
+	}
+	return "> " + valueOrDefault(f.Request.Method, "GET") + " " + u.String()
+}
+
+func statusLine(f *Flow) string {
+	if f.Response == nil {
+		return "< (WebSocket frame)"
+	}
+	return fmt.Sprintf("< %d %s", f.Response.StatusCode, http.StatusText(f.Response.StatusCode))
+}
+
+func responseHeader(f *Flow) http.Header {
+	if f.Response == nil {
+		return nil
+	}
+	return f.Response.Header
+}
+
+// bodyLines returns the response body for display: JSON indented, text by
+// lines, anything else by size and hash.
+func bodyLines(f *Flow) []string {
+	body := f.ResponseBody
+	if len(body) == 0 {
+		return nil
+	}
+	var indented bytes.Buffer
+	if json.Indent(&indented, body, "", "  ") == nil {
+		body = indented.Bytes()
+	}
+	if !utf8.Valid(body) {
+		sum := sha256.Sum256(body)
+		return []string{fmt.Sprintf("[%d bytes binary, sha256 %s]", len(body), hex.EncodeToString(sum[:8]))}
+	}
+	return strings.Split(strings.TrimRight(string(body), "\n"), "\n")
+}
+
+// wrapColumn cuts a line into pieces of at most col characters, tabs as
+// spaces.
+func wrapColumn(s string, col int) []string {
+	runes := []rune(strings.Replace(strings.TrimRight(s, "\r"), "\t", "    ", -1))
+	if len(runes) == 0 {
+		return []string{""}
+	}
+	var lines []string
+	for len(runes) > col {
+		lines = append(lines, string(runes[:col]))
+		runes = runes[col:]
+	}
+	return append(lines, string(runes))
+}
@@ -0,0 +1,137 @@
+package cproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoServer answers with the request it got: method, URL, the X-A and
+// Cookie headers and the body as received.
+func echoServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Content-Encoding") != "" {
+			body, _ = DecodeBody(r.Header.Get("Content-Encoding"), body)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Method + " " + r.Host + r.URL.RequestURI() + " a=" + r.Header.Get("X-A") + " cookie=" + r.Header.Get("Cookie") + " " + string(body)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// capturedFlow returns a captured POST to rawurl.
+func capturedFlow(rawurl, body string) *Flow {
+	req := httptest.NewRequest("POST", rawurl, nil)
+	req.Header.Set("X-A", "1")
+	req.Header.Set("Cookie", "s=1")
+	return &Flow{
+		Context:      &Context{ID: "f1", Scheme: "http"},
+		Request:      req,
+		Response:     &http.Response{StatusCode: 200, Header: http.Header{}},
+		RequestBody:  []byte(body),
+		ResponseBody: []byte("old"),
+	}
+}
+
+func TestFindFlow(t *testing.T) {
+	flows := []*Flow{capturedFlow("http://a.test/1", ""), capturedFlow("http://a.test/2", "")}
+	flows[1].Context = &Context{ID: "f2"}
+	for _, test := range []struct {
+		id   string
+		want *Flow
+	}{
+		{"f2", flows[1]},
+		{"1", flows[0]},
+		{"2", flows[1]},
+		{"3", nil},
+		{"f9", nil},
+	} {
+		if got := FindFlow(flows, test.id); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.id, got, test.want)
+		}
+	}
+}
+
+func TestResend(t *testing.T) {
+	srv := echoServer(t)
+	p := NewProxy("", "", "", "", "")
+	for _, test := range []struct {
+		name string
+		edit *FlowEdit
+		want string
+	}{
+		{"as captured", nil, "POST " + srv.Listener.Addr().String() + "/v1?q=1 a=1 cookie=s=1 name=u"},
+		{"edited", &FlowEdit{Method: "PUT", URL: srv.URL + "/v2", Header: http.Header{"X-A": {"2"}, "Cookie": {""}}, Body: []byte("name=v")},
+			"PUT " + srv.Listener.Addr().String() + "/v2 a=2 cookie= name=v"},
+		{"compressed again", &FlowEdit{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: []byte("name=z")},
+			"POST " + srv.Listener.Addr().String() + "/v1?q=1 a=1 cookie=s=1 name=z"},
+	} {
+		f, err := p.Resend(capturedFlow(srv.URL+"/v1?q=1", "name=u"), test.edit)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if string(f.ResponseBody) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, f.ResponseBody, test.want)
+		}
+	}
+
+	// redirects come back as they are
+	f, err := p.Resend(capturedFlow(srv.URL+"/moved", ""), nil)
+	if err != nil || f.Response.StatusCode != http.StatusFound {
+		t.Errorf("redirect: %v %v", f, err)
+	}
+	if _, err := p.Resend(capturedFlow(srv.URL, ""), &FlowEdit{URL: "/relative"}); err == nil {
+		t.Error("relative URL sent")
+	}
+	frame := capturedFlow(srv.URL, "")
+	frame.Response = nil
+	if _, err := p.Resend(frame, nil); err == nil {
+		t.Error("WebSocket frame sent")
+	}
+}
+
+func TestWriteSideBySide(t *testing.T) {
+	left := capturedFlow("http://a.test/v1", "")
+	left.Response.Header.Set("X-Same", "1")
+	left.Response.Header.Set("X-Old", "1")
+	left.ResponseBody = []byte(`{"a":1,"b":2}`)
+	right := capturedFlow("http://a.test/v1", "")
+	right.Response.StatusCode = 500
+	right.Response.Header.Set("X-Same", "1")
+	right.ResponseBody = []byte(`{"a":1,"b":3}`)
+
+	var b bytes.Buffer
+	WriteSideBySide(&b, left, right, "captured", "now", 63)
+	var marks []string
+	for _, line := range strings.Split(strings.TrimRight(b.String(), "\n"), "\n") {
+		if len(line) < 32 {
+			t.Fatalf("short line %q in\n%s", line, b.String())
+		}
+		marks = append(marks, strings.TrimSpace(line[:30])+" "+line[31:32])
+	}
+	want := []string{
+		"captured |",
+		"------------------------------ |",
+		"> POST http://a.test/v1 |",
+		"< 200 OK *",
+		"X-Old: 1 *",
+		"X-Same: 1 |",
+		" |",
+		"{ |",
+		`"a": 1, |`,
+		`"b": 2 *`,
+		"} |",
+	}
+	if strings.Join(marks, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s\noutput\n%s", strings.Join(marks, "\n"), strings.Join(want, "\n"), b.String())
+	}
+}
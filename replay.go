@@ -0,0 +1,292 @@
+package cproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// What a Replayer does with a request that has no recording.
+const (
+	REPLAY_MISS_404         = "404"         // answer 404
+	REPLAY_MISS_PASSTHROUGH = "passthrough" // send it upstream
+	REPLAY_MISS_FAIL        = "fail"        // answer 502 and count the run as failed
+)
+
+// REPLAY_HEADER marks the answers to requests without a recording.
+var REPLAY_HEADER = "X-Free-Proxy-Replay"
+
+// ReplayMatch says which parts of a request pick its recording. Method,
+// scheme, host, path and query always count; query parameters and header
+// names are patterns as in path.Match, header names case-insensitive.
+type ReplayMatch struct {
+	IgnoreQuery   []string // query parameters left out, e.g. _ or utm_*
+	Headers       []string // request headers that count, * for all
+	IgnoreHeaders []string // headers left out of Headers
+	Body          bool     // the SHA-256 of the request body counts
+}
+
+// Replayer answers requests from recorded flows without going upstream.
+// Requests with the same match key get the recordings in capture order, the
+// last one again once they are used up.
+type Replayer struct {
+	Match ReplayMatch
+	Miss  string
+
+	flows map[string][]*StoredFlow
+	next  map[string]int
+	lock  sync.Mutex
+
+	hits, misses uint64
+}
+
+func NewReplayer(flows []*StoredFlow, match ReplayMatch, miss string) (*Replayer, error) {
+	switch miss {
+	case "":
+		miss = REPLAY_MISS_404
+	case REPLAY_MISS_404, REPLAY_MISS_PASSTHROUGH, REPLAY_MISS_FAIL:
+	default:
+		return nil, fmt.Errorf("unknown miss policy %q, want 404, passthrough or fail", miss)
+	}
+	for _, patterns := range [][]string{match.IgnoreQuery, match.Headers, match.IgnoreHeaders} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("%s: %v", p, err)
+			}
+		}
+	}
+	r := &Replayer{
+		Match: match,
+		Miss:  miss,
+		flows: make(map[string][]*StoredFlow),
+		next:  make(map[string]int),
+	}
+	for _, sf := range flows {
+		if sf.Kind != FLOW_HTTP {
+			continue
+		}
+		u, err := url.Parse(sf.Url)
+		if err != nil {
+			continue
+		}
+		body := sf.ReqBody
+		if sf.ReqDecoded == "" {
+			body = plainBody(sf.ReqHeader, body)
+		}
+		key := r.key(sf.Method, u, sf.ReqHeader, body)
+		r.flows[key] = append(r.flows[key], sf)
+	}
+	return r, nil
+}
+
+// LoadReplay reads the HTTP flows of a store matching q, in capture order.
+func LoadReplay(filePath string, q *FlowQuery, match ReplayMatch, miss string) (*Replayer, error) {
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, err
+	}
+	s, err := OpenStore(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if q == nil {
+		q = &FlowQuery{}
+	}
+	flows, err := s.Find(q)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayer(flows, match, miss)
+}
+
+// Len returns how many recordings there are to replay.
+func (r *Replayer) Len() int {
+	n := 0
+	for _, list := range r.flows {
+		n += len(list)
+	}
+	return n
+}
+
+// Stats returns how many requests were answered from a recording and how
+// many had none.
+func (r *Replayer) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&r.hits), atomic.LoadUint64(&r.misses)
+}
+
+// Respond returns the recorded response to req, or the answer of the miss
+// policy. It returns nil when the request is to go upstream.
+func (r *Replayer) Respond(req *http.Request) *http.Response {
+	body, err := peekRequestBody(req)
+	if err != nil {
+		replayLog.Error("read request body", "method", req.Method, "url", req.URL.String(), "err", err)
+	}
+	u := *req.URL
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	sf := r.take(r.key(valueOrDefault(req.Method, "GET"), &u, req.Header, plainBody(req.Header, body)))
+	if sf != nil {
+		atomic.AddUint64(&r.hits, 1)
+		return replayResponse(req, sf)
+	}
+	atomic.AddUint64(&r.misses, 1)
+	replayLog.Warn("no recording", "method", req.Method, "url", u.String())
+	switch r.Miss {
+	case REPLAY_MISS_PASSTHROUGH:
+		return nil
+	case REPLAY_MISS_FAIL:
+		return replayMiss(req, http.StatusBadGateway)
+	}
+	return replayMiss(req, http.StatusNotFound)
+}
+
+// Baseline returns the recording of a captured flow, nil if there is none.
+// Like Respond it takes the recordings of a request in turn.
+func (r *Replayer) Baseline(f *Flow) *StoredFlow {
+	u := *f.Request.URL
+	if u.Host == "" {
+		u.Host = f.Request.Host
+	}
+	body := f.RequestBody
+	if f.RequestDecoded == "" {
+		body = plainBody(f.Request.Header, body)
+	}
+	return r.take(r.key(valueOrDefault(f.Request.Method, "GET"), &u, f.Request.Header, body))
+}
+
+// take returns the next recording of a match key.
+func (r *Replayer) take(key string) *StoredFlow {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	list := r.flows[key]
+	if len(list) == 0 {
+		return nil
+	}
+	i := r.next[key]
+	if i < len(list)-1 {
+		r.next[key] = i + 1
+	}
+	return list[i]
+}
+
+// key returns the match key of a request, body decoded.
+func (r *Replayer) key(method string, u *url.URL, h http.Header, body []byte) string {
+	var b strings.Builder
+	scheme := strings.ToLower(valueOrDefault(u.Scheme, "http"))
+	host := strings.ToLower(u.Host)
+	if scheme == "http" {
+		host = strings.TrimSuffix(host, ":80")
+	} else if scheme == "https" {
+		host = strings.TrimSuffix(host, ":443")
+	}
+	query := u.Query()
+	for name := range query {
+		if matchAny(r.Match.IgnoreQuery, name) {
+			query.Del(name)
+		}
+	}
+	fmt.Fprintf(&b, "%s %s://%s%s?%s", strings.ToUpper(method), scheme, host, valueOrDefault(u.EscapedPath(), "/"), query.Encode())
+	if len(r.Match.Headers) > 0 {
+		names := make([]string, 0, len(h))
+		for name := range h {
+			lower := strings.ToLower(name)
+			if matchAny(r.Match.Headers, lower) && !matchAny(r.Match.IgnoreHeaders, lower) {
+				names = append(names, name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool { return strings.ToLower(names[i]) < strings.ToLower(names[j]) })
+		for _, name := range names {
+			fmt.Fprintf(&b, "\n%s: %s", strings.ToLower(name), strings.Join(h[name], ", "))
+		}
+	}
+	if r.Match.Body {
+		sum := sha256.Sum256(body)
+		fmt.Fprintf(&b, "\n\n%s", hex.EncodeToString(sum[:]))
+	}
+	return b.String()
+}
+
+// matchAny reports whether name matches one of the patterns, compared in
+// lower case.
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// plainBody returns body without its Content-Encoding, or as it is when it
+// does not decode.
+func plainBody(h http.Header, body []byte) []byte {
+	if len(contentCodings(h.Get("Content-Encoding"))) == 0 || len(body) == 0 {
+		return body
+	}
+	if b, err := DecodeBody(h.Get("Content-Encoding"), body); err == nil {
+		return b
+	}
+	return body
+}
+
+// replayResponse builds the response of a recording, the body compressed
+// again as the recorded Content-Encoding says.
+func replayResponse(req *http.Request, sf *StoredFlow) *http.Response {
+	h := make(http.Header, len(sf.RespHeader))
+	for k, v := range sf.RespHeader {
+		h[k] = append([]string(nil), v...)
+	}
+	body := sf.RespBody
+	if sf.RespDecoded != "" {
+		if b, err := EncodeBody(sf.RespDecoded, body); err == nil {
+			body = b
+		} else {
+			h.Del("Content-Encoding")
+		}
+	}
+	h.Del("Content-Length")
+	if len(body) > 0 {
+		h.Set("Content-Length", fmt.Sprint(len(body)))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", sf.Status, http.StatusText(sf.Status)),
+		StatusCode:    sf.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func replayMiss(req *http.Request, status int) *http.Response {
+	body := fmt.Sprintf("free-proxy replay: no recording of %s %s\n", req.Method, req.URL)
+	h := make(http.Header)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Length", fmt.Sprint(len(body)))
+	h.Set(REPLAY_HEADER, "miss")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
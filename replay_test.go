@@ -0,0 +1,122 @@
+package cproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func replayBody(t *testing.T, r *Replayer, req *http.Request) string {
+	t.Helper()
+	resp := r.Respond(req)
+	if resp == nil {
+		t.Fatalf("%s %s: passed through", req.Method, req.URL)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return resp.Status
+	}
+	return string(b)
+}
+
+func TestLoadReplayOrder(t *testing.T) {
+	filePath := writeStore(t,
+		recording("GET", "http://api.test/n", "first"),
+		recording("GET", "http://api.test/other", "other"),
+		recording("GET", "http://api.test/n", "second"),
+		recording("GET", "http://api.test/n", "third"),
+	)
+	r, err := LoadReplay(filePath, nil, ReplayMatch{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 4 {
+		t.Fatalf("Len %d, want 4", r.Len())
+	}
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, replayBody(t, r, httptest.NewRequest("GET", "http://api.test/n", nil)))
+	}
+	// in capture order, the last again once used up
+	if want := "first second third third"; strings.Join(got, " ") != want {
+		t.Errorf("replayed %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestReplayMatch(t *testing.T) {
+	withHeader := recording("GET", "http://api.test/user?id=1&_=99", "tenant a")
+	withHeader.ReqHeader.Set("X-Tenant", "a")
+	post := recording("POST", "http://api.test/login", "welcome")
+	post.ReqBody = []byte(`{"user":"u"}`)
+	flows := []*StoredFlow{
+		recording("GET", "http://api.test/user?id=1", "plain"),
+		withHeader,
+		recording("GET", "https://API.test:443/secure", "secure"),
+		post,
+	}
+
+	for _, test := range []struct {
+		name   string
+		match  ReplayMatch
+		method string
+		url    string
+		header http.Header
+		body   string
+		want   string
+	}{
+		{"exact", ReplayMatch{}, "GET", "http://api.test/user?id=1", nil, "", "plain"},
+		{"other method", ReplayMatch{}, "POST", "http://api.test/user?id=1", nil, "", "404 Not Found"},
+		{"other query", ReplayMatch{}, "GET", "http://api.test/user?id=2", nil, "", "404 Not Found"},
+		{"ignored query", ReplayMatch{IgnoreQuery: []string{"_"}}, "GET", "http://api.test/user?_=1&id=1", nil, "", "plain"},
+		{"default port and host case", ReplayMatch{}, "GET", "https://api.test/secure", nil, "", "secure"},
+		{"header counts", ReplayMatch{Headers: []string{"x-tenant"}, IgnoreQuery: []string{"_"}}, "GET", "http://api.test/user?id=1",
+			http.Header{"X-Tenant": {"a"}}, "", "tenant a"},
+		{"ignored header", ReplayMatch{Headers: []string{"*"}, IgnoreHeaders: []string{"x-*"}, IgnoreQuery: []string{"_"}}, "GET",
+			"http://api.test/user?id=1", http.Header{"X-Tenant": {"b"}}, "", "plain"},
+		{"body counts", ReplayMatch{Body: true}, "POST", "http://api.test/login", nil, `{"user":"u"}`, "welcome"},
+		{"other body", ReplayMatch{Body: true}, "POST", "http://api.test/login", nil, `{"user":"v"}`, "404 Not Found"},
+		{"body ignored", ReplayMatch{}, "POST", "http://api.test/login", nil, `{"user":"v"}`, "welcome"},
+	} {
+		r, err := NewReplayer(flows, test.match, "")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		req := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		for k, v := range test.header {
+			req.Header[k] = v
+		}
+		if got := replayBody(t, r, req); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReplayMiss(t *testing.T) {
+	for _, test := range []struct {
+		miss   string
+		status int // 0 for passed through
+	}{
+		{"", http.StatusNotFound},
+		{REPLAY_MISS_404, http.StatusNotFound},
+		{REPLAY_MISS_FAIL, http.StatusBadGateway},
+		{REPLAY_MISS_PASSTHROUGH, 0},
+	} {
+		r, err := NewReplayer(nil, ReplayMatch{}, test.miss)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := r.Respond(httptest.NewRequest("GET", "http://api.test/", nil))
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		if status != test.status {
+			t.Errorf("miss %q: status %d, want %d", test.miss, status, test.status)
+		}
+	}
+	if _, err := NewReplayer(nil, ReplayMatch{}, "retry"); err == nil {
+		t.Error("unknown miss policy accepted")
+	}
+}
@@ -1,108 +1,549 @@
 package cproxy
 
 import (
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"net/url"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+type Action struct {
+	Option  string `yaml:"option" json:"option"`
+	Content string `yaml:"content,omitempty" json:"content,omitempty"`
+	Header  string `yaml:"header,omitempty" json:"header,omitempty"`
+	Value   string `yaml:"value,omitempty" json:"value,omitempty"`
+	Timeout string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+
+	Status      int      `yaml:"status,omitempty" json:"status,omitempty"`
+	Bytes       int      `yaml:"bytes,omitempty" json:"bytes,omitempty"`
+	Probability *float64 `yaml:"probability,omitempty" json:"probability,omitempty"`
+
+	Preset  string `yaml:"preset,omitempty" json:"preset,omitempty"`
+	Latency string `yaml:"latency,omitempty" json:"latency,omitempty"`
+	Jitter  string `yaml:"jitter,omitempty" json:"jitter,omitempty"`
+	Up      string `yaml:"up,omitempty" json:"up,omitempty"`
+	Down    string `yaml:"down,omitempty" json:"down,omitempty"`
+
+	Mode   string `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Key    string `yaml:"key,omitempty" json:"key,omitempty"`
+	MaxLen int    `yaml:"maxlen,omitempty" json:"maxlen,omitempty"`
+	TTL    string `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+}
+
 type Rule struct {
-	Host      string `yaml:"host"`
-	Regex     string `yaml:"regex"`
-	Option    string `yaml:"option"`
-	Content   string `yaml:"content"`
-	UriRegexp *regexp.Regexp
+	Host      string         `yaml:"host,omitempty" json:"host,omitempty"`
+	Regex     string         `yaml:"regex,omitempty" json:"regex,omitempty"`
+	Option    string         `yaml:"option,omitempty" json:"option,omitempty"`
+	Content   string         `yaml:"content,omitempty" json:"content,omitempty"`
+	Priority  int            `yaml:"priority,omitempty" json:"priority,omitempty"`
+	Stop      bool           `yaml:"stop,omitempty" json:"stop,omitempty"`
+	Actions   []Action       `yaml:"actions,omitempty" json:"actions,omitempty"`
+	UriRegexp *regexp.Regexp `yaml:"-" json:"-"`
+	File      string         `yaml:"-" json:"-"`
+	Line      int            `yaml:"-" json:"-"`
+	Group     string         `yaml:"-" json:"-"`
+	ID        string         `yaml:"-" json:"-"` // file:line, or api-n for a rule added at runtime
+
+	hostRegexp *regexp.Regexp
+	hostScore  int
 }
 
 var (
-	OPT_TO_STDOUT          = "to-stdout"
-	OPT_USE_LOCAL_RESPONSE = "use-local-response"
-	OPT_TO_REDIS           = "to-redis"
+	OPT_TO_STDOUT           = "to-stdout"
+	OPT_USE_LOCAL_RESPONSE  = "use-local-response"
+	OPT_TO_REDIS            = "to-redis"
+	OPT_TO_HAR              = "to-har"
+	OPT_TO_FILE             = "to-file"
+	OPT_TO_DB               = "to-db"
+	OPT_TO_WEBHOOK          = "to-webhook"
+	OPT_SET_REQUEST_HEADER  = "set-request-header"
+	OPT_DEL_REQUEST_HEADER  = "del-request-header"
+	OPT_SET_RESPONSE_HEADER = "set-response-header"
+	OPT_DEL_RESPONSE_HEADER = "del-response-header"
+	OPT_SCRIPT              = "script"
+
+	OPT_BLOCK       = "block"
+	OPT_RESET       = "reset"
+	OPT_CLOSE       = "close"
+	OPT_TRUNCATE    = "truncate"
+	OPT_BAD_CHUNKED = "bad-chunked"
+
+	OPT_THROTTLE = "throttle"
+
+	OPT_BREAKPOINT = "breakpoint"
 )
 
-func loadRules(filePath string) ([]Rule, error) {
-	cfg, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return nil, err
+var ruleOptions = map[string]bool{
+	OPT_TO_STDOUT:           true,
+	OPT_USE_LOCAL_RESPONSE:  true,
+	OPT_TO_REDIS:            true,
+	OPT_TO_HAR:              true,
+	OPT_TO_FILE:             true,
+	OPT_TO_DB:               true,
+	OPT_TO_WEBHOOK:          true,
+	OPT_SET_REQUEST_HEADER:  true,
+	OPT_DEL_REQUEST_HEADER:  true,
+	OPT_SET_RESPONSE_HEADER: true,
+	OPT_DEL_RESPONSE_HEADER: true,
+	OPT_SCRIPT:              true,
+	OPT_BLOCK:               true,
+	OPT_RESET:               true,
+	OPT_CLOSE:               true,
+	OPT_TRUNCATE:            true,
+	OPT_BAD_CHUNKED:         true,
+	OPT_THROTTLE:            true,
+	OPT_BREAKPOINT:          true,
+}
+
+const (
+	HOST_DEFAULT = "default"
+	HOST_ANY     = "*"
+)
+
+// RuleErrors collects every problem found in a rule file.
+type RuleErrors []string
+
+func (e RuleErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+func (a *Action) validate() error {
+	if !ruleOptions[a.Option] {
+		return fmt.Errorf("unknown option %q", a.Option)
+	}
+	switch a.Option {
+	case OPT_USE_LOCAL_RESPONSE, OPT_TO_HAR, OPT_TO_FILE, OPT_TO_DB:
+		if a.Content == "" {
+			return fmt.Errorf("%s needs content", a.Option)
+		}
+	case OPT_SET_REQUEST_HEADER, OPT_DEL_REQUEST_HEADER, OPT_SET_RESPONSE_HEADER, OPT_DEL_RESPONSE_HEADER:
+		if a.Header == "" {
+			return fmt.Errorf("%s needs header", a.Option)
+		}
+	case OPT_THROTTLE:
+		if _, err := a.throttle(); err != nil {
+			return err
+		}
+	case OPT_TO_REDIS:
+		if _, err := a.redisTarget(DefaultRedisTarget); err != nil {
+			return err
+		}
+	case OPT_TO_WEBHOOK:
+		if a.Content != "" {
+			if u, err := url.Parse(a.Content); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("%s needs an http or https url", a.Option)
+			}
+		}
+	case OPT_BREAKPOINT:
+		if a.Content != "" && a.Content != BREAKPOINT_REQUEST && a.Content != BREAKPOINT_RESPONSE {
+			return fmt.Errorf("%s content must be %s, %s or empty for both", a.Option, BREAKPOINT_REQUEST, BREAKPOINT_RESPONSE)
+		}
+	case OPT_SCRIPT:
+		if a.Content == "" {
+			return fmt.Errorf("%s needs content", a.Option)
+		}
+		if _, err := LoadScript(a.Content); err != nil {
+			return fmt.Errorf("script %s: %v", a.Content, err)
+		}
+	}
+	if a.Status != 0 && (a.Status < 100 || a.Status > 599) {
+		return fmt.Errorf("status %d out of range", a.Status)
+	}
+	if a.Bytes < 0 {
+		return fmt.Errorf("bytes must not be negative")
+	}
+	if p := a.Probability; p != nil && (*p < 0 || *p > 1) {
+		return fmt.Errorf("probability must be between 0 and 1")
+	}
+	if a.Timeout != "" {
+		if _, err := time.ParseDuration(a.Timeout); err != nil {
+			return fmt.Errorf("timeout: %v", err)
+		}
 	}
-	var out struct {
-		Version string `yaml:"version"`
-		Rules   []Rule `yaml:"rules"`
+	return nil
+}
+
+// GetTimeout returns the timeout of a script action.
+func (a *Action) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(a.Timeout); err == nil && d > 0 {
+		return d
 	}
+	return SCRIPT_TIMEOUT
+}
 
-	if err = yaml.Unmarshal(cfg, &out); err != nil {
-		return nil, err
+// compile prepares the regexps of the rule and checks its actions.
+func (r *Rule) compile() (errs []string) {
+	var err error
+	if r.UriRegexp, err = regexp.Compile(r.Regex); err != nil {
+		errs = append(errs, fmt.Sprintf("regex: %v", err))
+	}
+	if err = r.compileHost(); err != nil {
+		errs = append(errs, fmt.Sprintf("host: %v", err))
+	}
+	for _, a := range r.GetActions() {
+		if err = a.validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return
+}
+
+// compileHost turns the host field of a rule into a matcher.
+//
+//	default, * or empty  every host
+//	~regex               regular expression on the host
+//	*.example.com        glob, * matches any run of characters
+//	example.com:8443     exact, the port is only compared when given
+func (r *Rule) compileHost() (err error) {
+	host := strings.TrimSpace(r.Host)
+	switch {
+	case host == "" || host == HOST_DEFAULT || host == HOST_ANY:
+		r.hostRegexp = nil
+		r.hostScore = 0
+		return nil
+	case strings.HasPrefix(host, "~"):
+		r.hostRegexp, err = regexp.Compile(host[1:])
+		r.hostScore = 1
+	case strings.Contains(host, "*"):
+		parts := strings.Split(host, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		r.hostRegexp, err = regexp.Compile("(?i)^" + strings.Join(parts, ".*") + "$")
+		r.hostScore = 2
+	default:
+		r.hostRegexp, err = regexp.Compile("(?i)^" + regexp.QuoteMeta(host) + "$")
+		r.hostScore = 3
+	}
+	return err
+}
+
+func (r *Rule) matchHost(host string) bool {
+	if r.hostRegexp == nil {
+		return true
 	}
-	return out.Rules, nil
+	if r.hostRegexp.MatchString(host) {
+		return true
+	}
+	if name := hostWithoutPort(host); name != host {
+		return r.hostRegexp.MatchString(name)
+	}
+	return false
+}
+
+// GetActions returns the single option/content shorthand of the rule followed
+// by its actions list.
+func (r *Rule) GetActions() []Action {
+	actions := make([]Action, 0, len(r.Actions)+1)
+	if r.Option != "" {
+		actions = append(actions, Action{Option: r.Option, Content: r.Content})
+	}
+	return append(actions, r.Actions...)
+}
+
+func (r *Rule) match(host, uri string) bool {
+	return r.UriRegexp != nil && r.matchHost(host) && r.UriRegexp.MatchString(uri)
 }
 
 type RuleOperator struct {
 	Enable bool
-	rules  map[string][]Rule
+	rules  []Rule
 	filter *regexp.Regexp
+
+	groups        map[string]bool
+	groupOverride map[string]bool
+	files         []string
+	filePath      string
+	lock          sync.RWMutex
+
+	fileRules []Rule          // as loaded from the rule file
+	added     []Rule          // added at runtime, kept across reloads
+	disabled  map[string]bool // by rule id, kept across reloads
+	lastAdded int
+}
+
+// RuleInfo is a loaded rule as the admin API lists it.
+type RuleInfo struct {
+	ID      string `json:"id"`
+	Group   string `json:"group,omitempty"`
+	Enabled bool   `json:"enabled"`
+	Rule    Rule   `json:"rule"`
 }
 
+// ErrUnknownRule is returned for a rule id that is not loaded.
+var ErrUnknownRule = errors.New("no such rule")
+
+// Match returns the first rule matching host and uri.
 func (r *RuleOperator) Match(host, uri string) (rule Rule, matched bool) {
-	rule = Rule{
-		Option: OPT_TO_STDOUT,
+	rules := r.MatchAll(host, uri)
+	if len(rules) == 0 || !r.IsEnable() {
+		return Rule{Option: OPT_TO_STDOUT}, false
+	}
+	return rules[0], true
+}
+
+// MatchAll returns every rule matching host and uri, in the order their
+// actions should run. Rules are tried by priority, then host specificity,
+// then file order, and the walk ends after the first matching rule with
+// stop set. When neither rules nor a filter are configured every request
+// gets the to-stdout rule; otherwise an empty result means "leave it alone".
+func (r *RuleOperator) MatchAll(host, uri string) (rules []Rule) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if !r.Enable {
+		return []Rule{{Option: OPT_TO_STDOUT}}
 	}
-	matched = false
 	if r.filter != nil {
-		return rule, r.filter.MatchString(uri)
+		if r.filter.MatchString(uri) {
+			return []Rule{{Option: OPT_TO_STDOUT}}
+		}
+		return nil
 	}
-	if len(r.rules) == 0 {
-		return
+	for _, rl := range r.rules {
+		if rl.Group != "" && !r.groupEnabled(rl.Group) || r.disabled[rl.ID] {
+			continue
+		}
+		if rl.match(host, uri) {
+			rules = append(rules, rl)
+			if rl.Stop {
+				break
+			}
+		}
+	}
+	return
+}
+
+func (r *RuleOperator) IsEnable() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.Enable
+}
+
+func (r *RuleOperator) FilePath() string {
+	return r.filePath
+}
+
+// Files returns the rule file and everything it includes, as of the last
+// successful load.
+func (r *RuleOperator) Files() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return append([]string(nil), r.files...)
+}
+
+func (r *RuleOperator) groupEnabled(name string) bool {
+	if on, ok := r.groupOverride[name]; ok {
+		return on
+	}
+	on, ok := r.groups[name]
+	return !ok || on
+}
+
+// SetGroup turns a named rule group on or off. The choice is kept across
+// reloads of the rule file.
+func (r *RuleOperator) SetGroup(name string, enabled bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.groupOverride == nil {
+		r.groupOverride = make(map[string]bool)
 	}
-	rules, ok := r.rules[host]
-	if ok {
-		for _, rule := range rules {
-			if rule.UriRegexp.MatchString(uri) {
-				return rule, true
+	r.groupOverride[name] = enabled
+}
+
+// Groups returns every named group of the loaded rules and whether it is on.
+func (r *RuleOperator) Groups() map[string]bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	groups := make(map[string]bool, len(r.groups))
+	for name := range r.groups {
+		groups[name] = r.groupEnabled(name)
+	}
+	return groups
+}
+
+// Reload reads and compiles the rule file again. The running rules are only
+// replaced when the whole file, includes and all, is valid.
+func (r *RuleOperator) Reload() (int, error) {
+	if r.filePath == "" {
+		return 0, errors.New("no rule file")
+	}
+	set, err := compileRuleFile(r.filePath)
+	if err != nil {
+		return 0, err
+	}
+	r.lock.Lock()
+	r.fileRules = set.rules
+	r.groups = set.groups
+	r.files = set.files
+	r.merge()
+	r.lock.Unlock()
+	return len(set.rules), nil
+}
+
+// merge puts the file rules and the added ones together in match order. It
+// is called with the lock held.
+func (r *RuleOperator) merge() {
+	rules := make([]Rule, 0, len(r.fileRules)+len(r.added))
+	rules = append(append(rules, r.fileRules...), r.added...)
+	sortRules(rules)
+	r.rules = rules
+	r.Enable = r.filter != nil || len(rules) > 0
+}
+
+// Rules returns the loaded rules in match order.
+func (r *RuleOperator) Rules() []RuleInfo {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	infos := make([]RuleInfo, 0, len(r.rules))
+	for _, rl := range r.rules {
+		enabled := !r.disabled[rl.ID] && (rl.Group == "" || r.groupEnabled(rl.Group))
+		infos = append(infos, RuleInfo{ID: rl.ID, Group: rl.Group, Enabled: enabled, Rule: rl})
+	}
+	return infos
+}
+
+// AddRule checks a rule and adds it to the loaded ones. It returns the id
+// of the rule, which stays in place when the rule file is reloaded.
+func (r *RuleOperator) AddRule(rule Rule) (string, error) {
+	line := rule.Line
+	rule.File, rule.Line, rule.Group = "", 0, ""
+	if errs := rule.compile(); len(errs) > 0 {
+		if line > 0 {
+			// decoded from YAML, point at the rule
+			for i, e := range errs {
+				errs[i] = fmt.Sprintf("line %d: %s", line, e)
 			}
 		}
-		return
+		return "", RuleErrors(errs)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastAdded++
+	rule.ID = fmt.Sprintf("api-%d", r.lastAdded)
+	r.added = append(r.added, rule)
+	r.merge()
+	return rule.ID, nil
+}
+
+// RemoveRule removes a rule added at runtime. Rules of the rule file can
+// only be disabled.
+func (r *RuleOperator) RemoveRule(id string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, rl := range r.added {
+		if rl.ID == id {
+			r.added = append(r.added[:i:i], r.added[i+1:]...)
+			delete(r.disabled, id)
+			r.merge()
+			return nil
+		}
+	}
+	for _, rl := range r.fileRules {
+		if rl.ID == id {
+			return fmt.Errorf("%s is in the rule file, disable it instead", id)
+		}
+	}
+	return ErrUnknownRule
+}
+
+// SetRuleEnabled turns a single rule on or off. The choice is kept across
+// reloads for as long as the rule keeps its id.
+func (r *RuleOperator) SetRuleEnabled(id string, enabled bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, rl := range r.rules {
+		if rl.ID != id {
+			continue
+		}
+		if r.disabled == nil {
+			r.disabled = make(map[string]bool)
+		}
+		if enabled {
+			delete(r.disabled, id)
+		} else {
+			r.disabled[id] = true
+		}
+		return nil
 	}
-	rules, ok = r.rules["default"]
-	if !ok {
-		return
+	return ErrUnknownRule
+}
+
+// Filter returns the expression of the -f filter, "" when the rules are used.
+func (r *RuleOperator) Filter() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.filter == nil {
+		return ""
 	}
-	for _, rule := range rules {
-		if rule.UriRegexp.MatchString(uri) {
-			return rule, true
+	return r.filter.String()
+}
+
+// SetFilter replaces the -f filter. While a filter is set it decides alone
+// which requests are printed and captured; "" goes back to the rules.
+func (r *RuleOperator) SetFilter(filter string) error {
+	var f *regexp.Regexp
+	if filter != "" {
+		var err error
+		if f, err = regexp.Compile(filter); err != nil {
+			return err
 		}
 	}
-	return
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.filter = f
+	r.merge()
+	return nil
 }
 
-func NewRuleOperator(filePath, filter string) RuleOperator {
-	ruleInc := RuleOperator{filter: nil, Enable: false}
+func compileRuleFile(filePath string) (*ruleSet, error) {
+	set, err := loadRuleSet(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var errs RuleErrors
+	for i := range set.rules {
+		v := &set.rules[i]
+		v.ID = fmt.Sprintf("%s:%d", v.File, v.Line)
+		for _, e := range v.compile() {
+			errs = append(errs, fmt.Sprintf("%s:%d: %s", v.File, v.Line, e))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	sortRules(set.rules)
+	return set, nil
+}
+
+func sortRules(rules []Rule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return rules[i].hostScore > rules[j].hostScore
+	})
+}
+
+func NewRuleOperator(filePath, filter string) *RuleOperator {
+	ruleInc := &RuleOperator{filter: nil, Enable: false}
 
 	if len(filter) > 0 {
 		if f, err := regexp.Compile(filter); err == nil {
 			ruleInc.filter = f
 			ruleInc.Enable = true
-			return ruleInc
 		}
 	}
-	ruleMap := make(map[string][]Rule)
-	if rls, err := loadRules(filePath); err != nil {
+	// loaded under a filter too, for when the filter is cleared
+	if len(filePath) == 0 {
 		return ruleInc
-	} else {
-		for _, v := range rls {
-			v.UriRegexp, err = regexp.Compile(v.Regex)
-			if err != nil {
-				log.Println("compile error:", err)
-			}
-			r, ok := ruleMap[v.Host]
-			if ok {
-				r = append(r, v)
-			} else {
-				r = []Rule{v,}
-			}
-			ruleMap[v.Host] = r
-			ruleInc.Enable = true
-		}
 	}
-	ruleInc.rules = ruleMap
+	ruleInc.filePath = filePath
+	if _, err := ruleInc.Reload(); err != nil {
+		rulesLog.Error("load rules", "file", filePath, "err", err)
+	}
 	return ruleInc
 }
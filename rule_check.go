@@ -0,0 +1,69 @@
+package cproxy
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// CheckRules loads and validates a rule file without starting the proxy.
+func CheckRules(filePath string) ([]Rule, error) {
+	set, err := compileRuleFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return set.rules, nil
+}
+
+// TestRules prints which rules, and which of their actions, would fire for a
+// request to rawUrl.
+func TestRules(w io.Writer, filePath, method, rawUrl string) error {
+	set, err := compileRuleFile(filePath)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("url %q has no host", rawUrl)
+	}
+	op := &RuleOperator{rules: set.rules, groups: set.groups, Enable: len(set.rules) > 0}
+	matched := op.MatchAll(u.Host, u.RequestURI())
+
+	fmt.Fprintf(w, "%s %s\n", strings.ToUpper(method), u.String())
+	if len(matched) == 0 || !op.Enable {
+		fmt.Fprintf(w, "no rule matched\n")
+		return nil
+	}
+	for _, rule := range matched {
+		fmt.Fprintf(w, "%s:%d: host=%s regex=%s priority=%d", rule.File, rule.Line, valueOrDefault(rule.Host, HOST_DEFAULT), rule.Regex, rule.Priority)
+		if rule.Group != "" {
+			fmt.Fprintf(w, " group=%s", rule.Group)
+		}
+		if rule.Stop {
+			fmt.Fprintf(w, " stop")
+		}
+		fmt.Fprintf(w, "\n")
+		for _, a := range rule.GetActions() {
+			fmt.Fprintf(w, "    %s\n", a.String())
+		}
+	}
+	return nil
+}
+
+func (a Action) String() string {
+	switch {
+	case a.Header != "" && a.Value != "":
+		return fmt.Sprintf("%s %s: %s", a.Option, a.Header, a.Value)
+	case a.Header != "":
+		return fmt.Sprintf("%s %s", a.Option, a.Header)
+	case a.Content != "":
+		return fmt.Sprintf("%s %s", a.Option, a.Content)
+	case a.Key != "" || a.Mode != "":
+		return fmt.Sprintf("%s %s %s", a.Option, valueOrDefault(a.Mode, REDIS_LIST), valueOrDefault(a.Key, REDIS_QUEUE))
+	}
+	return a.Option
+}
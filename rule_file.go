@@ -0,0 +1,259 @@
+package cproxy
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	RULE_VERSION_1 = 1
+	RULE_VERSION_2 = 2
+
+	RULE_VERSION_LATEST = RULE_VERSION_2
+)
+
+// RuleFile is the on-disk layout of rule.yml.
+//
+// Version 1 only knows rules with a single option/content. Version 2 moves
+// those into actions and adds include (files or directories of *.yml, relative
+// to the including file) and named groups that can be switched off.
+type RuleFile struct {
+	Version int         `yaml:"version"`
+	Include []string    `yaml:"include,omitempty"`
+	Groups  []RuleGroup `yaml:"groups,omitempty"`
+	Rules   []Rule      `yaml:"rules,omitempty"`
+}
+
+type RuleGroup struct {
+	Name    string `yaml:"name"`
+	Enabled *bool  `yaml:"enabled,omitempty"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+type ruleSet struct {
+	rules  []Rule
+	groups map[string]bool
+	files  []string
+}
+
+func (r *Rule) UnmarshalYAML(n *yaml.Node) error {
+	if err := checkKnownFields(n, reflect.TypeOf(*r)); err != nil {
+		return err
+	}
+	type plain Rule
+	if err := n.Decode((*plain)(r)); err != nil {
+		return err
+	}
+	r.Line = n.Line
+	return nil
+}
+
+func (a *Action) UnmarshalYAML(n *yaml.Node) error {
+	if err := checkKnownFields(n, reflect.TypeOf(*a)); err != nil {
+		return err
+	}
+	type plain Action
+	return n.Decode((*plain)(a))
+}
+
+// checkKnownFields reports keys of mapping n that t has no yaml field for.
+// Node.Decode is never strict, so types with their own UnmarshalYAML check
+// here what the KnownFields decoder would.
+func checkKnownFields(n *yaml.Node, t reflect.Type) error {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	known := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+	var errs []string
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if k := n.Content[i]; !known[k.Value] {
+			errs = append(errs, fmt.Sprintf("line %d: field %s not found in type %s", k.Line, k.Value, t.String()))
+		}
+	}
+	if len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+	return nil
+}
+
+// ReadRuleFile decodes a single rule file strictly. Rules of a version 1 file
+// are returned migrated to the latest version.
+func ReadRuleFile(filePath string) (*RuleFile, error) {
+	cfg, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	out := &RuleFile{}
+	dec := yaml.NewDecoder(bytes.NewReader(cfg))
+	dec.KnownFields(true)
+	if err = dec.Decode(out); err != nil && err != io.EOF {
+		if te, ok := err.(*yaml.TypeError); ok {
+			errs := make(RuleErrors, 0, len(te.Errors))
+			for _, e := range te.Errors {
+				errs = append(errs, fmt.Sprintf("%s: %s", filePath, e))
+			}
+			return nil, errs
+		}
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	if err = out.migrate(filePath); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *RuleFile) migrate(filePath string) error {
+	if f.Version == 0 {
+		f.Version = RULE_VERSION_1
+	}
+	switch f.Version {
+	case RULE_VERSION_1:
+		if len(f.Include) > 0 || len(f.Groups) > 0 {
+			return fmt.Errorf("%s: include and groups need version %d", filePath, RULE_VERSION_2)
+		}
+		for i := range f.Rules {
+			r := &f.Rules[i]
+			if r.Option != "" {
+				r.Actions = append([]Action{{Option: r.Option, Content: r.Content}}, r.Actions...)
+			}
+			r.Option, r.Content = "", ""
+		}
+		f.Version = RULE_VERSION_2
+	case RULE_VERSION_2:
+		var errs RuleErrors
+		f.eachRule(func(r *Rule) {
+			if r.Option != "" || r.Content != "" {
+				errs = append(errs, fmt.Sprintf("%s:%d: option/content are version 1 keys, use actions", filePath, r.Line))
+			}
+		})
+		if len(errs) > 0 {
+			return errs
+		}
+	default:
+		return fmt.Errorf("%s: unknown rule file version %d", filePath, f.Version)
+	}
+	return nil
+}
+
+func (f *RuleFile) eachRule(fn func(r *Rule)) {
+	for i := range f.Rules {
+		fn(&f.Rules[i])
+	}
+	for i := range f.Groups {
+		for j := range f.Groups[i].Rules {
+			fn(&f.Groups[i].Rules[j])
+		}
+	}
+}
+
+// loadRuleSet reads filePath and everything it includes, depth first, in
+// file order.
+func loadRuleSet(filePath string) (*ruleSet, error) {
+	set := &ruleSet{groups: make(map[string]bool)}
+	if err := set.load(filePath, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func (s *ruleSet) load(filePath string, loading map[string]bool) error {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return err
+	}
+	if loading[abs] {
+		return fmt.Errorf("%s: include cycle", filePath)
+	}
+	loading[abs] = true
+	defer delete(loading, abs)
+
+	f, err := ReadRuleFile(filePath)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, filePath)
+
+	for _, inc := range f.Include {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(filePath), inc)
+		}
+		files, err := includeFiles(inc)
+		if err != nil {
+			return fmt.Errorf("%s: include %v", filePath, err)
+		}
+		if len(files) == 0 || files[0] != inc {
+			s.files = append(s.files, inc)
+		}
+		for _, file := range files {
+			if err = s.load(file, loading); err != nil {
+				return err
+			}
+		}
+	}
+
+	f.eachRule(func(r *Rule) { r.File = filePath })
+	s.rules = append(s.rules, f.Rules...)
+	for _, g := range f.Groups {
+		if g.Name == "" {
+			return fmt.Errorf("%s: group without name", filePath)
+		}
+		if _, ok := s.groups[g.Name]; !ok || g.Enabled != nil {
+			s.groups[g.Name] = g.Enabled == nil || *g.Enabled
+		}
+		for _, r := range g.Rules {
+			r.Group = g.Name
+			s.rules = append(s.rules, r)
+		}
+	}
+	return nil
+}
+
+// includeFiles expands an include entry: a file is itself, a directory is
+// its *.yml and *.yaml files in name order.
+func includeFiles(inc string) ([]string, error) {
+	fi, err := os.Stat(inc)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{inc}, nil
+	}
+	entries, err := ioutil.ReadDir(inc)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if !e.IsDir() && (ext == ".yml" || ext == ".yaml") {
+			files = append(files, filepath.Join(inc, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// MigrateRuleFile returns filePath rewritten in the latest schema version.
+// Includes are left as they are.
+func MigrateRuleFile(filePath string) ([]byte, error) {
+	f, err := ReadRuleFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	f.Version = RULE_VERSION_LATEST
+	return yaml.Marshal(f)
+}
@@ -0,0 +1,279 @@
+package cproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckRulesErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		yml  string
+		want []string // in the error, in order
+	}{
+		{"unknown rule key", `
+version: 2
+rules:
+  - host: api.test
+    regx: '.*'
+`, []string{"line 5: field regx not found in type cproxy.Rule"}},
+		{"unknown action key", `
+version: 2
+rules:
+  - regex: '.*'
+    actions:
+      - option: set-response-header
+        hedaer: X-A
+`, []string{"line 7: field hedaer not found in type cproxy.Action"}},
+		{"unknown top key", `
+version: 2
+rule:
+  - regex: '.*'
+`, []string{"field rule not found"}},
+		{"every error at once", `
+version: 2
+rules:
+  - regex: '('
+    actions: [{option: to-stdout}]
+  - regex: '.*'
+    actions: [{option: to-nowhere}]
+  - host: '~['
+    regex: '.*'
+    actions: [{option: use-local-response}]
+  - regex: '.*'
+    actions: [{option: set-request-header}, {option: del-response-header}]
+`, []string{
+			":4: regex:",
+			":6: unknown option \"to-nowhere\"",
+			":8: host:",
+			":8: use-local-response needs content",
+			":11: set-request-header needs header",
+			":11: del-response-header needs header",
+		}},
+		{"fault fields", `
+version: 2
+rules:
+  - regex: '.*'
+    actions: [{option: block, status: 999}, {option: close, probability: 2}, {option: truncate, bytes: -1}]
+`, []string{
+			":4: status 999 out of range",
+			":4: probability must be between 0 and 1",
+			":4: bytes must not be negative",
+		}},
+		{"not yaml", "rules: [", []string{"yaml:"}},
+	} {
+		_, err := CheckRules(writeTemp(t, "rules.yml", test.yml))
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+			continue
+		}
+		msg, at := err.Error(), 0
+		for _, want := range test.want {
+			i := strings.Index(msg[at:], want)
+			if i < 0 {
+				t.Errorf("%s: %q not found in order in\n%s", test.name, want, msg)
+				break
+			}
+			at += i + len(want)
+		}
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	rules, err := CheckRules(writeTemp(t, "rules.yml", `
+version: 2
+rules:
+  - host: '*.api.test'
+    regex: '^/v1/'
+    priority: 5
+    stop: true
+    actions:
+      - option: use-local-response
+        content: /tmp/local.json
+      - option: set-response-header
+        header: Cache-Control
+        value: no-cache
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || len(rules[0].GetActions()) != 2 || !rules[0].Stop || rules[0].Priority != 5 || rules[0].Line != 4 {
+		t.Errorf("got %+v", rules)
+	}
+}
+
+func TestTestRules(t *testing.T) {
+	rules := writeTemp(t, "rules.yml", `
+version: 2
+groups:
+  - name: mock
+    rules:
+      - host: '*.api.test'
+        regex: '^/v1/'
+        stop: true
+        actions:
+          - option: set-response-header
+            header: Cache-Control
+            value: no-cache
+rules:
+  - regex: '.*'
+    actions: [{option: to-stdout}]
+`)
+	var b bytes.Buffer
+	if err := TestRules(&b, rules, "get", "http://v1.api.test/v1/users"); err != nil {
+		t.Fatal(err)
+	}
+	want := `GET http://v1.api.test/v1/users
+` + rules + `:6: host=*.api.test regex=^/v1/ priority=0 group=mock stop
+    set-response-header Cache-Control: no-cache
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+
+	b.Reset()
+	if err := TestRules(&b, rules, "GET", "http://other.test/"); err != nil || !strings.Contains(b.String(), rules+":14: host=default regex=.* priority=0\n    to-stdout\n") {
+		t.Errorf("got %v\n%s", err, b.String())
+	}
+	if err := TestRules(&b, rules, "GET", "/no/host"); err == nil {
+		t.Error("url without host accepted")
+	}
+}
+
+func TestReadRuleFileMigrate(t *testing.T) {
+	v1 := writeTemp(t, "v1.yml", `
+rules:
+  - host: api.test
+    regex: '.*'
+    option: use-local-response
+    content: /tmp/local.json
+    actions:
+      - option: set-response-header
+        header: X-Mock
+        value: "1"
+  - regex: '^/log'
+    option: to-stdout
+`)
+	f, err := ReadRuleFile(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != RULE_VERSION_2 {
+		t.Errorf("version %d, want %d", f.Version, RULE_VERSION_2)
+	}
+	want := [][]string{{OPT_USE_LOCAL_RESPONSE, OPT_SET_RESPONSE_HEADER}, {OPT_TO_STDOUT}}
+	for i, r := range f.Rules {
+		var got []string
+		for _, a := range r.Actions {
+			got = append(got, a.Option)
+		}
+		if r.Option != "" || r.Content != "" || strings.Join(got, " ") != strings.Join(want[i], " ") {
+			t.Errorf("rule %d: option %q content %q actions %v, want actions %v", i, r.Option, r.Content, got, want[i])
+		}
+	}
+	if f.Rules[0].Actions[0].Content != "/tmp/local.json" {
+		t.Errorf("content not moved: %+v", f.Rules[0].Actions[0])
+	}
+
+	// the migrated file reads back as version 2 with the same rules
+	b, err := MigrateRuleFile(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "version: 2\n") || strings.Contains(string(b), "option: use-local-response\n    content") {
+		t.Errorf("migrated file:\n%s", b)
+	}
+	f2, err := ReadRuleFile(writeTemp(t, "v2.yml", string(b)))
+	if err != nil {
+		t.Fatalf("migrated file: %v\n%s", err, b)
+	}
+	if len(f2.Rules) != 2 || len(f2.Rules[0].Actions) != 2 || f2.Rules[0].Actions[1].Value != "1" {
+		t.Errorf("migrated rules %+v", f2.Rules)
+	}
+}
+
+func TestReadRuleFileVersions(t *testing.T) {
+	for _, test := range []struct {
+		name, yml, want string
+	}{
+		{"option in version 2", "version: 2\nrules:\n  - regex: '.*'\n    option: to-stdout\n",
+			":3: option/content are version 1 keys, use actions"},
+		{"option in a group", "version: 2\ngroups:\n  - name: g\n    rules:\n      - regex: '.*'\n        content: x\n",
+			":5: option/content are version 1 keys"},
+		{"include in version 1", "version: 1\ninclude: [other.yml]\n", "include and groups need version 2"},
+		{"groups without version", "groups:\n  - name: g\n", "include and groups need version 2"},
+		{"unknown version", "version: 3\n", "unknown rule file version 3"},
+	} {
+		_, err := ReadRuleFile(writeTemp(t, "rules.yml", test.yml))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestIncludeAndGroups(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, yml string) string {
+		filePath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(yml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filePath
+	}
+	write("rules.d/b.yml", "version: 2\nrules:\n  - regex: '^/b'\n    actions: [{option: to-stdout}]\n")
+	write("rules.d/a.yaml", `version: 2
+groups:
+  - name: mock
+    enabled: false
+    rules:
+      - regex: '^/a'
+        actions: [{option: to-stdout}]
+`)
+	write("rules.d/notes.txt", "not rules")
+	write("v1.yml", "rules:\n  - regex: '^/v1'\n    option: to-stdout\n")
+	main := write("main.yml", `version: 2
+include: [rules.d, v1.yml]
+groups:
+  - name: capture
+    rules:
+      - regex: '^/c'
+        actions: [{option: to-stdout}]
+rules:
+  - regex: '^/main'
+    actions: [{option: to-stdout}]
+`)
+
+	op := NewRuleOperator(main, "")
+	var got []string
+	for _, r := range op.rules {
+		got = append(got, filepath.Base(r.File)+":"+r.Regex+":"+r.Group)
+	}
+	// includes first, a directory in name order, then the file's own groups and rules
+	want := "a.yaml:^/a:mock b.yml:^/b: v1.yml:^/v1: main.yml:^/main: main.yml:^/c:capture"
+	if strings.Join(got, " ") != want {
+		t.Errorf("rules %v, want %s", got, want)
+	}
+	if groups := op.Groups(); groups["mock"] || !groups["capture"] {
+		t.Errorf("groups %v, want mock off and capture on", groups)
+	}
+	if len(op.MatchAll("any.test", "/a")) != 0 {
+		t.Error("rule of a disabled group matched")
+	}
+	op.SetGroup("mock", true)
+	if len(op.MatchAll("any.test", "/a")) != 1 {
+		t.Error("rule of an enabled group did not match")
+	}
+
+	write("loop.yml", "version: 2\ninclude: [main.yml]\n")
+	write("main.yml", "version: 2\ninclude: [loop.yml]\n")
+	if _, err := CheckRules(main); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("cycle: got %v", err)
+	}
+}
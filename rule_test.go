@@ -0,0 +1,135 @@
+package cproxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeTemp(t *testing.T, name, content string) string {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestRuleHost(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"", "any.test", true},
+		{"default", "any.test:8080", true},
+		{"*", "any.test", true},
+		{"api.test", "api.test", true},
+		{"api.test", "API.Test", true},
+		{"api.test", "api.test:8443", true},
+		{"api.test", "xapi.test", false},
+		{"api.test:8443", "api.test:8443", true},
+		{"api.test:8443", "api.test", false},
+		{"api.test:8443", "api.test:443", false},
+		{"*.api.test", "v1.api.test", true},
+		{"*.api.test", "a.b.API.test:443", true},
+		{"*.api.test", "api.test", false},
+		{"api.*", "api.example.com", true},
+		{"api.*", "apix.example.com", false},
+		{"a*i.test", "api.test", true},
+		{"~^api[0-9]+\\.test$", "api12.test", true},
+		{"~^api[0-9]+\\.test$", "api12.test:80", true},
+		{"~^api[0-9]+\\.test$", "api.test", false},
+	} {
+		r := Rule{Host: test.pattern}
+		if err := r.compileHost(); err != nil {
+			t.Fatalf("%s: %v", test.pattern, err)
+		}
+		if got := r.matchHost(test.host); got != test.want {
+			t.Errorf("host %q against %q: %v, want %v", test.host, test.pattern, got, test.want)
+		}
+	}
+
+	r := Rule{Host: "~api[("}
+	if err := r.compileHost(); err == nil {
+		t.Error("bad host regexp compiled")
+	}
+}
+
+func TestMatchAllOrder(t *testing.T) {
+	rules := writeTemp(t, "rules.yml", `version: 2
+rules:
+  - host: default
+    regex: '.*'
+    actions: [{option: to-stdout}]
+  - host: '*.api.test'
+    regex: '.*'
+    actions: [{option: to-stdout}]
+  - host: v1.api.test
+    regex: '^/users'
+    actions: [{option: to-stdout}]
+  - host: '~^v1\.'
+    regex: '.*'
+    actions: [{option: to-stdout}]
+  - host: default
+    regex: '^/admin'
+    priority: 10
+    actions: [{option: to-stdout}]
+  - host: v1.api.test
+    regex: '^/stop'
+    stop: true
+    actions: [{option: to-stdout}]
+`)
+	op := NewRuleOperator(rules, "")
+	for _, test := range []struct {
+		host, uri string
+		want      []int // lines of the matched rules, in order
+	}{
+		// exact host, glob, regexp, then default
+		{"v1.api.test", "/users/1", []int{9, 6, 12, 3}},
+		{"v2.api.test", "/users/1", []int{6, 3}},
+		{"other.test", "/users/1", []int{3}},
+		// priority before host specificity
+		{"v1.api.test", "/admin", []int{15, 6, 12, 3}},
+		// stop ends the walk
+		{"v1.api.test", "/stop", []int{19}},
+	} {
+		var got []int
+		for _, r := range op.MatchAll(test.host, test.uri) {
+			got = append(got, r.Line)
+		}
+		if !equalInts(got, test.want) {
+			t.Errorf("%s%s: matched lines %v, want %v", test.host, test.uri, got, test.want)
+		}
+	}
+
+	if r, ok := op.Match("v1.api.test", "/admin"); !ok || r.Line != 15 {
+		t.Errorf("Match: got line %d %v, want 15", r.Line, ok)
+	}
+}
+
+func TestMatchAllWithoutRules(t *testing.T) {
+	op := NewRuleOperator("", "")
+	if rules := op.MatchAll("any.test", "/"); len(rules) != 1 || rules[0].Option != OPT_TO_STDOUT {
+		t.Errorf("no rules: got %v, want to-stdout", rules)
+	}
+	op = NewRuleOperator("", "^/api/")
+	if rules := op.MatchAll("any.test", "/api/x"); len(rules) != 1 || rules[0].Option != OPT_TO_STDOUT {
+		t.Errorf("filter match: got %v, want to-stdout", rules)
+	}
+	if rules := op.MatchAll("any.test", "/static/x"); len(rules) != 0 {
+		t.Errorf("filter miss: got %v, want none", rules)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,384 @@
+package cproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dop251/goja"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var SCRIPT_TIMEOUT = time.Second
+
+const (
+	HOOK_BEFORE_SEND_REQUEST  = "beforeSendRequest"
+	HOOK_BEFORE_SEND_RESPONSE = "beforeSendResponse"
+	HOOK_ON_WEBSOCKET_MESSAGE = "onWebSocketMessage"
+)
+
+// Senders of a WebSocket frame, as onWebSocketMessage gets them.
+const (
+	WS_FROM_CLIENT = "client"
+	WS_FROM_SERVER = "server"
+)
+
+// Script is a rule script running in its own JavaScript VM. A script exports
+// any of the hooks, either through module.exports or as global functions:
+//
+//	beforeSendRequest(request)                 -> request changes, {response: ...} or nothing
+//	beforeSendResponse(request, response)      -> response changes or nothing
+//	onWebSocketMessage(request, message, from) -> new message, false to drop, or nothing
+//
+// request is {method, url, host, path, headers, body} and response is
+// {statusCode, headers, body}. from is "client" or "server", who sent the
+// WebSocket message. Compressed bodies are handed to the hooks decompressed; a
+// changed body is compressed again as long as the hook keeps the
+// Content-Encoding header. Calls are serialized per script and stopped
+// after the timeout; a throwing or hanging hook only loses its own change.
+type Script struct {
+	Path string
+
+	vm      *goja.Runtime
+	hooks   map[string]goja.Callable
+	modTime time.Time
+	lock    sync.Mutex
+}
+
+var scripts = struct {
+	sync.Mutex
+	m map[string]*Script
+}{m: make(map[string]*Script)}
+
+// LoadScript returns the script at filePath, compiling it again when the file
+// changed since the last load.
+func LoadScript(filePath string) (*Script, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	scripts.Lock()
+	defer scripts.Unlock()
+	if s, ok := scripts.m[filePath]; ok && s.modTime.Equal(fi.ModTime()) {
+		return s, nil
+	}
+	s, err := newScript(filePath)
+	if err != nil {
+		return nil, err
+	}
+	s.modTime = fi.ModTime()
+	scripts.m[filePath] = s
+	return s, nil
+}
+
+func newScript(filePath string) (s *Script, err error) {
+	src, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	prg, err := goja.Compile(filePath, string(src), false)
+	if err != nil {
+		return nil, err
+	}
+	s = &Script{
+		Path:  filePath,
+		vm:    goja.New(),
+		hooks: make(map[string]goja.Callable),
+	}
+	module := s.vm.NewObject()
+	exports := s.vm.NewObject()
+	module.Set("exports", exports)
+	s.vm.Set("module", module)
+	s.vm.Set("exports", exports)
+	console := s.vm.NewObject()
+	console.Set("log", func(call goja.FunctionCall) goja.Value {
+		args := make([]string, 0, len(call.Arguments))
+		for _, a := range call.Arguments {
+			args = append(args, a.String())
+		}
+		scriptLog.Info(strings.Join(args, " "), "script", filePath)
+		return goja.Undefined()
+	})
+	s.vm.Set("console", console)
+
+	timer := time.AfterFunc(SCRIPT_TIMEOUT, func() { s.vm.Interrupt("timeout") })
+	_, err = s.vm.RunProgram(prg)
+	timer.Stop()
+	if err != nil {
+		return nil, err
+	}
+
+	exported := s.vm.Get("module").ToObject(s.vm).Get("exports")
+	for _, name := range []string{HOOK_BEFORE_SEND_REQUEST, HOOK_BEFORE_SEND_RESPONSE, HOOK_ON_WEBSOCKET_MESSAGE} {
+		var fn goja.Value
+		if exported != nil && !goja.IsUndefined(exported) && !goja.IsNull(exported) {
+			fn = exported.ToObject(s.vm).Get(name)
+		}
+		if fn == nil || goja.IsUndefined(fn) {
+			fn = s.vm.Get(name)
+		}
+		if call, ok := goja.AssertFunction(fn); ok {
+			s.hooks[name] = call
+		}
+	}
+	if len(s.hooks) == 0 {
+		return nil, errors.New("script exports no hook")
+	}
+	return s, nil
+}
+
+func (s *Script) Has(hook string) bool {
+	return s.hooks[hook] != nil
+}
+
+// call runs a hook with a deadline. The returned value is already exported
+// to Go; nil means the hook returned nothing.
+func (s *Script) call(hook string, timeout time.Duration, args ...interface{}) (ret interface{}, err error) {
+	fn := s.hooks[hook]
+	if fn == nil {
+		return nil, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s panic: %v", hook, r)
+		}
+	}()
+
+	s.vm.ClearInterrupt()
+	values := make([]goja.Value, 0, len(args))
+	for _, a := range args {
+		values = append(values, s.vm.ToValue(a))
+	}
+	timer := time.AfterFunc(timeout, func() { s.vm.Interrupt("timeout") })
+	v, err := fn(goja.Undefined(), values...)
+	timer.Stop()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", hook, err)
+	}
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return nil, nil
+	}
+	return v.Export(), nil
+}
+
+// BeforeSendRequest lets the script change req in place, or answer it with a
+// response of its own.
+func (s *Script) BeforeSendRequest(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if !s.Has(HOOK_BEFORE_SEND_REQUEST) {
+		return nil, nil
+	}
+	body, err := peekRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	encoding := req.Header.Get("Content-Encoding")
+	body, encoding = decodeScriptBody(encoding, body)
+	ret, err := s.call(HOOK_BEFORE_SEND_REQUEST, timeout, scriptRequest(req, body))
+	if err != nil {
+		return nil, err
+	}
+	m, ok := ret.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	if r, ok := m["response"].(map[string]interface{}); ok {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       emptyBody,
+			Request:    req,
+		}
+		applyScriptResponse(resp, r, "")
+		return resp, nil
+	}
+	if v, ok := m["method"].(string); ok && v != "" {
+		req.Method = v
+	}
+	if v, ok := m["url"].(string); ok && v != "" {
+		if u, err := url.Parse(v); err == nil && u.Host != "" {
+			req.URL = u
+			req.Host = u.Host
+		}
+	}
+	if h, ok := m["headers"].(map[string]interface{}); ok {
+		req.Header = scriptHeader(h)
+	}
+	if v, ok := m["body"].(string); ok {
+		setRequestBody(req, encodeScriptBody(req.Header, encoding, []byte(v)))
+	}
+	return nil, nil
+}
+
+// BeforeSendResponse lets the script change status, headers and body of resp.
+func (s *Script) BeforeSendResponse(req *http.Request, resp *http.Response, timeout time.Duration) error {
+	if !s.Has(HOOK_BEFORE_SEND_RESPONSE) {
+		return nil
+	}
+	reqBody, err := peekRequestBody(req)
+	if err != nil {
+		return err
+	}
+	reqBody, _ = decodeScriptBody(req.Header.Get("Content-Encoding"), reqBody)
+	var body []byte
+	if resp.Body != nil {
+		var save = resp.Body
+		save, resp.Body, err = drainBody(resp.Body)
+		if err != nil {
+			return err
+		}
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body = save
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	body, encoding = decodeScriptBody(encoding, body)
+	ret, err := s.call(HOOK_BEFORE_SEND_RESPONSE, timeout, scriptRequest(req, reqBody), map[string]interface{}{
+		"statusCode": resp.StatusCode,
+		"headers":    flatHeader(resp.Header),
+		"body":       string(body),
+	})
+	if err != nil {
+		return err
+	}
+	if m, ok := ret.(map[string]interface{}); ok {
+		applyScriptResponse(resp, m, encoding)
+	}
+	return nil
+}
+
+// OnWebSocketMessage returns the message to forward and whether to forward
+// it. from is WS_FROM_CLIENT or WS_FROM_SERVER.
+func (s *Script) OnWebSocketMessage(req *http.Request, message []byte, from string, timeout time.Duration) ([]byte, bool, error) {
+	if !s.Has(HOOK_ON_WEBSOCKET_MESSAGE) {
+		return message, true, nil
+	}
+	ret, err := s.call(HOOK_ON_WEBSOCKET_MESSAGE, timeout, scriptRequest(req, nil), string(message), from)
+	if err != nil {
+		return message, true, err
+	}
+	switch v := ret.(type) {
+	case string:
+		return []byte(v), true, nil
+	case bool:
+		return message, v, nil
+	}
+	return message, true, nil
+}
+
+func scriptRequest(req *http.Request, body []byte) map[string]interface{} {
+	u := *req.URL
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	return map[string]interface{}{
+		"method":  req.Method,
+		"url":     u.String(),
+		"host":    req.Host,
+		"path":    req.URL.RequestURI(),
+		"headers": flatHeader(req.Header),
+		"body":    string(body),
+	}
+}
+
+// applyScriptResponse sets what the hook returned on resp. encoding is the
+// content encoding the hook's body is to be compressed with.
+func applyScriptResponse(resp *http.Response, m map[string]interface{}, encoding string) {
+	switch v := m["statusCode"].(type) {
+	case int64:
+		resp.StatusCode = int(v)
+	case float64:
+		resp.StatusCode = int(v)
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	if h, ok := m["headers"].(map[string]interface{}); ok {
+		resp.Header = scriptHeader(h)
+	}
+	if v, ok := m["body"].(string); ok {
+		body := encodeScriptBody(resp.Header, encoding, []byte(v))
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	}
+}
+
+// decodeScriptBody returns the body for a hook and the encoding to put back
+// on a changed body; a body that does not decode is passed as it is.
+func decodeScriptBody(encoding string, body []byte) ([]byte, string) {
+	if len(contentCodings(encoding)) == 0 || len(body) == 0 {
+		return body, ""
+	}
+	decoded, err := DecodeBody(encoding, body)
+	if err != nil {
+		return body, ""
+	}
+	return decoded, encoding
+}
+
+// encodeScriptBody compresses a body changed by a hook with the encoding its
+// original came in, if the header still asks for it, and otherwise drops the
+// Content-Encoding header the body no longer matches.
+func encodeScriptBody(h http.Header, encoding string, body []byte) []byte {
+	if encoding != "" && h.Get("Content-Encoding") == encoding {
+		if encoded, err := EncodeBody(encoding, body); err == nil {
+			return encoded
+		}
+	}
+	h.Del("Content-Encoding")
+	return body
+}
+
+func flatHeader(h http.Header) map[string]interface{} {
+	m := make(map[string]interface{}, len(h))
+	for k, v := range h {
+		if len(v) == 1 {
+			m[k] = v[0]
+		} else {
+			m[k] = append([]string(nil), v...)
+		}
+	}
+	return m
+}
+
+func scriptHeader(m map[string]interface{}) http.Header {
+	h := make(http.Header, len(m))
+	for k, v := range m {
+		switch vv := v.(type) {
+		case []interface{}:
+			for _, s := range vv {
+				h.Add(k, fmt.Sprint(s))
+			}
+		default:
+			h.Set(k, fmt.Sprint(vv))
+		}
+	}
+	return h
+}
+
+func peekRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	save, body, err := drainBody(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = save
+	return ioutil.ReadAll(body)
+}
+
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+	req.ContentLength = int64(len(body))
+	if req.Header.Get("Content-Length") != "" {
+		req.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	}
+}
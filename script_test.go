@@ -0,0 +1,145 @@
+package cproxy
+
+import (
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const wsScript = `
+module.exports = {
+  onWebSocketMessage: function (request, message, from) {
+    if (message === "drop") return false;
+    if (message === "keep") return;
+    return from + ":" + message;
+  }
+};
+`
+
+func TestBeforeSendRequest(t *testing.T) {
+	s, err := LoadScript(writeTemp(t, "req.js", `
+function beforeSendRequest(request) {
+  if (request.path === "/mock") return {response: {statusCode: 201, headers: {"X-Mock": "1"}, body: "mocked"}};
+  return {headers: {"X-Seen": request.method + " " + request.body}};
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "http://api.test/users", strings.NewReader("name=u"))
+	if resp, err := s.BeforeSendRequest(req, SCRIPT_TIMEOUT); err != nil || resp != nil {
+		t.Fatalf("got %v %v, want the request changed", resp, err)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if got := req.Header.Get("X-Seen"); got != "POST name=u" || string(body) != "name=u" {
+		t.Errorf("header %q body %q, want the body read and kept", got, body)
+	}
+
+	resp, err := s.BeforeSendRequest(httptest.NewRequest("GET", "http://api.test/mock", nil), SCRIPT_TIMEOUT)
+	if err != nil || resp == nil {
+		t.Fatalf("got %v %v, want a response", resp, err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 201 || resp.Header.Get("X-Mock") != "1" || string(body) != "mocked" {
+		t.Errorf("got %d %v %q", resp.StatusCode, resp.Header, body)
+	}
+}
+
+func TestBeforeSendResponse(t *testing.T) {
+	s, err := LoadScript(writeTemp(t, "resp.js", `
+module.exports = {
+  beforeSendResponse: function (request, response) {
+    return {statusCode: 418, body: response.body.toUpperCase()};
+  }
+};
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("teapot"))}
+	if err := s.BeforeSendResponse(httptest.NewRequest("GET", "http://api.test/", nil), resp, SCRIPT_TIMEOUT); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 418 || string(body) != "TEAPOT" {
+		t.Errorf("got %d %q, want 418 TEAPOT", resp.StatusCode, body)
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	s, err := LoadScript(writeTemp(t, "loop.js", `function beforeSendRequest(request) { for (;;) {} }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://api.test/", nil)
+	start := time.Now()
+	if _, err := s.BeforeSendRequest(req, 50*time.Millisecond); err == nil {
+		t.Error("endless hook returned no error")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("hook stopped after %v", time.Since(start))
+	}
+	// the script still works after being interrupted
+	if _, _, err := s.OnWebSocketMessage(req, []byte("x"), WS_FROM_CLIENT, SCRIPT_TIMEOUT); err != nil {
+		t.Errorf("after timeout: %v", err)
+	}
+}
+
+func TestOnWebSocketMessage(t *testing.T) {
+	s, err := LoadScript(writeTemp(t, "ws.js", wsScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://ws.test/socket", nil)
+	for _, test := range []struct {
+		message, from string
+		want          string
+		forward       bool
+	}{
+		{"hi", WS_FROM_CLIENT, "client:hi", true},
+		{"hi", WS_FROM_SERVER, "server:hi", true},
+		{"keep", WS_FROM_CLIENT, "keep", true},
+		{"drop", WS_FROM_SERVER, "drop", false},
+	} {
+		got, forward, err := s.OnWebSocketMessage(req, []byte(test.message), test.from, SCRIPT_TIMEOUT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want || forward != test.forward {
+			t.Errorf("%s from %s: got %q %v, want %q %v", test.message, test.from, got, forward, test.want, test.forward)
+		}
+	}
+}
+
+func TestBeforeWsRequestScript(t *testing.T) {
+	script := writeTemp(t, "ws.js", wsScript)
+	rules := writeTemp(t, "rules.yml", `version: 2
+rules:
+  - host: ws.test
+    regex: '^/socket'
+    actions:
+      - option: script
+        content: `+script+`
+`)
+	p := NewProxy("", "", rules, "", "")
+	wsContext := func(req *http.Request) *Context {
+		ctx := newContext(p, "", "ws", req.Host)
+		ctx.Rules = p.Regexp.MatchAll(req.Host, req.URL.RequestURI())
+		return ctx
+	}
+	req := httptest.NewRequest("GET", "http://ws.test/socket", nil)
+	if got, ok := p.BeforeWsRequest(wsContext(req), req, websocket.TextMessage, []byte("hi")); !ok || string(got) != "client:hi" {
+		t.Errorf("got %q %v, want client:hi", got, ok)
+	}
+	if _, ok := p.BeforeWsRequest(wsContext(req), req, websocket.TextMessage, []byte("drop")); ok {
+		t.Error("dropped frame forwarded")
+	}
+	other := httptest.NewRequest("GET", "http://ws.test/other", nil)
+	if got, ok := p.BeforeWsRequest(wsContext(other), other, websocket.TextMessage, []byte("hi")); !ok || string(got) != "hi" {
+		t.Errorf("unmatched frame: got %q %v, want hi", got, ok)
+	}
+}
@@ -0,0 +1,443 @@
+package cproxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS flows (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	time        INTEGER NOT NULL,
+	kind        TEXT NOT NULL,
+	method      TEXT NOT NULL,
+	scheme      TEXT NOT NULL,
+	host        TEXT NOT NULL,
+	path        TEXT NOT NULL,
+	url         TEXT NOT NULL,
+	proto       TEXT NOT NULL,
+	status      INTEGER NOT NULL,
+	req_header  TEXT NOT NULL,
+	resp_header TEXT NOT NULL,
+	req_body    BLOB,
+	resp_body   BLOB,
+	wait        INTEGER NOT NULL,
+	receive     INTEGER NOT NULL,
+	flow_id     TEXT NOT NULL DEFAULT '',
+	client      TEXT NOT NULL DEFAULT '',
+	timings     TEXT NOT NULL DEFAULT '',
+	req_decoded TEXT NOT NULL DEFAULT '',
+	resp_decoded TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS flows_host ON flows(host);
+CREATE INDEX IF NOT EXISTS flows_path ON flows(path);
+CREATE INDEX IF NOT EXISTS flows_status ON flows(status);
+CREATE INDEX IF NOT EXISTS flows_time ON flows(time);
+`
+
+// storeColumns are added to databases created before them.
+var storeColumns = []struct{ name, decl string }{
+	{"flow_id", "TEXT NOT NULL DEFAULT ''"},
+	{"client", "TEXT NOT NULL DEFAULT ''"},
+	{"timings", "TEXT NOT NULL DEFAULT ''"},
+	{"req_decoded", "TEXT NOT NULL DEFAULT ''"},
+	{"resp_decoded", "TEXT NOT NULL DEFAULT ''"},
+}
+
+const (
+	FLOW_HTTP = "http"
+	FLOW_WS   = "ws"
+)
+
+// Store keeps captured flows in a SQLite database. WebSocket frames from the
+// server are stored as kind ws with status 206 and the frame as response body.
+type Store struct {
+	Path string
+
+	db *sql.DB
+}
+
+// StoredFlow is one row of the store.
+type StoredFlow struct {
+	ID         int64
+	FlowID     string
+	ClientAddr string
+	Time       time.Time
+	Kind       string
+	Method     string
+	Scheme     string
+	Host       string
+	Path       string
+	Url        string
+	Proto      string
+	Status     int
+	ReqHeader  http.Header
+	RespHeader http.Header
+	ReqBody    []byte
+	RespBody   []byte
+	Timings    Timings
+
+	ReqDecoded, RespDecoded string // content encodings removed from the bodies
+}
+
+func OpenStore(filePath string) (*Store, error) {
+	db, err := sql.Open("sqlite", filePath)
+	if err != nil {
+		return nil, err
+	}
+	// one writer at a time, SQLite locks the whole file anyway
+	db.SetMaxOpenConns(1)
+	if err := migrateStore(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	return &Store{Path: filePath, db: db}, nil
+}
+
+func migrateStore(db *sql.DB) error {
+	if _, err := db.Exec(storeSchema); err != nil {
+		return err
+	}
+	rows, err := db.Query("SELECT name FROM pragma_table_info('flows')")
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	for _, c := range storeColumns {
+		if !have[c.name] {
+			if _, err := db.Exec("ALTER TABLE flows ADD COLUMN " + c.name + " " + c.decl); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS flows_flow_id ON flows(flow_id)"); err != nil {
+		return err
+	}
+	// version 1 stores hosts lowercased, lower the hosts of older rows once
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version < 1 {
+		if _, err := db.Exec("UPDATE flows SET host = lower(host) WHERE host != lower(host)"); err != nil {
+			return err
+		}
+		if _, err := db.Exec("PRAGMA user_version = 1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) WriteFlow(f *Flow) error {
+	return s.Insert(storedFlowOf(f))
+}
+
+// Insert adds sf to the store and sets its ID. The host is stored
+// lowercased, so that queries on it can use the index.
+func (s *Store) Insert(sf *StoredFlow) error {
+	reqHeader, _ := json.Marshal(sf.ReqHeader)
+	respHeader, _ := json.Marshal(sf.RespHeader)
+	timings, _ := json.Marshal(sf.Timings)
+	res, err := s.db.Exec(`INSERT INTO flows
+		(time, kind, method, scheme, host, path, url, proto, status, req_header, resp_header, req_body, resp_body,
+		wait, receive, flow_id, client, timings, req_decoded, resp_decoded)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sf.Time.UnixNano(), sf.Kind, sf.Method, sf.Scheme, strings.ToLower(sf.Host), sf.Path, sf.Url, sf.Proto, sf.Status,
+		string(reqHeader), string(respHeader), sf.ReqBody, sf.RespBody,
+		msDuration(sf.Timings.Wait), msDuration(sf.Timings.Receive), sf.FlowID, sf.ClientAddr, string(timings),
+		sf.ReqDecoded, sf.RespDecoded)
+	if err != nil {
+		return err
+	}
+	sf.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func storedFlowOf(f *Flow) *StoredFlow {
+	req := f.Request
+	u := *req.URL
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	sf := &StoredFlow{
+		Time:      time.Now(),
+		Kind:      FLOW_WS,
+		Method:    valueOrDefault(req.Method, "GET"),
+		Host:      hostWithoutPort(valueOrDefault(req.Host, u.Host)),
+		Path:      u.Path,
+		Proto:     valueOrDefault(req.Proto, "HTTP/1.1"),
+		Status:    206,
+		ReqHeader: req.Header,
+		ReqBody:   f.RequestBody,
+		RespBody:  f.ResponseBody,
+		Timings:   f.Timings,
+
+		ReqDecoded:  f.RequestDecoded,
+		RespDecoded: f.ResponseDecoded,
+	}
+	if f.Context != nil {
+		sf.Time, sf.Scheme = f.Context.Start, f.Context.Scheme
+		sf.FlowID, sf.ClientAddr = f.Context.ID, f.Context.ClientAddr
+	}
+	if f.Response != nil {
+		sf.Kind = FLOW_HTTP
+		sf.Status = f.Response.StatusCode
+		sf.RespHeader = f.Response.Header
+	}
+	if sf.Scheme == "" {
+		sf.Scheme = valueOrDefault(u.Scheme, "http")
+	}
+	u.Scheme = sf.Scheme
+	sf.Url = u.String()
+	return sf
+}
+
+// Flow returns the stored flow as a Flow, for the HAR export.
+func (sf *StoredFlow) Flow() *Flow {
+	u, err := url.Parse(sf.Url)
+	if err != nil {
+		u = &url.URL{Scheme: sf.Scheme, Host: sf.Host, Path: sf.Path}
+	}
+	f := &Flow{
+		Context:      &Context{ID: sf.FlowID, ClientAddr: sf.ClientAddr, Scheme: sf.Scheme, Host: u.Host, Start: sf.Time},
+		Request:      &http.Request{Method: sf.Method, URL: u, Host: u.Host, Proto: sf.Proto, Header: sf.ReqHeader},
+		RequestBody:  sf.ReqBody,
+		ResponseBody: sf.RespBody,
+		Timings:      sf.Timings,
+
+		RequestDecoded:  sf.ReqDecoded,
+		ResponseDecoded: sf.RespDecoded,
+	}
+	if sf.Kind == FLOW_HTTP {
+		f.Response = &http.Response{StatusCode: sf.Status, Proto: sf.Proto, Header: sf.RespHeader}
+	}
+	return f
+}
+
+// FlowQuery selects stored flows. Conditions are ANDed.
+type FlowQuery struct {
+	where []string
+	args  []interface{}
+	Limit int
+}
+
+var queryOps = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// ParseFlowQuery reads conditions like host=api.* status>=500 since=1h:
+//
+//	host, path, url, method, kind   = or != , * and ? are wildcards, host case-insensitive
+//	flow                            the flow id, = or !=
+//	status, id                      = != > >= < <=
+//	since, until                    a duration back from now, or RFC 3339
+func ParseFlowQuery(args []string) (*FlowQuery, error) {
+	q := &FlowQuery{}
+	for _, arg := range args {
+		key, op, value := splitCondition(arg)
+		if key == "" {
+			return nil, fmt.Errorf("bad condition %q, want key=value", arg)
+		}
+		if err := q.add(key, op, value); err != nil {
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		}
+	}
+	return q, nil
+}
+
+// splitCondition splits a condition at the operator that comes first, the
+// longer one where two start there, so that the value may hold operators of
+// its own: url=*?a!=b.
+func splitCondition(arg string) (key, op, value string) {
+	at := -1
+	for _, o := range queryOps {
+		if i := strings.Index(arg, o); i > 0 && (at < 0 || i < at || i == at && len(o) > len(op)) {
+			at, op = i, o
+		}
+	}
+	if at < 0 {
+		return "", "", ""
+	}
+	return arg[:at], op, arg[at+len(op):]
+}
+
+func (q *FlowQuery) sql() string {
+	query := `SELECT id, time, kind, method, scheme, host, path, url, proto, status,
+		req_header, resp_header, req_body, resp_body, wait, receive, flow_id, client, timings, req_decoded, resp_decoded FROM flows`
+	if len(q.where) > 0 {
+		query += " WHERE " + strings.Join(q.where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	return query
+}
+
+func (q *FlowQuery) add(key, op, value string) error {
+	switch key {
+	case "host", "path", "url", "method", "kind", "flow":
+		if op != "=" && op != "!=" {
+			return fmt.Errorf("%s takes = or !=", key)
+		}
+		column := key
+		switch key {
+		case "flow":
+			column = "flow_id"
+		case "method":
+			value = strings.ToUpper(value)
+		case "host":
+			// host names are case-insensitive, GLOB is not; Insert
+			// lowercases them so that the query can use the index
+			value = strings.ToLower(value)
+		}
+		not := ""
+		if op == "!=" {
+			not = "NOT "
+		}
+		if strings.ContainsAny(value, "*?") {
+			q.where = append(q.where, fmt.Sprintf("%s %sGLOB ?", column, not))
+		} else {
+			q.where = append(q.where, fmt.Sprintf("%s %s ?", column, op))
+		}
+		q.args = append(q.args, value)
+	case "status", "id":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s is not a number", value)
+		}
+		q.where = append(q.where, fmt.Sprintf("%s %s ?", key, op))
+		q.args = append(q.args, n)
+	case "since", "until":
+		if op != "=" {
+			return fmt.Errorf("%s takes =", key)
+		}
+		t, err := parseQueryTime(value)
+		if err != nil {
+			return err
+		}
+		if key == "since" {
+			q.where = append(q.where, "time >= ?")
+		} else {
+			q.where = append(q.where, "time < ?")
+		}
+		q.args = append(q.args, t.UnixNano())
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
+
+func parseQueryTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad time %q, want a duration like 1h or RFC 3339", s)
+}
+
+// Find returns the flows matching q, oldest first. With a limit, the newest
+// flows within the limit are returned.
+func (s *Store) Find(q *FlowQuery) ([]*StoredFlow, error) {
+	rows, err := s.db.Query(q.sql(), q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var flows []*StoredFlow
+	for rows.Next() {
+		var sf StoredFlow
+		var t, wait, receive int64
+		var reqHeader, respHeader, timings string
+		err := rows.Scan(&sf.ID, &t, &sf.Kind, &sf.Method, &sf.Scheme, &sf.Host, &sf.Path, &sf.Url, &sf.Proto, &sf.Status,
+			&reqHeader, &respHeader, &sf.ReqBody, &sf.RespBody, &wait, &receive, &sf.FlowID, &sf.ClientAddr, &timings,
+			&sf.ReqDecoded, &sf.RespDecoded)
+		if err != nil {
+			return nil, err
+		}
+		sf.Time = time.Unix(0, t)
+		if timings == "" || json.Unmarshal([]byte(timings), &sf.Timings) != nil {
+			// stored before the timing phases
+			sf.Timings = noTimings
+			sf.Timings.Wait, sf.Timings.Receive = millis(time.Duration(wait)), millis(time.Duration(receive))
+			sf.Timings.Total = sf.Timings.Wait + sf.Timings.Receive
+		}
+		json.Unmarshal([]byte(reqHeader), &sf.ReqHeader)
+		json.Unmarshal([]byte(respHeader), &sf.RespHeader)
+		flows = append(flows, &sf)
+	}
+	for i, j := 0, len(flows)-1; i < j; i, j = i+1, j-1 {
+		flows[i], flows[j] = flows[j], flows[i]
+	}
+	return flows, rows.Err()
+}
+
+// WriteFlows prints flows in one of the formats:
+//
+//	text   one line per flow
+//	har    a HAR document
+//	curl   one curl command per request
+//	jsonl  one capture record per line, as the JSON sinks write them
+func WriteFlows(w io.Writer, flows []*StoredFlow, format string) error {
+	switch format {
+	case "", "text":
+		for _, sf := range flows {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t%d\n", sf.ID, sf.Time.Format("2006-01-02 15:04:05.000"),
+				sf.Method, sf.Status, sf.Url, msDuration(sf.Timings.Total).Round(time.Millisecond), len(sf.RespBody))
+		}
+	case "har":
+		list := make([]*Flow, 0, len(flows))
+		for _, sf := range flows {
+			list = append(list, sf.Flow())
+		}
+		_, err := WriteHarFlows(w, list)
+		return err
+	case "curl":
+		for _, sf := range flows {
+			if sf.Kind != FLOW_HTTP {
+				continue
+			}
+			fmt.Fprintf(w, "%s\n", sf.Flow().Curl())
+		}
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, sf := range flows {
+			if err := enc.Encode(sf.Flow().Record()); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown format %q, want text, har, curl or jsonl", format)
+	}
+	return nil
+}
+
+func msDuration(ms float64) time.Duration {
+	if ms < 0 {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
@@ -0,0 +1,216 @@
+package cproxy
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recording returns a stored request of rawurl answered with body.
+func recording(method, rawurl, body string) *StoredFlow {
+	u, _ := url.Parse(rawurl)
+	return &StoredFlow{
+		Time:       time.Now(),
+		Kind:       FLOW_HTTP,
+		Method:     method,
+		Scheme:     u.Scheme,
+		Host:       u.Hostname(),
+		Path:       u.Path,
+		Url:        rawurl,
+		Status:     http.StatusOK,
+		ReqHeader:  http.Header{},
+		RespHeader: http.Header{"Content-Type": {"text/plain"}},
+		RespBody:   []byte(body),
+	}
+}
+
+// writeStore writes flows to a new store and returns its path.
+func writeStore(t *testing.T, flows ...*StoredFlow) string {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), "flows.db")
+	s, err := OpenStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, sf := range flows {
+		if err := s.Insert(sf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filePath
+}
+
+func TestParseFlowQuery(t *testing.T) {
+	for _, test := range []struct {
+		arg   string
+		where string
+		arg0  interface{}
+	}{
+		{"host=api.test", "host = ?", "api.test"},
+		{"host=API.*", "host GLOB ?", "api.*"},
+		{"host!=*.CDN.test", "host NOT GLOB ?", "*.cdn.test"},
+		{"path=/v1/*", "path GLOB ?", "/v1/*"},
+		{"method=post", "method = ?", "POST"},
+		{"status>=500", "status >= ?", int64(500)},
+		{"status<=299", "status <= ?", int64(299)},
+		{"status!=200", "status != ?", int64(200)},
+		{"status>399", "status > ?", int64(399)},
+		{"id<10", "id < ?", int64(10)},
+		// the first operator splits, the value keeps its own
+		{"url=*?a!=b", "url GLOB ?", "*?a!=b"},
+		{"url=*?x>=1", "url GLOB ?", "*?x>=1"},
+		{"path!=/a=b", "path != ?", "/a=b"},
+		{"url=*q<=2*", "url GLOB ?", "*q<=2*"},
+	} {
+		q, err := ParseFlowQuery([]string{test.arg})
+		if err != nil {
+			t.Errorf("%s: %v", test.arg, err)
+			continue
+		}
+		if len(q.where) != 1 || q.where[0] != test.where || q.args[0] != test.arg0 {
+			t.Errorf("%s: got %v %v, want [%s] [%v]", test.arg, q.where, q.args, test.where, test.arg0)
+		}
+	}
+}
+
+func TestParseFlowQueryErrors(t *testing.T) {
+	for _, arg := range []string{
+		"host",
+		"=api.test",
+		"color=red",
+		"host>api",
+		"status=5xx",
+		"since>1h",
+		"since=yesterday",
+	} {
+		if _, err := ParseFlowQuery([]string{arg}); err == nil {
+			t.Errorf("%s: no error", arg)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	var flows []*StoredFlow
+	for i, u := range []string{
+		"http://api.test/v1/users?a=1",
+		"http://API.Test/v1/users?a!=b",
+		"https://cdn.test/img.png",
+		"http://api.test/v2/orders",
+	} {
+		sf := recording("GET", u, "")
+		sf.Status = []int{200, 404, 200, 503}[i]
+		flows = append(flows, sf)
+	}
+	s, err := OpenStore(writeStore(t, flows...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, test := range []struct {
+		args  string
+		limit int
+		want  []int // indexes in flows, oldest first
+	}{
+		{"", 0, []int{0, 1, 2, 3}},
+		{"host=api.test", 0, []int{0, 1, 3}},
+		{"host=API.*", 0, []int{0, 1, 3}},
+		{"host!=api.*", 0, []int{2}},
+		{"url=*a!=b", 0, []int{1}},
+		{"status>=400", 0, []int{1, 3}},
+		{"status>=400 host=api.test path=/v1/*", 0, []int{1}},
+		{"", 2, []int{2, 3}},
+	} {
+		var args []string
+		if test.args != "" {
+			args = strings.Fields(test.args)
+		}
+		q, err := ParseFlowQuery(args)
+		if err != nil {
+			t.Fatalf("%s: %v", test.args, err)
+		}
+		q.Limit = test.limit
+		found, err := s.Find(q)
+		if err != nil {
+			t.Fatalf("%s: %v", test.args, err)
+		}
+		var got, want []int64
+		for _, sf := range found {
+			got = append(got, sf.ID)
+		}
+		for _, i := range test.want {
+			want = append(want, flows[i].ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%q limit %d: found %v, want %v", test.args, test.limit, got, want)
+		}
+	}
+}
+
+func TestFindUsesHostIndex(t *testing.T) {
+	s, err := OpenStore(writeStore(t, recording("GET", "http://API.test/", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, arg := range []string{"host=API.test", "host=api.*"} {
+		q, err := ParseFlowQuery([]string{arg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Limit = 10
+		rows, err := s.db.Query("EXPLAIN QUERY PLAN "+q.sql(), q.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan []string
+		for rows.Next() {
+			var id, parent, notused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+				t.Fatal(err)
+			}
+			plan = append(plan, detail)
+		}
+		rows.Close()
+		if !strings.Contains(strings.Join(plan, "; "), "INDEX flows_host") {
+			t.Errorf("%s: plan %q does not use flows_host", arg, plan)
+		}
+		if found, err := s.Find(q); err != nil || len(found) != 1 {
+			t.Errorf("%s: found %d %v, want 1", arg, len(found), err)
+		}
+	}
+}
+
+func TestStoreLowersOldHosts(t *testing.T) {
+	filePath := writeStore(t)
+	db, err := sql.Open("sqlite", filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO flows (time, kind, method, scheme, host, path, url, proto, status, req_header, resp_header, wait, receive)
+		VALUES (0, 'http', 'GET', 'http', 'Old.Test', '/', 'http://Old.Test/', 'HTTP/1.1', 200, '{}', '{}', 0, 0)`)
+	if err == nil {
+		_, err = db.Exec("PRAGMA user_version = 0")
+	}
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	q, _ := ParseFlowQuery([]string{"host=old.test"})
+	if found, err := s.Find(q); err != nil || len(found) != 1 || found[0].Host != "old.test" {
+		t.Errorf("found %v %v, want the old row with host old.test", found, err)
+	}
+}
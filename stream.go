@@ -0,0 +1,318 @@
+package cproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// STREAM_PING is how often an idle stream sends a keep-alive.
+var STREAM_PING = 15 * time.Second
+
+// streamUpgrader takes the WebSocket handshakes of the admin stream. Unlike
+// the upgrader of the proxied connections it refuses other origins, as a
+// page on any site could otherwise read every flow through the browser.
+var streamUpgrader = &websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     sameOrigin,
+}
+
+// sameOrigin reports whether r comes from a page of the admin itself, or
+// from a client that sends no Origin, as curl and the tail command do.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// FlowFilter selects the flows of a stream. Empty fields select everything,
+// and a flow has to pass every field that is set. ParseFlowFilter makes one.
+type FlowFilter struct {
+	Host   []string // patterns, * and ? are wildcards, case-insensitive
+	Path   []string // patterns on the path without the query
+	Method []string
+	Kind   string // FLOW_HTTP or FLOW_WS
+	Status string // 404, 4xx, >=500, !=200 ...; frames have no status
+
+	host, path *regexp.Regexp
+	status     func(int) bool
+}
+
+// ParseFlowFilter reads a filter from the parameters host, path and method,
+// each a comma separated list, kind and status.
+func ParseFlowFilter(v url.Values) (*FlowFilter, error) {
+	ff := &FlowFilter{
+		Host:   splitPatterns(v.Get("host")),
+		Path:   splitPatterns(v.Get("path")),
+		Method: splitPatterns(strings.ToUpper(v.Get("method"))),
+		Kind:   v.Get("kind"),
+		Status: v.Get("status"),
+	}
+	if err := ff.compile(); err != nil {
+		return nil, err
+	}
+	return ff, nil
+}
+
+func (ff *FlowFilter) compile() error {
+	switch ff.Kind {
+	case "", FLOW_HTTP, FLOW_WS:
+	default:
+		return fmt.Errorf("kind must be %s or %s", FLOW_HTTP, FLOW_WS)
+	}
+	ff.host, ff.path = globRegexp(ff.Host, true), globRegexp(ff.Path, false)
+	if ff.Status == "" {
+		return nil
+	}
+	var err error
+	ff.status, err = parseStatusCondition(ff.Status)
+	return err
+}
+
+// Match reports whether the filter selects the flow.
+func (ff *FlowFilter) Match(f *Flow) bool {
+	kind := FLOW_HTTP
+	if f.Response == nil {
+		kind = FLOW_WS
+	}
+	if ff.Kind != "" && ff.Kind != kind {
+		return false
+	}
+	host := f.Request.Host
+	if host == "" {
+		host = f.Request.URL.Host
+	}
+	if ff.host != nil && !ff.host.MatchString(host) && !ff.host.MatchString(hostWithoutPort(host)) {
+		return false
+	}
+	if ff.path != nil && !ff.path.MatchString(f.Request.URL.Path) {
+		return false
+	}
+	if len(ff.Method) > 0 && !containsString(ff.Method, valueOrDefault(f.Request.Method, "GET")) {
+		return false
+	}
+	if ff.status != nil && (f.Response == nil || !ff.status(f.Response.StatusCode)) {
+		return false
+	}
+	return true
+}
+
+func splitPatterns(list string) []string {
+	var patterns []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// globRegexp turns patterns into one regexp where * matches any run of
+// characters, / included, and ? any one character, as in query conditions.
+func globRegexp(patterns []string, fold bool) *regexp.Regexp {
+	if len(patterns) == 0 {
+		return nil
+	}
+	alternatives := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		quoted := regexp.QuoteMeta(p)
+		quoted = strings.Replace(quoted, `\*`, ".*", -1)
+		quoted = strings.Replace(quoted, `\?`, ".", -1)
+		alternatives = append(alternatives, quoted)
+	}
+	expr := "^(?:" + strings.Join(alternatives, "|") + ")$"
+	if fold {
+		expr = "(?i)" + expr
+	}
+	return regexp.MustCompile(expr)
+}
+
+// parseStatusCondition reads 404, 4xx, or a comparison like >=500.
+func parseStatusCondition(cond string) (func(int) bool, error) {
+	if len(cond) == 3 && strings.HasSuffix(strings.ToLower(cond), "xx") && cond[0] >= '1' && cond[0] <= '5' {
+		class := int(cond[0]-'0') * 100
+		return func(s int) bool { return s >= class && s < class+100 }, nil
+	}
+	op, value := "=", cond
+	for _, o := range queryOps {
+		if strings.HasPrefix(cond, o) {
+			op, value = o, cond[len(o):]
+			break
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("status %q, want 404, 4xx or a comparison like >=500", cond)
+	}
+	switch op {
+	case ">=":
+		return func(s int) bool { return s >= n }, nil
+	case "<=":
+		return func(s int) bool { return s <= n }, nil
+	case "!=":
+		return func(s int) bool { return s != n }, nil
+	case ">":
+		return func(s int) bool { return s > n }, nil
+	case "<":
+		return func(s int) bool { return s < n }, nil
+	}
+	return func(s int) bool { return s == n }, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stream sends the flows as they happen, as server-sent events or, to a
+// WebSocket handshake, one text message per flow. Each event is a capture
+// record with its seq; bodies are left out unless bodies=1. An SSE client
+// that reconnects with Last-Event-ID, or one that sets after=, first gets
+// the kept flows it missed.
+func (a *Admin) stream(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) || !a.keepsFlows(w) {
+		return
+	}
+	ff, err := ParseFlowFilter(r.URL.Query())
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	bodies, _ := strconv.ParseBool(r.FormValue("bodies"))
+	after, _ := strconv.ParseUint(valueOrDefault(r.Header.Get("Last-Event-ID"), r.FormValue("after")), 10, 64)
+
+	var send func(adminFlow) error
+	var ping func() error
+	done := r.Context().Done()
+	if IsWebSocketRequest(r) {
+		conn, err := streamUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		closed := make(chan struct{})
+		done = closed
+		go func() {
+			// the client sends nothing but the close
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		send = func(af adminFlow) error {
+			return conn.WriteJSON(af)
+		}
+		ping = func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(STREAM_PING))
+		}
+	} else {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			adminError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		send = func(af adminFlow) error {
+			b, err := json.Marshal(af)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: flow\ndata: %s\n\n", af.Seq, b); err == nil {
+				flusher.Flush()
+			}
+			return err
+		}
+		ping = func() error {
+			_, err := io.WriteString(w, ": ping\n\n")
+			flusher.Flush()
+			return err
+		}
+	}
+
+	backlog, flows, cancel := a.Proxy.Recent.Subscribe(after)
+	defer cancel()
+	for _, rf := range backlog {
+		if ff.Match(rf.Flow) {
+			if send(adminRecord(rf, bodies)) != nil {
+				return
+			}
+		}
+	}
+	ticker := time.NewTicker(STREAM_PING)
+	defer ticker.Stop()
+	for {
+		select {
+		case rf, ok := <-flows:
+			if !ok {
+				// fell behind; an SSE client comes back with Last-Event-ID
+				return
+			}
+			if ff.Match(rf.Flow) {
+				if send(adminRecord(rf, bodies)) != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			if ping() != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// ReadStream reads the server-sent events of the admin stream and calls fn
+// with each flow and its seq, until the stream ends or fn returns an error.
+func ReadStream(r io.Reader, fn func(seq uint64, f *Flow) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+	var seq uint64
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			f, err := DecodeRecord([]byte(data.String()))
+			data.Reset()
+			if err != nil {
+				return err
+			}
+			if err = fn(seq, f); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "id:"):
+			seq, _ = strconv.ParseUint(strings.TrimSpace(line[3:]), 10, 64)
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(line[5:], " "))
+		}
+	}
+	return scanner.Err()
+}
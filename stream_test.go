@@ -0,0 +1,215 @@
+package cproxy
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamFlow returns an exchange answered with status, or a WebSocket frame
+// for status 0.
+func streamFlow(method, rawurl string, status int) *Flow {
+	f := &Flow{Context: &Context{ID: "f"}, Request: httptest.NewRequest(method, rawurl, nil)}
+	if status > 0 {
+		f.Response = &http.Response{StatusCode: status, Header: http.Header{}}
+	}
+	return f
+}
+
+func TestFlowFilter(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		flow   *Flow
+		want   bool
+	}{
+		{"", streamFlow("GET", "http://api.test/a", 200), true},
+		{"host=API.test", streamFlow("GET", "http://api.test/a", 200), true},
+		{"host=api.test", streamFlow("GET", "http://api.test:8080/a", 200), true},
+		{"host=*.test,other", streamFlow("GET", "http://www.api.test/a", 200), true},
+		{"host=other", streamFlow("GET", "http://api.test/a", 200), false},
+		{"path=/v1/*", streamFlow("GET", "http://api.test/v1/users/1?q=1", 200), true},
+		{"path=/v1/?", streamFlow("GET", "http://api.test/v1/ab", 200), false},
+		{"method=post,put", streamFlow("PUT", "http://api.test/a", 200), true},
+		{"method=post", streamFlow("GET", "http://api.test/a", 200), false},
+		{"kind=ws", streamFlow("GET", "http://api.test/a", 0), true},
+		{"kind=ws", streamFlow("GET", "http://api.test/a", 200), false},
+		{"status=404", streamFlow("GET", "http://api.test/a", 404), true},
+		{"status=4xx", streamFlow("GET", "http://api.test/a", 499), true},
+		{"status=4xx", streamFlow("GET", "http://api.test/a", 500), false},
+		{"status=>=500", streamFlow("GET", "http://api.test/a", 503), true},
+		{"status=!=200", streamFlow("GET", "http://api.test/a", 200), false},
+		{"status=<300", streamFlow("GET", "http://api.test/a", 0), false},
+		{"host=api.test&status=2xx", streamFlow("GET", "http://api.test/a", 404), false},
+	} {
+		v, _ := url.ParseQuery(test.filter)
+		ff, err := ParseFlowFilter(v)
+		if err != nil {
+			t.Fatalf("%s: %v", test.filter, err)
+		}
+		if got := ff.Match(test.flow); got != test.want {
+			t.Errorf("%s on %s: %v, want %v", test.filter, test.flow.Request.URL, got, test.want)
+		}
+	}
+}
+
+func TestParseFlowFilterErrors(t *testing.T) {
+	for _, filter := range []string{"kind=tcp", "status=abc", "status=>=x", "status=6xx"} {
+		v, _ := url.ParseQuery(filter)
+		if _, err := ParseFlowFilter(v); err == nil {
+			t.Errorf("%s: no error", filter)
+		}
+	}
+}
+
+func seqs(flows []RecentFlow) string {
+	var s []string
+	for _, rf := range flows {
+		s = append(s, fmt.Sprint(rf.Seq))
+	}
+	return strings.Join(s, " ")
+}
+
+func TestFlowBuffer(t *testing.T) {
+	b := NewFlowBuffer(3)
+	for i := 0; i < 5; i++ {
+		b.WriteFlow(streamFlow("GET", "http://api.test/a", 200))
+	}
+	for _, test := range []struct {
+		after uint64
+		n     int
+		want  string
+	}{
+		{0, 0, "3 4 5"},
+		{0, 2, "4 5"},
+		{3, 0, "4 5"},
+		{1, 1, "3"},
+		{5, 0, ""},
+	} {
+		if got := seqs(b.Flows(test.after, test.n)); got != test.want {
+			t.Errorf("after %d n %d: %q, want %q", test.after, test.n, got, test.want)
+		}
+	}
+
+	backlog, flows, cancel := b.Subscribe(4)
+	if seqs(backlog) != "5" {
+		t.Errorf("backlog %q", seqs(backlog))
+	}
+	b.WriteFlow(streamFlow("GET", "http://api.test/a", 200))
+	if rf := <-flows; rf.Seq != 6 {
+		t.Errorf("got %d, want 6", rf.Seq)
+	}
+	cancel()
+	if _, ok := <-flows; ok {
+		t.Error("channel open after cancel")
+	}
+	cancel()
+}
+
+func TestFlowBufferSlowSubscriber(t *testing.T) {
+	defer func(n int) { SUBSCRIBER_QUEUE = n }(SUBSCRIBER_QUEUE)
+	SUBSCRIBER_QUEUE = 2
+	b := NewFlowBuffer(10)
+	_, flows, cancel := b.Subscribe(0)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		b.WriteFlow(streamFlow("GET", "http://api.test/a", 200))
+	}
+	n := 0
+	for range flows {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("got %d flows before the cut, want 2", n)
+	}
+}
+
+// streamAdmin serves the admin API of a proxy keeping the flows.
+func streamAdmin(t *testing.T) (*Proxy, *httptest.Server) {
+	p := NewProxy("", "", "", "", "")
+	p.Recent = NewFlowBuffer(10)
+	srv := httptest.NewServer(NewAdmin(p))
+	t.Cleanup(srv.Close)
+	return p, srv
+}
+
+func TestStreamResume(t *testing.T) {
+	p, srv := streamAdmin(t)
+	p.Recent.WriteFlow(streamFlow("GET", "http://api.test/a/1", 200))
+	p.Recent.WriteFlow(streamFlow("GET", "http://api.test/b", 200))
+	p.Recent.WriteFlow(streamFlow("GET", "http://api.test/a/3", 200))
+	p.Recent.WriteFlow(streamFlow("GET", "http://api.test/a/4", 200))
+
+	// the client got flow 1 before it lost the connection
+	req, _ := http.NewRequest("GET", srv.URL+"/api/stream?path=/a/*", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	var got []string
+	done := make(chan error, 1)
+	go func() {
+		done <- ReadStream(resp.Body, func(seq uint64, f *Flow) error {
+			got = append(got, fmt.Sprint(seq, " ", f.Request.URL.Path))
+			if len(got) == 3 {
+				return fmt.Errorf("enough")
+			}
+			return nil
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	p.Recent.WriteFlow(streamFlow("GET", "http://api.test/b", 200))
+	p.Recent.WriteFlow(streamFlow("GET", "http://api.test/a/6", 200))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream stalled")
+	}
+	if want := "3 /a/3,4 /a/4,6 /a/6"; strings.Join(got, ",") != want {
+		t.Errorf("got %q, want %q", strings.Join(got, ","), want)
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	p, srv := streamAdmin(t)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/stream?kind=ws&bodies=1&after=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	p.Recent.WriteFlow(streamFlow("GET", "http://api.test/a", 200))
+	frame := streamFlow("GET", "http://api.test/ws", 0)
+	frame.ResponseBody = []byte("hi")
+	p.Recent.WriteFlow(frame)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var af adminFlow
+	if err := conn.ReadJSON(&af); err != nil {
+		t.Fatal(err)
+	}
+	if af.Seq != 2 || af.Kind != FLOW_WS || af.Frame == nil || string(af.Frame.Data) != "hi" {
+		t.Errorf("got %+v", af)
+	}
+}
+
+func TestStreamBadFilter(t *testing.T) {
+	_, srv := streamAdmin(t)
+	resp, err := http.Get(srv.URL + "/api/stream?status=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,292 @@
+package cproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Throttle slows a flow down. Up and Down are bytes per second, 0 means
+// unlimited. Latency, plus a random part of Jitter, is added once per
+// request, per WebSocket frame and per CONNECT tunnel.
+type Throttle struct {
+	Latency time.Duration
+	Jitter  time.Duration
+	Up      int64
+	Down    int64
+}
+
+// ThrottlePresets are named link profiles, close to the browser devtools ones.
+var ThrottlePresets = map[string]Throttle{
+	"gprs": {Latency: 500 * time.Millisecond, Up: 20000 / 8, Down: 50000 / 8},
+	"edge": {Latency: 400 * time.Millisecond, Jitter: 100 * time.Millisecond, Up: 200000 / 8, Down: 240000 / 8},
+	"2g":   {Latency: 300 * time.Millisecond, Jitter: 50 * time.Millisecond, Up: 50000 / 8, Down: 250000 / 8},
+	"3g":   {Latency: 100 * time.Millisecond, Jitter: 30 * time.Millisecond, Up: 330000 / 8, Down: 780000 / 8},
+	"4g":   {Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond, Up: 3000000 / 8, Down: 4000000 / 8},
+	"dsl":  {Latency: 5 * time.Millisecond, Up: 1000000 / 8, Down: 2000000 / 8},
+}
+
+// ParseThrottle reads a preset name and/or key=value settings separated by
+// commas, e.g. "3g", "latency=200ms,jitter=50ms,down=64k,up=32k" or
+// "edge,latency=1s". Rates take k and m suffixes (bytes per second).
+func ParseThrottle(s string) (*Throttle, error) {
+	t := &Throttle{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 1 {
+			preset, ok := ThrottlePresets[strings.ToLower(part)]
+			if !ok {
+				return nil, fmt.Errorf("unknown throttle preset %q", part)
+			}
+			*t = preset
+			continue
+		}
+		if err := t.set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *Throttle) set(key, value string) (err error) {
+	switch key {
+	case "latency":
+		t.Latency, err = time.ParseDuration(value)
+	case "jitter":
+		t.Jitter, err = time.ParseDuration(value)
+	case "up":
+		t.Up, err = parseRate(value)
+	case "down":
+		t.Down, err = parseRate(value)
+	default:
+		return fmt.Errorf("unknown throttle setting %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("throttle %s: %v", key, err)
+	}
+	return nil
+}
+
+func parseRate(s string) (int64, error) {
+	mul := int64(1)
+	switch {
+	case strings.HasSuffix(strings.ToLower(s), "k"):
+		mul, s = 1024, s[:len(s)-1]
+	case strings.HasSuffix(strings.ToLower(s), "m"):
+		mul, s = 1024*1024, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad rate %q", s)
+	}
+	return n * mul, nil
+}
+
+// throttle builds the Throttle of a throttle action: the preset first, then
+// the single settings on top of it.
+func (a *Action) throttle() (*Throttle, error) {
+	t := &Throttle{}
+	if a.Preset != "" {
+		preset, ok := ThrottlePresets[strings.ToLower(a.Preset)]
+		if !ok {
+			return nil, fmt.Errorf("unknown throttle preset %q", a.Preset)
+		}
+		*t = preset
+	}
+	for _, kv := range [][2]string{{"latency", a.Latency}, {"jitter", a.Jitter}, {"up", a.Up}, {"down", a.Down}} {
+		if kv[1] == "" {
+			continue
+		}
+		if err := t.set(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Delay sleeps for the latency and a random part of the jitter.
+func (t *Throttle) Delay() {
+	if t == nil {
+		return
+	}
+	d := t.Latency
+	if t.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(t.Jitter)))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// flowThrottle returns the throttle of the flow: the last throttle action of
+// the matched rules, else the global one for flows not already throttled as
+// a whole CONNECT tunnel.
+func (p *Proxy) flowThrottle(ctx *Context) *Throttle {
+	var t *Throttle
+	for _, rule := range ctx.Rules {
+		for _, a := range rule.GetActions() {
+			if a.Option != OPT_THROTTLE || !a.fire() {
+				continue
+			}
+			if rt, err := a.throttle(); err == nil {
+				t = rt
+			}
+		}
+	}
+	if t == nil && !ctx.tunneled {
+		t = p.Throttle
+	}
+	return t
+}
+
+// limiter spaces out bytes so that at most rate bytes pass per second.
+type limiter struct {
+	rate  int64
+	start time.Time
+	n     int64
+	lock  sync.Mutex
+}
+
+func newLimiter(rate int64) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &limiter{rate: rate, start: time.Now()}
+}
+
+// chunk is the largest piece passed at once, a tenth of a second worth.
+func (l *limiter) chunk() int {
+	if c := l.rate / 10; c > 0 {
+		return int(c)
+	}
+	return 1
+}
+
+func (l *limiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	l.n += int64(n)
+	due := l.start.Add(time.Duration(float64(l.n) / float64(l.rate) * float64(time.Second)))
+	l.lock.Unlock()
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	l *limiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if c := r.l.chunk(); len(p) > c {
+		p = p[:c]
+	}
+	n, err := r.r.Read(p)
+	r.l.wait(n)
+	return n, err
+}
+
+type throttledReadCloser struct {
+	throttledReader
+	c io.Closer
+}
+
+func (r *throttledReadCloser) Close() error {
+	return r.c.Close()
+}
+
+func throttleReadCloser(rc io.ReadCloser, rate int64) io.ReadCloser {
+	l := newLimiter(rate)
+	if l == nil || rc == nil || rc == http.NoBody {
+		return rc
+	}
+	return &throttledReadCloser{throttledReader{rc, l}, rc}
+}
+
+func throttledWrite(w io.Writer, l *limiter, p []byte) (n int, err error) {
+	for len(p) > 0 {
+		c := l.chunk()
+		if c > len(p) {
+			c = len(p)
+		}
+		m, err := w.Write(p[:c])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		l.wait(m)
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// throttledResponseWriter limits what is written to the client. It keeps the
+// Hijacker of the wrapped writer for fault injection.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	l *limiter
+}
+
+func throttleResponseWriter(w http.ResponseWriter, rate int64) http.ResponseWriter {
+	l := newLimiter(rate)
+	if l == nil {
+		return w
+	}
+	return &throttledResponseWriter{w, l}
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	return throttledWrite(w.ResponseWriter, w.l, p)
+}
+
+func (w *throttledResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *throttledResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// copyThrottled copies src to dst at no more than rate bytes per second.
+func copyThrottled(dst io.Writer, src io.Reader, rate int64) (int64, error) {
+	if l := newLimiter(rate); l != nil {
+		src = &throttledReader{src, l}
+	}
+	return io.Copy(dst, src)
+}
+
+func (t *Throttle) up() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Up
+}
+
+func (t *Throttle) down() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Down
+}
@@ -0,0 +1,120 @@
+package cproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseThrottle(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want Throttle
+	}{
+		{"", Throttle{}},
+		{"3g", ThrottlePresets["3g"]},
+		{"EDGE", ThrottlePresets["edge"]},
+		{"latency=200ms,jitter=50ms", Throttle{Latency: 200 * time.Millisecond, Jitter: 50 * time.Millisecond}},
+		{"down=64k, up=32K", Throttle{Down: 64 * 1024, Up: 32 * 1024}},
+		{"down=2m,up=100", Throttle{Down: 2 * 1024 * 1024, Up: 100}},
+		{"down=0", Throttle{}},
+		// settings after a preset change only themselves
+		{"dsl,latency=1s", Throttle{Latency: time.Second, Up: 1000000 / 8, Down: 2000000 / 8}},
+	} {
+		got, err := ParseThrottle(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if *got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.in, *got, test.want)
+		}
+	}
+}
+
+func TestParseThrottleErrors(t *testing.T) {
+	for _, in := range []string{
+		"5g",
+		"latency=soon",
+		"jitter=-",
+		"down=fast",
+		"down=-1k",
+		"up=1g",
+		"down=k",
+		"speed=1k",
+	} {
+		if got, err := ParseThrottle(in); err == nil {
+			t.Errorf("%q: got %+v, want an error", in, *got)
+		}
+	}
+}
+
+func TestActionThrottle(t *testing.T) {
+	a := Action{Option: OPT_THROTTLE, Preset: "4g", Down: "1k"}
+	got, err := a.throttle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ThrottlePresets["4g"]
+	want.Down = 1024
+	if *got != want {
+		t.Errorf("got %+v, want %+v", *got, want)
+	}
+	for _, a := range []Action{{Preset: "9g"}, {Latency: "later"}, {Up: "1x"}} {
+		if _, err := a.throttle(); err == nil {
+			t.Errorf("%+v: no error", a)
+		}
+	}
+}
+
+func TestNewLimiter(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		if newLimiter(rate) != nil {
+			t.Errorf("rate %d: got a limiter, want none", rate)
+		}
+	}
+	for _, test := range []struct {
+		rate  int64
+		chunk int
+	}{
+		{1, 1},
+		{9, 1},
+		{10240, 1024},
+	} {
+		if got := newLimiter(test.rate).chunk(); got != test.chunk {
+			t.Errorf("rate %d: chunk %d, want %d", test.rate, got, test.chunk)
+		}
+	}
+}
+
+func TestLimiterCapsThroughput(t *testing.T) {
+	const rate = 20 * 1024
+	data := bytes.Repeat([]byte("x"), rate/2) // half a second worth
+
+	start := time.Now()
+	got, err := ioutil.ReadAll(throttleReadCloser(ioutil.NopCloser(bytes.NewReader(data)), rate))
+	elapsed := time.Since(start)
+	if err != nil || len(got) != len(data) {
+		t.Fatalf("read %d bytes %v, want %d", len(got), err, len(data))
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("read: %d bytes at %d B/s took %v, want about 500ms", len(data), rate, elapsed)
+	}
+
+	var b bytes.Buffer
+	start = time.Now()
+	if n, err := throttledWrite(&b, newLimiter(rate), data); err != nil || n != len(data) {
+		t.Fatalf("wrote %d bytes %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("write: %d bytes at %d B/s took %v, want about 500ms", len(data), rate, elapsed)
+	}
+
+	// no rate, no limit
+	start = time.Now()
+	var sink bytes.Buffer
+	if _, err := copyThrottled(&sink, bytes.NewReader(data), 0); err != nil || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("unthrottled copy took %v, %v", time.Since(start), err)
+	}
+}
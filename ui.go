@@ -0,0 +1,21 @@
+package cproxy
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles is the web UI, a single page on top of the admin API.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiHandler serves the web UI at the root of the admin port.
+func uiHandler() http.Handler {
+	root, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(root))
+}
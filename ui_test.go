@@ -0,0 +1,143 @@
+package cproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// adminGet gets path from the admin server and returns the status, the
+// header and the body.
+func adminGet(t *testing.T, url string) (int, http.Header, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header, string(b)
+}
+
+func TestUIServed(t *testing.T) {
+	_, srv := streamAdmin(t)
+	status, h, page := adminGet(t, srv.URL+"/")
+	if status != http.StatusOK || !strings.HasPrefix(h.Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d, Content-Type %q", status, h.Get("Content-Type"))
+	}
+	// every path the page calls is served by the admin API
+	calls := regexp.MustCompile(`api\("([^"]+)"`).FindAllStringSubmatch(page, -1)
+	if len(calls) == 0 {
+		t.Fatal("no API calls in the page")
+	}
+	for _, call := range calls {
+		path := call[1]
+		if strings.HasSuffix(path, "/") {
+			path += "missing"
+		}
+		if path == "api/stream" {
+			// answered by a stream that does not end
+			continue
+		}
+		if status, _, body := adminGet(t, srv.URL+"/"+path); status == http.StatusNotFound && !strings.Contains(body, "no recent flow") {
+			t.Errorf("%s: not served", call[1])
+		}
+	}
+}
+
+func TestAdminFlowRecords(t *testing.T) {
+	p, srv := streamAdmin(t)
+	f := streamFlow("POST", "http://api.test/v1/users?a=1", 201)
+	f.Context.ID = "h1"
+	f.Request.Header.Set("Content-Encoding", "gzip")
+	f.RequestBody, f.RequestDecoded = []byte("name=u"), "gzip"
+	f.Response.Header.Set("Content-Type", "text/plain")
+	f.ResponseBody = []byte("created")
+	f.Timings = Timings{-1, -1, -1, 1, 2, 3, 4, 7}
+	p.Recent.WriteFlow(f)
+	frame := streamFlow("GET", "http://api.test/ws", 0)
+	frame.Context.ID, frame.ResponseBody = "w1", []byte("hi")
+	p.Recent.WriteFlow(frame)
+
+	// the fields the page reads, without the bodies for the list
+	status, _, body := adminGet(t, srv.URL+"/api/flows?limit=1000&bodies=0")
+	var list []map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &list); err != nil || status != http.StatusOK || len(list) != 2 {
+		t.Fatalf("status %d %v: %s", status, err, body)
+	}
+	rec := list[0]
+	request, _ := rec["request"].(map[string]interface{})
+	response, _ := rec["response"].(map[string]interface{})
+	timings, _ := rec["timings"].(map[string]interface{})
+	if rec["seq"] != 1.0 || rec["id"] != "h1" || rec["kind"] != FLOW_HTTP || rec["time"] == nil ||
+		request["method"] != "POST" || request["url"] != "http://api.test/v1/users?a=1" ||
+		response["status"] != 201.0 || response["headers"] == nil || timings["total"] != 7.0 {
+		t.Errorf("record %s", body)
+	}
+	if request["body"] != nil || response["body"] != nil {
+		t.Errorf("bodies listed: %s", body)
+	}
+	if list[1]["kind"] != FLOW_WS || list[1]["frame"] == nil {
+		t.Errorf("frame %s", body)
+	}
+
+	// one flow comes with its bodies
+	_, _, body = adminGet(t, srv.URL+"/api/flows/h1")
+	var one []adminFlow
+	if err := json.Unmarshal([]byte(body), &one); err != nil || len(one) != 1 || string(one[0].Response.Body) != "created" {
+		t.Errorf("flow %s: %v", body, err)
+	}
+	_, _, body = adminGet(t, srv.URL+"/api/flows/w1")
+	if err := json.Unmarshal([]byte(body), &one); err != nil || len(one) != 1 || string(one[0].Frame.Data) != "hi" {
+		t.Errorf("frames %s: %v", body, err)
+	}
+}
+
+func TestAdminFlowFormats(t *testing.T) {
+	p, srv := streamAdmin(t)
+	f := streamFlow("POST", "http://api.test/v1/users", 200)
+	f.Context.ID = "h1"
+	f.RequestBody = []byte("name=u")
+	p.Recent.WriteFlow(f)
+	frame := streamFlow("GET", "http://api.test/ws", 0)
+	frame.Context.ID = "w1"
+	p.Recent.WriteFlow(frame)
+
+	status, _, body := adminGet(t, srv.URL+"/api/flows/h1?format=curl")
+	if status != http.StatusOK || !strings.HasPrefix(body, "curl ") || !strings.Contains(body, "http://api.test/v1/users") || !strings.Contains(body, "name=u") {
+		t.Errorf("curl %d %q", status, body)
+	}
+	status, h, body := adminGet(t, srv.URL+"/api/flows/h1?format=har")
+	var har struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					Url string `json:"url"`
+				} `json:"request"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal([]byte(body), &har); err != nil || status != http.StatusOK || len(har.Log.Entries) != 1 ||
+		har.Log.Entries[0].Request.Url != "http://api.test/v1/users" {
+		t.Errorf("har %d %v: %s", status, err, body)
+	}
+	if cd := h.Get("Content-Disposition"); cd != `attachment; filename="h1.har"` {
+		t.Errorf("Content-Disposition %q", cd)
+	}
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/api/flows/w1?format=curl", http.StatusBadRequest},
+		{"/api/flows/h1?format=xml", http.StatusBadRequest},
+		{"/api/flows/h9", http.StatusNotFound},
+	} {
+		if status, _, body := adminGet(t, srv.URL+test.path); status != test.status {
+			t.Errorf("%s: %d %s, want %d", test.path, status, body, test.status)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package cproxy
 
 import (
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -46,4 +47,11 @@ func WriteToFile(filePath string, data []byte) error {
 	f.Write(data)
 	f.Close()
 	return nil
-}
\ No newline at end of file
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
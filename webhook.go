@@ -0,0 +1,219 @@
+package cproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	WEBHOOK_QUEUE_SIZE = 1000
+	WEBHOOK_TIMEOUT    = 10 * time.Second
+	WEBHOOK_RETRIES    = 5
+	WEBHOOK_SIGNATURE  = "X-Free-Proxy-Signature"
+)
+
+// Webhook configures the webhook sinks. Batch 0 or 1 posts every record as
+// a JSON object; a larger Batch posts JSON arrays of up to Batch records,
+// waiting at most Interval for a batch to fill.
+type Webhook struct {
+	URL      string // default endpoint of to-webhook actions without content
+	Secret   string // signs the body, see WebhookSink
+	Batch    int
+	Interval time.Duration
+}
+
+// WebhookSink posts flows to an HTTP endpoint from a bounded queue, in capture
+// order. With a secret every request carries
+//
+//	X-Free-Proxy-Signature: sha256=<hex HMAC-SHA256 of the body>
+//
+// Only 2xx answers deliver a batch. Network errors, 429 and 5xx answers are
+// retried with backoff up to WEBHOOK_RETRIES times; other answers, redirects
+// included, drop the batch.
+type WebhookSink struct {
+	URL string
+	Webhook
+
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+
+	written, dropped, failed, retries uint64
+}
+
+func NewWebhookSink(endpoint string, conf Webhook) *WebhookSink {
+	if conf.Interval <= 0 {
+		conf.Interval = time.Second
+	}
+	s := &WebhookSink{
+		URL:     endpoint,
+		Webhook: conf,
+		client: &http.Client{
+			Timeout: WEBHOOK_TIMEOUT,
+			// a redirect is an answer like any other, not a place to post again
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		queue: make(chan []byte, WEBHOOK_QUEUE_SIZE),
+		done:  make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.work()
+	return s
+}
+
+func (s *WebhookSink) WriteFlow(f *Flow) error {
+	msg, err := EncodeFlow(f, CAPTURE_SCHEMA_LATEST)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-s.done:
+		atomic.AddUint64(&s.dropped, 1)
+		return nil
+	default:
+	}
+	select {
+	case s.queue <- msg:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Stats() DeliveryStats {
+	return DeliveryStats{
+		Queued:  len(s.queue),
+		Written: atomic.LoadUint64(&s.written),
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Failed:  atomic.LoadUint64(&s.failed),
+		Retries: atomic.LoadUint64(&s.retries),
+	}
+}
+
+// Close posts what is queued, waiting at most SINK_DRAIN_TIMEOUT.
+func (s *WebhookSink) Close() error {
+	s.once.Do(func() { close(s.done) })
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(SINK_DRAIN_TIMEOUT):
+	}
+	return nil
+}
+
+func (s *WebhookSink) work() {
+	defer s.wg.Done()
+	for {
+		var batch [][]byte
+		select {
+		case msg := <-s.queue:
+			batch = append(batch, msg)
+		case <-s.done:
+			select {
+			case msg := <-s.queue:
+				batch = append(batch, msg)
+			default:
+				return
+			}
+		}
+		if s.Batch > 1 {
+			timer := time.NewTimer(s.Interval)
+		fill:
+			for len(batch) < s.Batch {
+				select {
+				case msg := <-s.queue:
+					batch = append(batch, msg)
+				case <-timer.C:
+					break fill
+				case <-s.done:
+					break fill
+				}
+			}
+			timer.Stop()
+		}
+		s.deliver(batch)
+	}
+}
+
+func (s *WebhookSink) deliver(batch [][]byte) {
+	body := batch[0]
+	if s.Batch > 1 {
+		body = append([]byte("["), bytes.Join(batch, []byte(","))...)
+		body = append(body, ']')
+	}
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			atomic.AddUint64(&s.written, uint64(len(batch)))
+			return
+		}
+		if !retry {
+			captureLog.Error("webhook refused records, dropping them", "url", s.URL, "records", len(batch), "err", err)
+			atomic.AddUint64(&s.failed, uint64(len(batch)))
+			return
+		}
+		if attempt > WEBHOOK_RETRIES {
+			captureLog.Error("webhook failed, giving up on records", "url", s.URL, "records", len(batch), "err", err)
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+			return
+		}
+		captureLog.Warn("webhook failed, retrying", "url", s.URL, "backoff", backoff, "err", err)
+		atomic.AddUint64(&s.retries, 1)
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			// closing: one more try right away, then give up
+			attempt = WEBHOOK_RETRIES
+		}
+		backoff *= 2
+	}
+}
+
+// post sends one body. It returns whether a failure is worth retrying.
+func (s *WebhookSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "free-proxy")
+	if s.Secret != "" {
+		req.Header.Set(WEBHOOK_SIGNATURE, SignWebhook(s.Secret, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return false, fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// SignWebhook returns the signature header value of a webhook body.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
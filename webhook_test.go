@@ -0,0 +1,141 @@
+package cproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookServer collects the bodies posted to it and answers them with the
+// statuses in turn, then 200. Redirects point to /moved.
+type hookServer struct {
+	*httptest.Server
+	statuses []int
+
+	bodies     [][]byte
+	signatures []string
+	lock       sync.Mutex
+}
+
+func newHookServer(statuses ...int) *hookServer {
+	h := &hookServer{statuses: statuses}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		h.lock.Lock()
+		h.bodies = append(h.bodies, b)
+		h.signatures = append(h.signatures, r.Header.Get(WEBHOOK_SIGNATURE))
+		status := http.StatusOK
+		if len(h.statuses) > 0 {
+			status, h.statuses = h.statuses[0], h.statuses[1:]
+		}
+		h.lock.Unlock()
+		if status >= 300 && status < 400 {
+			w.Header().Set("Location", "/moved")
+		}
+		w.WriteHeader(status)
+	}))
+	return h
+}
+
+func (h *hookServer) posts() ([][]byte, []string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.bodies, h.signatures
+}
+
+func hookFlow(path string) *Flow {
+	return &Flow{Request: httptest.NewRequest("GET", "http://api.test"+path, nil)}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	h := newHookServer()
+	defer h.Close()
+	s := NewWebhookSink(h.URL, Webhook{Secret: "s3cret"})
+	s.WriteFlow(hookFlow("/a"))
+	s.WriteFlow(hookFlow("/b"))
+	s.Close()
+
+	bodies, signatures := h.posts()
+	if len(bodies) != 2 {
+		t.Fatalf("%d posts, want one per flow", len(bodies))
+	}
+	for i, body := range bodies {
+		if _, err := DecodeRecord(body); err != nil {
+			t.Errorf("post %d: %v", i, err)
+		}
+		if want := SignWebhook("s3cret", body); signatures[i] != want {
+			t.Errorf("post %d: signature %q, want %q", i, signatures[i], want)
+		}
+	}
+	// known answer: HMAC-SHA256 of "{}" with key "key"
+	if got := SignWebhook("key", []byte("{}")); got != "sha256=a777724d943eb48dc69bca8a4a6d57a04db3f9ec7e1de4e581e860265bdf3032" {
+		t.Errorf("SignWebhook(key, {}) = %s", got)
+	}
+	if st := s.Stats(); st.Written != 2 || st.Dropped != 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestWebhookBatch(t *testing.T) {
+	h := newHookServer()
+	defer h.Close()
+	s := NewWebhookSink(h.URL, Webhook{Batch: 3, Interval: 50 * time.Millisecond})
+	for _, path := range []string{"/1", "/2", "/3", "/4"} {
+		s.WriteFlow(hookFlow(path))
+	}
+	time.Sleep(200 * time.Millisecond) // the last batch waits for the interval
+	s.Close()
+
+	bodies, signatures := h.posts()
+	var sizes []int
+	for _, body := range bodies {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		sizes = append(sizes, len(batch))
+	}
+	if !equalInts(sizes, []int{3, 1}) {
+		t.Errorf("batches of %v, want [3 1]", sizes)
+	}
+	if signatures[0] != "" {
+		t.Errorf("signed without a secret: %q", signatures[0])
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	for _, test := range []struct {
+		statuses []int
+		posts    int
+		written  uint64
+		failed   uint64
+	}{
+		{[]int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, 3, 1, 0},
+		{[]int{http.StatusBadGateway}, 2, 1, 0},
+		{[]int{http.StatusAccepted}, 1, 1, 0},
+		{[]int{http.StatusBadRequest}, 1, 0, 1},
+		{[]int{http.StatusTemporaryRedirect}, 1, 0, 1},
+		{[]int{http.StatusFound}, 1, 0, 1},
+		{[]int{http.StatusNotModified}, 1, 0, 1},
+	} {
+		h := newHookServer(test.statuses...)
+		s := NewWebhookSink(h.URL, Webhook{})
+		s.WriteFlow(hookFlow("/"))
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if st := s.Stats(); st.Written+st.Failed > 0 {
+				break
+			}
+		}
+		s.Close()
+		h.Close()
+		bodies, _ := h.posts()
+		st := s.Stats()
+		if len(bodies) != test.posts || st.Written != test.written || st.Failed != test.failed || st.Retries != uint64(test.posts-1) {
+			t.Errorf("answers %v: %d posts, stats %+v", test.statuses, len(bodies), st)
+		}
+	}
+}